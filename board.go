@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// boardBlobMax is the largest blob a board profile writes. Bootloaders are
+// a few MiB at most, so anything larger is most likely the wrong file.
+const boardBlobMax = 64 << 20
+
+// BoardWrite puts a part of one of the files of a profile at an offset of
+// the drive. Offsets and sizes take the forms ParseSize reads.
+type BoardWrite struct {
+	// File names the bootloader file the user picks. Writes with the same
+	// File share it.
+	File  string `json:"file"`
+	Skip  string `json:"skip,omitempty"`
+	Seek  string `json:"seek"`
+	Count string `json:"count,omitempty"`
+	// Limit is the room the write has before it runs into what follows,
+	// such as the next blob or the first partition.
+	Limit string `json:"limit,omitempty"`
+}
+
+// BoardProfile tells where the bootloader of a family of boards goes on the
+// drive. The profiles that come with Utkirna can be extended or replaced by
+// files in the boards directory of the configuration, one profile per file.
+type BoardProfile struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Writes      []BoardWrite `json:"writes"`
+
+	// source is the file the profile was loaded from.
+	source string
+}
+
+// boardBlob is a write of a profile with the file the user picked.
+type boardBlob struct {
+	file   string
+	path   string
+	r      RawRange
+	length int64
+}
+
+func boardProfileDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(configDir, "utkirna", "boards")
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+func parseBoardProfile(content []byte, source string) (BoardProfile, error) {
+	var profile BoardProfile
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&profile)
+	if err != nil {
+		return profile, errors.Join(fmt.Errorf("parseBoardProfile(): %s is not a board profile", source), err)
+	}
+	profile.source = source
+	return profile, profile.Check()
+}
+
+// Check makes sure every offset and size of the profile can be read.
+func (profile BoardProfile) Check() error {
+	if len(profile.Name) < 1 {
+		return fmt.Errorf("The board profile in %s has no name.", profile.source)
+	}
+	if len(profile.Writes) < 1 {
+		return fmt.Errorf("The board profile %q writes nothing.", profile.Name)
+	}
+	for _, write := range profile.Writes {
+		if len(write.File) < 1 {
+			return fmt.Errorf("A write of the board profile %q names no file.", profile.Name)
+		}
+		for _, size := range []string{write.Skip, write.Seek, write.Count, write.Limit} {
+			_, err := ParseSize(size)
+			if err != nil {
+				return errors.Join(fmt.Errorf("The board profile %q has a bad offset.", profile.Name), err)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadBoardProfiles returns the profiles that come with Utkirna and those of
+// the user, sorted by name. A profile of the user replaces the one of the
+// same name. Broken files are logged and left out.
+func LoadBoardProfiles() []BoardProfile {
+	profiles := map[string]BoardProfile{}
+
+	builtin, _ := boardProfilesFS.ReadDir("assets/boards")
+	for _, entry := range builtin {
+		name := path.Join("assets/boards", entry.Name())
+		content, err := boardProfilesFS.ReadFile(name)
+		if err != nil {
+			log.Printf("LoadBoardProfiles(): %s", err)
+			continue
+		}
+		profile, err := parseBoardProfile(content, name)
+		if err != nil {
+			log.Printf("LoadBoardProfiles(): %s", err)
+			continue
+		}
+		profiles[profile.Name] = profile
+	}
+
+	dir, err := boardProfileDir()
+	if err != nil {
+		log.Printf("LoadBoardProfiles(): boardProfileDir failed: %s", err)
+	} else {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		for _, file := range files {
+			content, err := os.ReadFile(file)
+			if err == nil {
+				var profile BoardProfile
+				profile, err = parseBoardProfile(content, file)
+				if err == nil {
+					profiles[profile.Name] = profile
+				}
+			}
+			if err != nil {
+				log.Printf("LoadBoardProfiles(): %s", err)
+			}
+		}
+	}
+
+	sorted := []BoardProfile{}
+	for _, profile := range profiles {
+		sorted = append(sorted, profile)
+	}
+	slices.SortFunc(sorted, func(a BoardProfile, b BoardProfile) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return sorted
+}
+
+// Files lists the files the user picks for the profile, in the order they
+// are first written.
+func (profile BoardProfile) Files() []string {
+	files := []string{}
+	for _, write := range profile.Writes {
+		if !slices.Contains(files, write.File) {
+			files = append(files, write.File)
+		}
+	}
+	return files
+}
+
+// plan resolves the writes of the profile against the files picked for it,
+// and makes sure every blob fits in its room and none runs into another.
+func (profile BoardProfile) plan(files map[string]string) ([]boardBlob, error) {
+	blobs := []boardBlob{}
+	for _, write := range profile.Writes {
+		blob := boardBlob{file: write.File, path: files[write.File]}
+		if len(blob.path) < 1 {
+			return nil, fmt.Errorf("Select the file for %s.", write.File)
+		}
+		blob.r.Skip, _ = ParseSize(write.Skip)
+		blob.r.Seek, _ = ParseSize(write.Seek)
+		blob.r.Count, _ = ParseSize(write.Count)
+		limit, _ := ParseSize(write.Limit)
+
+		stat, err := os.Stat(blob.path)
+		if err != nil {
+			return nil, errors.Join(errors.New("BoardProfile.plan(): Stat failed"), err)
+		}
+		blob.length, err = blob.r.Length(stat.Size())
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("%s:", write.File), err)
+		}
+		if limit > 0 && blob.length > limit {
+			return nil, fmt.Errorf(
+				"%s is %d bytes, only %d bytes fit at byte %d.",
+				write.File,
+				blob.length,
+				limit,
+				blob.r.Seek,
+			)
+		}
+		if blob.length > boardBlobMax {
+			return nil, fmt.Errorf("%s is too large for a bootloader (%s).", write.File, fmtBytes(blob.length))
+		}
+		blobs = append(blobs, blob)
+	}
+
+	sorted := slices.Clone(blobs)
+	slices.SortFunc(sorted, func(a boardBlob, b boardBlob) int {
+		return cmp.Compare(a.r.Seek, b.r.Seek)
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].r.Seek+sorted[i-1].length > sorted[i].r.Seek {
+			return nil, fmt.Errorf("%s runs into %s at byte %d.", sorted[i-1].file, sorted[i].file, sorted[i].r.Seek)
+		}
+	}
+	return blobs, nil
+}
+
+// CheckBoard checks the profile and the files of a board job before it is
+// started, and warns about the partition table and the partitions of the
+// drive the blobs overwrite.
+func CheckBoard(data *MainData) ([]string, error) {
+	blobs, err := data.board.plan(data.boardFiles)
+	if err != nil {
+		return nil, err
+	}
+	table, err := ListPartitions(data.selectedDisk, data.selectedIdentity)
+	if err != nil {
+		return []string{"The partition table of the drive could not be read, overlaps are not checked."}, nil
+	}
+
+	warnings := []string{}
+	for _, blob := range blobs {
+		for _, overlap := range table.Overlaps(blob.r.Seek, blob.length) {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s at bytes %d to %d overlaps %s.",
+				blob.file,
+				blob.r.Seek,
+				blob.r.Seek+blob.length,
+				overlap,
+			))
+		}
+	}
+	return warnings, nil
+}
+
+// sectors returns the first sector of the drive the blob touches and a
+// buffer covering every sector it touches.
+func (blob boardBlob) sectors(layout diskGeometry) (int64, []byte, error) {
+	sectorSize := int64(layout.sectorSize)
+	first := blob.r.Seek / sectorSize
+	end := (blob.r.Seek + blob.length + sectorSize - 1) / sectorSize
+	if end > layout.numSectors {
+		return 0, nil, fmt.Errorf("%s lies past the end of the drive", blob.file)
+	}
+	return first, alignedBuffer(int((end-first)*sectorSize), layout.alignment), nil
+}
+
+// read returns the part of its file the blob writes.
+func (blob boardBlob) read() ([]byte, error) {
+	file, err := os.Open(blob.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content := make([]byte, blob.length)
+	_, err = file.ReadAt(content, blob.r.Skip)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return content, nil
+}
+
+// write puts the blob on the drive. The sectors it only partly covers keep
+// what they held around it, as the MBR does for an Amlogic bootloader.
+func (blob boardBlob) write(handles Handles, layout diskGeometry, content []byte) error {
+	first, buf, err := blob.sectors(layout)
+	if err != nil {
+		return err
+	}
+	err = readDiskSectors(handles, &buf, first, layout.sectorSize)
+	if err != nil {
+		return errors.Join(errors.New("boardBlob.write(): readDiskSectors failed"), err)
+	}
+	copy(buf[blob.r.Seek-first*int64(layout.sectorSize):], content)
+	err = writeDiskSectors(handles, &buf, first, layout.sectorSize)
+	if err != nil {
+		return errors.Join(errors.New("boardBlob.write(): writeDiskSectors failed"), err)
+	}
+	return nil
+}
+
+func (blob boardBlob) verify(handles Handles, layout diskGeometry, content []byte) error {
+	first, buf, err := blob.sectors(layout)
+	if err != nil {
+		return err
+	}
+	err = readDiskSectors(handles, &buf, first, layout.sectorSize)
+	if err != nil {
+		return errors.Join(errors.New("boardBlob.verify(): readDiskSectors failed"), err)
+	}
+	start := blob.r.Seek - first*int64(layout.sectorSize)
+	if !bytes.Equal(buf[start:start+blob.length], content) {
+		return fmt.Errorf("Verification failed: %s does not read back as written", blob.file)
+	}
+	return nil
+}
+
+// FlashBoard writes the bootloader files of data.board at their offsets of
+// the selected drive, then reads them back.
+func FlashBoard(data *MainData, ui Frontend, handles Handles) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	go func() {
+		defer func() { cleanUp(data, ui, handles) }()
+
+		layout, err := getDiskGeometry(handles)
+		if err != nil {
+			ui.HandleError(data, errors.Join(errors.New("FlashBoard(): getDiskGeometry failed"), err))
+			return
+		}
+		blobs, err := data.board.plan(data.boardFiles)
+		if err != nil {
+			ui.HandleError(data, err)
+			return
+		}
+		contents := [][]byte{}
+		total := int64(0)
+		for _, blob := range blobs {
+			content, err := blob.read()
+			if err != nil {
+				ui.HandleError(data, errors.Join(fmt.Errorf("FlashBoard(): reading %s failed", blob.path), err))
+				return
+			}
+			contents = append(contents, content)
+			total += blob.length
+		}
+		data.report.AddNote("Board profile %s", data.board.Name)
+
+		// Every blob is written before any is read back, twice the length
+		// in all.
+		done := int64(0)
+		ui.SetProgress(0, 2*total)
+		for i, blob := range blobs {
+			select {
+			case <-data.bQuitTask:
+				return
+			default:
+			}
+			ui.SetStatus(fmt.Sprintf("Writing %s...", blob.file))
+			err = blob.write(handles, layout, contents[i])
+			if err != nil {
+				ui.HandleError(data, err)
+				return
+			}
+			data.report.AddNote("Wrote %s (%s), %s", blob.path, fmtBytes(blob.length), blob.r)
+			done += blob.length
+			ui.SetProgress(done, 2*total)
+		}
+
+		err = SyncDisk(handles)
+		if err == nil {
+			err = FlushDiskCache(handles)
+		}
+		if err != nil {
+			ui.HandleError(data, errors.Join(errors.New("FlashBoard(): SyncDisk failed"), err))
+			return
+		}
+
+		ui.SetStatus("Verifying...")
+		for i, blob := range blobs {
+			err = blob.verify(handles, layout, contents[i])
+			if err != nil {
+				ui.HandleError(data, err)
+				return
+			}
+			done += blob.length
+			ui.SetProgress(done, 2*total)
+		}
+
+		ui.HandleSuccess(fmt.Sprintf("The bootloader for %s was written and verified.", data.board.Name))
+	}()
+}
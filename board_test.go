@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoardProfilePlan(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	for name, size := range map[string]int64{"spl": 32 << 10, "u-boot": 1 << 20, "rootfs": boardBlobMax + 1} {
+		files[name] = filepath.Join(dir, name)
+		file, err := os.Create(files[name])
+		if err == nil {
+			err = file.Truncate(size)
+			file.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		writes []BoardWrite
+		// want holds the offset on the drive and the length of every blob.
+		want    [][2]int64
+		wantErr bool
+	}{
+		{
+			name: "within their limits",
+			writes: []BoardWrite{
+				{File: "spl", Seek: "8K", Limit: "32K"},
+				{File: "u-boot", Seek: "40K", Limit: "2M"},
+			},
+			want: [][2]int64{{8 << 10, 32 << 10}, {40 << 10, 1 << 20}},
+		},
+		{
+			name: "out of order",
+			writes: []BoardWrite{
+				{File: "u-boot", Seek: "40K"},
+				{File: "spl", Seek: "16s"},
+			},
+			want: [][2]int64{{40 << 10, 1 << 20}, {8 << 10, 32 << 10}},
+		},
+		{
+			name: "parts of one file",
+			writes: []BoardWrite{
+				{File: "u-boot", Seek: "32K", Count: "64K"},
+				{File: "u-boot", Skip: "64K", Seek: "1M"},
+			},
+			want: [][2]int64{{32 << 10, 64 << 10}, {1 << 20, 1<<20 - 64<<10}},
+		},
+		{
+			name:    "no file picked",
+			writes:  []BoardWrite{{File: "idbloader", Seek: "32K"}},
+			wantErr: true,
+		},
+		{
+			name:    "over the limit",
+			writes:  []BoardWrite{{File: "spl", Seek: "8K", Limit: "16K"}},
+			wantErr: true,
+		},
+		{
+			name: "overlapping",
+			writes: []BoardWrite{
+				{File: "spl", Seek: "8K"},
+				{File: "u-boot", Seek: "32K"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "skip past the end",
+			writes:  []BoardWrite{{File: "spl", Skip: "32K", Seek: "8K"}},
+			wantErr: true,
+		},
+		{
+			name:    "too large for a bootloader",
+			writes:  []BoardWrite{{File: "rootfs", Seek: "1M"}},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile := BoardProfile{Name: "test", Writes: test.writes}
+			blobs, err := profile.plan(files)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("plan() accepted the profile")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blobs) != len(test.want) {
+				t.Fatalf("got %d blobs, want %d", len(blobs), len(test.want))
+			}
+			for i, want := range test.want {
+				got := [2]int64{blobs[i].r.Seek, blobs[i].length}
+				if got != want {
+					t.Errorf("blob %d is %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"unsafe"
+)
+
+const ioAlignment = 4096
+
+// alignedBuffer returns a zeroed slice whose first byte sits on an align
+// boundary, as required by O_DIRECT and FILE_FLAG_NO_BUFFERING handles.
+func alignedBuffer(size int, align int) []byte {
+	buf := make([]byte, size+align)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(align-1)); rem != 0 {
+		offset = align - rem
+	}
+	return buf[offset : offset+size : offset+size]
+}
+
+// BufferPool hands out equally sized buffers aligned to the block size of
+// the device a job is working on.
+type BufferPool struct {
+	size  int
+	align int
+	pool  sync.Pool
+}
+
+func NewBufferPool(size int, align int) *BufferPool {
+	if align < ioAlignment {
+		align = ioAlignment
+	}
+	bp := &BufferPool{size: size, align: align}
+	bp.pool.New = func() any {
+		return alignedBuffer(bp.size, bp.align)
+	}
+	return bp
+}
+
+func (bp *BufferPool) Get() []byte {
+	return bp.pool.Get().([]byte)
+}
+
+func (bp *BufferPool) Put(buf []byte) {
+	if cap(buf) != bp.size {
+		return
+	}
+	bp.pool.Put(buf[:bp.size])
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const certificateVersion = 1
+
+// WipeCertificate records how and with what result a drive was wiped. It is
+// issued for every wipe that got to touch the drive, failed ones included.
+type WipeCertificate struct {
+	Version  int
+	Host     string
+	Operator string
+	Device   string
+	Identity DiskIdentity
+	Method   string
+	Passes   []string
+	// Verification is passed, skipped or not verifiable, and empty when the
+	// wipe did not get to it.
+	Verification string `json:",omitempty"`
+	SectorSize   int
+	Sectors      int64
+	Started      time.Time
+	Ended        time.Time
+	// Result is passed, failed or cancelled.
+	Result string
+	Error  string `json:",omitempty"`
+	// Digest is the SHA-256 of the certificate with an empty Digest. It is
+	// only a checksum against accidental damage: anyone who edits the
+	// certificate can compute it again.
+	Digest string
+}
+
+func NewWipeCertificate(data *MainData) *WipeCertificate {
+	certificate := &WipeCertificate{
+		Version:  certificateVersion,
+		Device:   data.selectedDrive,
+		Identity: data.selectedIdentity,
+		Method:   data.wipeMethod.String(),
+		Started:  time.Now(),
+	}
+	if !data.verify {
+		certificate.Verification = "skipped"
+	}
+	certificate.Host, _ = os.Hostname()
+	if current, err := user.Current(); err == nil {
+		certificate.Operator = current.Username
+	}
+	return certificate
+}
+
+// Finish records the outcome of the wipe and computes the digest.
+func (certificate *WipeCertificate) Finish(err error) {
+	certificate.Ended = time.Now()
+	if err == nil {
+		certificate.Result = "passed"
+		if len(certificate.Verification) < 1 {
+			certificate.Verification = "passed"
+		}
+	} else if errors.Is(err, errCancelled) {
+		certificate.Result = "cancelled"
+	} else {
+		certificate.Result = "failed"
+		certificate.Error = err.Error()
+	}
+	certificate.Digest = certificate.digest()
+}
+
+func (certificate *WipeCertificate) digest() string {
+	unsigned := *certificate
+	unsigned.Digest = ""
+	content, _ := json.Marshal(unsigned)
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+func (certificate *WipeCertificate) String() string {
+	var content strings.Builder
+	fmt.Fprintf(&content, "Utkirna wipe certificate\n\n")
+	fmt.Fprintf(&content, "Device:   %s (%s)\n", certificate.Device, certificate.Identity)
+	if len(certificate.Identity.Vendor) > 0 {
+		fmt.Fprintf(&content, "Vendor:   %s\n", certificate.Identity.Vendor)
+	}
+	fmt.Fprintf(&content, "Sectors:  %d of %d bytes\n", certificate.Sectors, certificate.SectorSize)
+	fmt.Fprintf(&content, "Method:   %s\n", certificate.Method)
+	for i, pass := range certificate.Passes {
+		fmt.Fprintf(&content, "  Pass %d: %s\n", i+1, pass)
+	}
+	if len(certificate.Verification) > 0 {
+		fmt.Fprintf(&content, "Verified: %s\n", certificate.Verification)
+	}
+	fmt.Fprintf(&content, "Started:  %s\n", certificate.Started.Format(time.RFC3339))
+	fmt.Fprintf(&content, "Ended:    %s\n", certificate.Ended.Format(time.RFC3339))
+	fmt.Fprintf(&content, "Result:   %s\n", certificate.Result)
+	if len(certificate.Error) > 0 {
+		fmt.Fprintf(&content, "Error:    %s\n", certificate.Error)
+	}
+	fmt.Fprintf(&content, "\nSigned off by %s on %s\n", certificate.Operator, certificate.Host)
+	fmt.Fprintf(&content, "Checksum: %s (SHA-256, not a signature)\n", certificate.Digest)
+	return content.String()
+}
+
+// safeFileName names a drive in file names by its serial, or its device name
+// when it has none.
+func safeFileName(identity DiskIdentity, device string) string {
+	name := identity.Serial
+	if len(name) < 1 {
+		name = filepath.Base(device)
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// Save writes the certificate as JSON and as text to the certificates
+// directory and returns the path of the JSON file. The text file sits next
+// to it with the .txt extension.
+func (certificate *WipeCertificate) Save() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Join(errors.New("WipeCertificate.Save(): UserConfigDir failed"), err)
+	}
+	dir := filepath.Join(configDir, "utkirna", "certificates")
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", errors.Join(errors.New("WipeCertificate.Save(): MkdirAll failed"), err)
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf(
+		"%s-wipe-%s",
+		certificate.Started.Format("20060102-150405"),
+		safeFileName(certificate.Identity, certificate.Device),
+	))
+
+	content, err := json.MarshalIndent(certificate, "", "  ")
+	if err != nil {
+		return "", errors.Join(errors.New("WipeCertificate.Save(): MarshalIndent failed"), err)
+	}
+	err = os.WriteFile(base+".json", content, 0o600)
+	if err != nil {
+		return "", errors.Join(errors.New("WipeCertificate.Save(): WriteFile failed"), err)
+	}
+	err = os.WriteFile(base+".txt", []byte(certificate.String()), 0o600)
+	if err != nil {
+		return "", errors.Join(errors.New("WipeCertificate.Save(): WriteFile failed"), err)
+	}
+	return base + ".json", nil
+}
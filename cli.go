@@ -0,0 +1,849 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// Options are the settings that can be given on the command line, both for
+// the GUI and for the commands below.
+type Options struct {
+	AllDisks bool
+	Retry    RetryPolicy
+}
+
+type command struct {
+	usage string
+	run   func(options Options, args []string) int
+}
+
+var commands = map[string]command{
+	"list":    {"list the drives Utkirna can work with", listCommand},
+	"resume":  {"resume the interrupted job recorded in a journal", resumeCommand},
+	"write":   {"write an image to a drive and verify it", writeCommand},
+	"undo":    {"put back what the last write to a drive overwrote", undoCommand},
+	"clone":   {"copy one drive onto another", cloneCommand},
+	"wipe":    {"erase a drive and issue a certificate", wipeCommand},
+	"format":  {"restore a drive to a single FAT32 or exFAT partition", formatCommand},
+	"table":   {"save or restore the partition table of a drive", tableCommand},
+	"board":   {"write the bootloader of a board at its offsets of a drive", boardCommand},
+	"compose": {"compose a disk from partition images, onto a drive or into an image", composeCommand},
+}
+
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintf(flags.Output(), "Usage: utkirna [options] [command [arguments]]\n\nOptions:\n")
+	flags.PrintDefaults()
+	fmt.Fprintf(flags.Output(), "\nCommands:\n")
+	for name, cmd := range commands {
+		fmt.Fprintf(flags.Output(), "  %-10s %s\n", name, cmd.usage)
+	}
+	fmt.Fprintf(flags.Output(), "\nWithout a command the GUI is started.\n")
+}
+
+// ParseArgs parses the global options. The remaining arguments name a
+// command, or are files handed over by the desktop and ignored.
+func ParseArgs(args []string) (Options, []string, error) {
+	var options Options
+
+	flags := flag.NewFlagSet("utkirna", flag.ContinueOnError)
+	flags.BoolVar(
+		&options.AllDisks,
+		"all-disks",
+		false,
+		"list every whole-disk block device, not only removable ones",
+	)
+	flags.IntVar(
+		&options.Retry.Count,
+		"retries",
+		DefaultRetryPolicy.Count,
+		"how many times a failed read or write of the drive is retried",
+	)
+	flags.DurationVar(
+		&options.Retry.Backoff,
+		"retry-backoff",
+		DefaultRetryPolicy.Backoff,
+		"wait before the first retry, doubled for every further one",
+	)
+	flags.BoolVar(
+		&options.Retry.Split,
+		"retry-split",
+		DefaultRetryPolicy.Split,
+		"retry a chunk that keeps failing in smaller pieces",
+	)
+	flags.Usage = func() { usage(flags) }
+
+	err := flags.Parse(args)
+	return options, flags.Args(), err
+}
+
+// RunCommand runs the command named by args and returns its exit code. It
+// returns false when args do not name a command.
+func RunCommand(options Options, args []string) (int, bool) {
+	if len(args) < 1 {
+		return 0, false
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return 0, false
+	}
+	return cmd.run(options, args[1:]), true
+}
+
+func printAllDisksWarning() {
+	fmt.Fprintln(
+		os.Stderr,
+		"WARNING: every disk is listed, including internal ones. Writing to the wrong one destroys its data.",
+	)
+}
+
+func listCommand(options Options, args []string) int {
+	if options.AllDisks {
+		printAllDisksWarning()
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "DRIVE\tBUS\tREMOVABLE\tSTATE")
+	for _, disk := range GetDisks(options.AllDisks) {
+		state := "read-write"
+		if disk.System {
+			state = "system disk"
+		} else if disk.ReadOnly {
+			state = "read-only"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%t\t%s\n", disk.Path, disk.Bus, disk.Removable, state)
+	}
+	writer.Flush()
+	return 0
+}
+
+// cliFrontend reports the progress of a job on the terminal. The job and the
+// interrupt handler both report through it, hence the lock.
+type cliFrontend struct {
+	mutex   sync.Mutex
+	status  string
+	speed   string
+	percent int64
+	failed  bool
+	done    chan struct{}
+	once    sync.Once
+	// mismatch answers for the user when the partition table of the image
+	// was built for another sector size than the one of the drive.
+	mismatch MismatchChoice
+}
+
+func (cli *cliFrontend) SetStatus(status string) {
+	cli.mutex.Lock()
+	defer cli.mutex.Unlock()
+	cli.status = status
+	fmt.Fprintf(os.Stderr, "\n%s\n", status)
+}
+
+func (cli *cliFrontend) SetSpeed(speed string) {
+	cli.mutex.Lock()
+	defer cli.mutex.Unlock()
+	cli.speed = speed
+}
+
+func (cli *cliFrontend) SetElapsed(elapsed string) {}
+
+func (cli *cliFrontend) ShowRescueMap(rescueMap *RescueMap) {}
+
+func (cli *cliFrontend) SetProgress(done int64, total int64) {
+	cli.mutex.Lock()
+	defer cli.mutex.Unlock()
+	percent := done * 100 / max(total, 1)
+	if percent != cli.percent {
+		cli.percent = percent
+		fmt.Fprintf(os.Stderr, "\r%3d%%  %-12s", percent, cli.speed)
+	}
+}
+
+func (cli *cliFrontend) HandleError(data *MainData, err error) {
+	cli.setFailed()
+	fmt.Fprintf(os.Stderr, "\nError: %s\n", err)
+}
+
+func (cli *cliFrontend) HandleSuccess(message string) {
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Println(message)
+}
+
+func (cli *cliFrontend) setFailed() {
+	cli.mutex.Lock()
+	defer cli.mutex.Unlock()
+	cli.failed = true
+}
+
+func (cli *cliFrontend) JobFinished(data MainData) {
+	cli.once.Do(func() { close(cli.done) })
+}
+
+func (cli *cliFrontend) ConfirmSectorSizeMismatch(imageSector int, diskSector int, callback func(MismatchChoice)) {
+	fmt.Fprintf(
+		os.Stderr,
+		"The partition table of the image was built for %d-byte sectors, the drive uses %d-byte sectors.\n",
+		imageSector,
+		diskSector,
+	)
+	switch cli.mismatch {
+	case MISMATCH_TRANSLATE:
+		fmt.Fprintln(os.Stderr, "The partition table is translated while writing.")
+	case MISMATCH_AS_IS:
+		fmt.Fprintln(os.Stderr, "The image is written as is.")
+	default:
+		cli.setFailed()
+		fmt.Fprintln(
+			os.Stderr,
+			"Nothing was written. Use --translate to translate the partition table while writing, or --as-is to write the image unchanged.",
+		)
+	}
+	callback(cli.mismatch)
+}
+
+// mismatchChoice turns the --translate and --as-is flags into the answer to
+// a sector size mismatch.
+func mismatchChoice(translate bool, asIs bool) (MismatchChoice, error) {
+	if translate && asIs {
+		return MISMATCH_CANCEL, errors.New("--translate and --as-is cannot be used together")
+	}
+	if translate {
+		return MISMATCH_TRANSLATE, nil
+	}
+	if asIs {
+		return MISMATCH_AS_IS, nil
+	}
+	return MISMATCH_CANCEL, nil
+}
+
+func resumeCommand(options Options, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna resume <journal>")
+		return 2
+	}
+
+	journal, err := LoadJournal(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	data := MainData{retry: options.Retry}
+	err = PrepareResume(&data, journal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Resuming %s\n", journal)
+	return runJob(&data)
+}
+
+// runJob runs a job that has been set up in data on the terminal and returns
+// the exit code for its outcome. The first interrupt cancels the job the same
+// way the GUI does, which keeps its journal for another try.
+func runJob(data *MainData) int {
+	return runWriteJob(data, MISMATCH_CANCEL)
+}
+
+// runWriteJob is runJob for jobs that write an image or a drive, with the
+// answer given on the command line for a sector size mismatch.
+func runWriteJob(data *MainData, mismatch MismatchChoice) int {
+	cli := &cliFrontend{done: make(chan struct{}), percent: -1, mismatch: mismatch}
+
+	// An interrupt that comes while the job is being started waits in the
+	// channel until the job can be cancelled.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	StartMainTask(data, cli)
+	quit := data.bQuitTask
+	go func() {
+		select {
+		case <-interrupt:
+			cli.setFailed()
+			select {
+			case quit <- struct{}{}:
+				fmt.Fprintln(os.Stderr, "\nCancelled")
+			case <-cli.done:
+			}
+		case <-cli.done:
+		}
+	}()
+	<-cli.done
+
+	cli.mutex.Lock()
+	defer cli.mutex.Unlock()
+	if cli.failed {
+		return 1
+	}
+	return 0
+}
+
+// findListedDisk looks up a drive given on the command line among the drives
+// Utkirna lists.
+func findListedDisk(options Options, path string) (Disk, DiskIdentity, error) {
+	for _, disk := range GetDisks(options.AllDisks) {
+		if disk.Path != path {
+			continue
+		}
+		identity, err := GetDiskIdentity(disk.Path)
+		return disk, identity, err
+	}
+	return Disk{}, DiskIdentity{}, fmt.Errorf(
+		"%s is not a drive Utkirna can work with; see \"utkirna list\" and -all-disks",
+		path,
+	)
+}
+
+// confirm asks a yes/no question on the terminal.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	var answer string
+	fmt.Scanln(&answer)
+	return answer == "y" || answer == "Y" || answer == "yes"
+}
+
+func writeCommand(options Options, args []string) int {
+	data := MainData{retry: options.Retry, taskType: START_WRITE}
+	var drive string
+	var yes, noPad, noSnapshot, translate, asIs bool
+	var partition int
+	var skip, seek, count string
+
+	flags := flag.NewFlagSet("utkirna write", flag.ContinueOnError)
+	flags.StringVar(&data.imagePath, "image", "", "the image to write")
+	flags.StringVar(&drive, "drive", "", "the drive to write to; everything on it is replaced")
+	flags.IntVar(&partition, "partition", 0, "write the image into this partition of the drive instead of over the whole drive")
+	flags.StringVar(&skip, "skip", "", "start reading the image at this offset, such as 8K, 1M or 64s (512-byte sectors)")
+	flags.StringVar(&seek, "seek", "", "start writing the drive at this offset, leaving what is before it as it is")
+	flags.StringVar(&count, "count", "", "write only this much of the image")
+	flags.BoolVar(&data.ignoreSize, "ignore-size", false, "write even if the image is larger than the drive")
+	flags.BoolVar(&noPad, "no-pad", false, "keep the rest of the last partial sector as it is on the drive")
+	flags.BoolVar(&data.clearTail, "clear-tail", false, "discard the rest of the drive after the image")
+	flags.BoolVar(&data.skipZeros, "skip-zeros", false, "discard or zero the drive first, then skip the chunks of zeros (every chunk is written if it can do neither)")
+	flags.BoolVar(&data.assumeBlank, "blank", false, "the drive is already blank, skip the chunks of zeros")
+	flags.BoolVar(&data.deltaWrite, "delta", false, "read the drive first and write only the chunks that differ")
+	flags.BoolVar(&noSnapshot, "no-snapshot", false, "do not save what is overwritten for \"utkirna undo\"")
+	flags.BoolVar(&translate, "translate", false, "translate a partition table built for another sector size than the drive's")
+	flags.BoolVar(&asIs, "as-is", false, "write an image whose partition table was built for another sector size unchanged")
+	flags.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if len(data.imagePath) < 1 || len(drive) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna write --image <file> --drive <drive> [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+	data.padTail = !noPad
+	data.snapshot = !noSnapshot
+	data.skipZeros = data.skipZeros || data.assumeBlank
+	mismatch, err := mismatchChoice(translate, asIs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for _, size := range []struct {
+		flag  string
+		value string
+		n     *int64
+	}{
+		{"--skip", skip, &data.rawRange.Skip},
+		{"--seek", seek, &data.rawRange.Seek},
+		{"--count", count, &data.rawRange.Count},
+	} {
+		*size.n, err = ParseSize(size.value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", size.flag, err)
+			return 2
+		}
+	}
+
+	if options.AllDisks {
+		printAllDisksWarning()
+	}
+	data.selectedDisk, data.selectedIdentity, err = findListedDisk(options, drive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data.selectedDrive = data.selectedDisk.Path
+
+	target := fmt.Sprintf("Everything on %s (%s)", drive, data.selectedIdentity)
+	if partition > 0 {
+		table, err := ListPartitions(data.selectedDisk, data.selectedIdentity)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, p := range table.Partitions {
+			if p.Index == partition && p.Extended {
+				fmt.Fprintf(os.Stderr, "Partition %d is an extended partition, which only holds other partitions.\n", partition)
+				return 1
+			}
+			if p.Index == partition {
+				data.partition = p
+				target = fmt.Sprintf("%s of %s (%s)", table.Describe(p), drive, data.selectedIdentity)
+			}
+		}
+		if data.partition.Index == 0 {
+			fmt.Fprintf(os.Stderr, "%s has no partition %d.\n", drive, partition)
+			return 1
+		}
+	}
+
+	question := fmt.Sprintf("%s will be replaced by %s. Continue?", target, data.imagePath)
+	if data.rawRange.IsSet() {
+		warnings, err := CheckRawRange(&data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, warning := range warnings {
+			fmt.Fprintln(os.Stderr, "Warning: "+warning)
+		}
+		question = fmt.Sprintf("%s will be written %s. Continue?", data.imagePath, data.rawRange)
+	}
+
+	if !yes && !confirm(question) {
+		return 1
+	}
+	return runWriteJob(&data, mismatch)
+}
+
+func undoCommand(options Options, args []string) int {
+	data := MainData{retry: options.Retry, taskType: START_RESTORE}
+	var drive string
+	var yes bool
+
+	flags := flag.NewFlagSet("utkirna undo", flag.ContinueOnError)
+	flags.StringVar(&drive, "drive", "", "the drive to undo the last write on")
+	flags.StringVar(&data.snapshotPath, "snapshot", "", "the snapshot to put back instead of the latest one")
+	flags.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if len(drive) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna undo --drive <drive> [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	if options.AllDisks {
+		printAllDisksWarning()
+	}
+	data.selectedDisk, data.selectedIdentity, err = findListedDisk(options, drive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data.selectedDrive = data.selectedDisk.Path
+
+	var snapshot *Snapshot
+	if len(data.snapshotPath) > 0 {
+		snapshot, err = LoadSnapshot(data.snapshotPath)
+	} else {
+		snapshot, err = LatestSnapshot(data.selectedIdentity)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if snapshot == nil {
+		fmt.Fprintf(os.Stderr, "No snapshot was saved for %s.\n", drive)
+		return 1
+	}
+	data.snapshotPath = snapshot.path
+
+	if !yes && !confirm(fmt.Sprintf(
+		"The snapshot of %s will be put back. Everything written to the drive since is lost. Continue?",
+		snapshot,
+	)) {
+		return 1
+	}
+	return runJob(&data)
+}
+
+func cloneCommand(options Options, args []string) int {
+	data := MainData{retry: options.Retry, taskType: START_CLONE, padTail: true}
+	var from, to string
+	var yes, noVerify, translate, asIs bool
+
+	flags := flag.NewFlagSet("utkirna clone", flag.ContinueOnError)
+	flags.StringVar(&from, "from", "", "the drive to copy from")
+	flags.StringVar(&to, "to", "", "the drive to copy to; everything on it is replaced")
+	flags.BoolVar(&data.mbrCheck, "allocated", false, "copy only the allocated partitions of the source")
+	flags.BoolVar(&noVerify, "no-verify", false, "skip the verification of the copy")
+	flags.BoolVar(&translate, "translate", false, "translate the partition table when the drives use different sector sizes")
+	flags.BoolVar(&asIs, "as-is", false, "copy the partition table unchanged when the drives use different sector sizes")
+	flags.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if len(from) < 1 || len(to) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna clone --from <drive> --to <drive> [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+	data.verify = !noVerify
+	mismatch, err := mismatchChoice(translate, asIs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if options.AllDisks {
+		printAllDisksWarning()
+	}
+	data.sourceDisk, data.sourceIdentity, err = findListedDisk(options, from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data.selectedDisk, data.selectedIdentity, err = findListedDisk(options, to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data.selectedDrive = data.selectedDisk.Path
+	data.imagePath = SourceDevicePath(data.sourceDisk, data.sourceIdentity)
+
+	if !yes && !confirm(fmt.Sprintf(
+		"Everything on %s (%s) will be replaced by a copy of %s (%s). Continue?",
+		to,
+		data.selectedIdentity,
+		from,
+		data.sourceIdentity,
+	)) {
+		return 1
+	}
+	return runWriteJob(&data, mismatch)
+}
+
+func wipeCommand(options Options, args []string) int {
+	data := MainData{retry: options.Retry, taskType: START_WIPE}
+	var drive, method string
+	var yes, noVerify bool
+
+	flags := flag.NewFlagSet("utkirna wipe", flag.ContinueOnError)
+	flags.StringVar(&drive, "drive", "", "the drive to wipe")
+	flags.StringVar(
+		&method,
+		"method",
+		WIPE_ZERO.String(),
+		"one of "+strings.Join(wipeMethodNames, ", "),
+	)
+	flags.BoolVar(&noVerify, "no-verify", false, "skip reading the drive back")
+	flags.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if len(drive) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna wipe --drive <drive> [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+	data.wipeMethod, err = ParseWipeMethod(method)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	data.verify = !noVerify
+
+	if options.AllDisks {
+		printAllDisksWarning()
+	}
+	data.selectedDisk, data.selectedIdentity, err = findListedDisk(options, drive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data.selectedDrive = data.selectedDisk.Path
+
+	if !yes && !confirm(fmt.Sprintf(
+		"Everything on %s (%s) will be erased for good. Continue?",
+		drive,
+		data.selectedIdentity,
+	)) {
+		return 1
+	}
+	return runJob(&data)
+}
+
+func formatCommand(options Options, args []string) int {
+	data := MainData{retry: options.Retry, taskType: START_FORMAT}
+	var drive, table, fileSystem string
+	var yes bool
+
+	flags := flag.NewFlagSet("utkirna format", flag.ContinueOnError)
+	flags.StringVar(&drive, "drive", "", "the drive to format")
+	flags.StringVar(&table, "table", "mbr", "the partition table, mbr or gpt")
+	flags.StringVar(&fileSystem, "fs", "fat32", "the filesystem, fat32 or exfat")
+	flags.StringVar(&data.format.Label, "label", "", "the volume label")
+	flags.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if len(drive) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna format --drive <drive> [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+	data.format.Table, err = ParseTableType(table)
+	if err == nil {
+		data.format.FileSystem, err = ParseFileSystem(fileSystem)
+	}
+	if err == nil {
+		err = data.format.CheckLabel()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if options.AllDisks {
+		printAllDisksWarning()
+	}
+	data.selectedDisk, data.selectedIdentity, err = findListedDisk(options, drive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data.selectedDrive = data.selectedDisk.Path
+
+	if !yes && !confirm(fmt.Sprintf(
+		"Everything on %s (%s) will be lost. Continue?",
+		drive,
+		data.selectedIdentity,
+	)) {
+		return 1
+	}
+	return runJob(&data)
+}
+
+func tableCommand(options Options, args []string) int {
+	data := MainData{retry: options.Retry}
+	var drive string
+	var yes bool
+
+	flags := flag.NewFlagSet("utkirna table", flag.ContinueOnError)
+	flags.StringVar(&drive, "drive", "", "the drive whose partition table is saved or restored")
+	flags.StringVar(&data.imagePath, "file", "", "the backup file, by default a new one in the settings folder when saving")
+	flags.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	if len(args) > 0 && args[0] == "save" {
+		data.taskType = START_TABLE_BACKUP
+	} else if len(args) > 0 && args[0] == "restore" {
+		data.taskType = START_TABLE_RESTORE
+	} else {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna table save|restore --drive <drive> [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	if len(drive) < 1 || flags.NArg() > 0 || (data.taskType == START_TABLE_RESTORE && len(data.imagePath) < 1) {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna table save|restore --drive <drive> [--file <backup>] [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	if options.AllDisks {
+		printAllDisksWarning()
+	}
+	data.selectedDisk, data.selectedIdentity, err = findListedDisk(options, drive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data.selectedDrive = data.selectedDisk.Path
+
+	if data.taskType == START_TABLE_BACKUP {
+		if len(data.imagePath) < 1 {
+			data.imagePath, err = DefaultTableBackupPath(&data)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		return runJob(&data)
+	}
+
+	backup, err := LoadTableBackup(data.imagePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !yes && !confirm(fmt.Sprintf(
+		"The partition table of %s (%s) will be replaced by the %s. Continue?",
+		drive,
+		data.selectedIdentity,
+		backup,
+	)) {
+		return 1
+	}
+	return runJob(&data)
+}
+
+func boardCommand(options Options, args []string) int {
+	data := MainData{retry: options.Retry, taskType: START_BOARD}
+	var drive, board string
+	var yes bool
+	files := map[string]string{}
+
+	flags := flag.NewFlagSet("utkirna board", flag.ContinueOnError)
+	flags.StringVar(&board, "board", "", "the name of the board profile, as listed by \"utkirna board list\"")
+	flags.StringVar(&drive, "drive", "", "the drive to write the bootloader to")
+	flags.Func("file", "a file of the profile as name=path, or only the path when the profile needs one file", func(s string) error {
+		name, path, ok := strings.Cut(s, "=")
+		if !ok {
+			name, path = "", s
+		}
+		files[name] = path
+		return nil
+	})
+	flags.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	if len(args) > 0 && args[0] == "list" {
+		for _, profile := range LoadBoardProfiles() {
+			fmt.Printf("%s\n  %s\n", profile.Name, profile.Description)
+			for _, write := range profile.Writes {
+				fmt.Printf("  %s at %s\n", write.File, write.Seek)
+			}
+		}
+		return 0
+	} else if len(args) < 1 || args[0] != "write" {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna board list|write --board <name> --drive <drive> --file <name>=<path> [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	if len(board) < 1 || len(drive) < 1 || len(files) < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna board write --board <name> --drive <drive> --file <name>=<path> [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	for _, profile := range LoadBoardProfiles() {
+		if strings.EqualFold(profile.Name, board) {
+			data.board = profile
+		}
+	}
+	if len(data.board.Name) < 1 {
+		fmt.Fprintf(os.Stderr, "There is no board profile %q.\n", board)
+		return 1
+	}
+	if path, ok := files[""]; ok {
+		if len(data.board.Files()) != 1 {
+			fmt.Fprintf(os.Stderr, "%s needs the files %s, name them.\n", data.board.Name, strings.Join(data.board.Files(), ", "))
+			return 2
+		}
+		files[data.board.Files()[0]] = path
+	}
+	data.boardFiles = files
+
+	if options.AllDisks {
+		printAllDisksWarning()
+	}
+	data.selectedDisk, data.selectedIdentity, err = findListedDisk(options, drive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data.selectedDrive = data.selectedDisk.Path
+
+	warnings, err := CheckBoard(&data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "Warning: "+warning)
+	}
+	if !yes && !confirm(fmt.Sprintf(
+		"The bootloader for %s will be written to %s (%s). Continue?",
+		data.board.Name,
+		drive,
+		data.selectedIdentity,
+	)) {
+		return 1
+	}
+	return runJob(&data)
+}
+
+func composeCommand(options Options, args []string) int {
+	data := MainData{retry: options.Retry, taskType: START_COMPOSE}
+	var drive string
+	var yes bool
+
+	flags := flag.NewFlagSet("utkirna compose", flag.ContinueOnError)
+	flags.StringVar(&data.composeLayout, "layout", "", "the layout file describing the partitions and their images")
+	flags.StringVar(&drive, "drive", "", "the drive to compose the disk on; everything on it is replaced")
+	flags.StringVar(&data.imagePath, "output", "", "the image to compose the disk into instead")
+	flags.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if len(data.composeLayout) < 1 || (len(drive) < 1) == (len(data.imagePath) < 1) || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: utkirna compose --layout <file> --drive <drive>|--output <image> [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+	layout, err := LoadDiskLayout(data.composeLayout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(data.imagePath) > 0 {
+		sectorSize := max(layout.SectorSize, 512)
+		_, err = layout.Plan(0, sectorSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		data.taskType = START_COMPOSE_IMAGE
+		return runJob(&data)
+	}
+
+	if options.AllDisks {
+		printAllDisksWarning()
+	}
+	data.selectedDisk, data.selectedIdentity, err = findListedDisk(options, drive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	data.selectedDrive = data.selectedDisk.Path
+	_, err = layout.Plan(data.selectedIdentity.Size, 512)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if !yes && !confirm(fmt.Sprintf(
+		"Everything on %s (%s) will be replaced by the disk %s describes. Continue?",
+		drive,
+		data.selectedIdentity,
+		data.composeLayout,
+	)) {
+		return 1
+	}
+	return runJob(&data)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestCLISectorSizeMismatch(t *testing.T) {
+	tests := []struct {
+		translate, asIs bool
+		want            MismatchChoice
+		wantFailed      bool
+		wantErr         bool
+	}{
+		{false, false, MISMATCH_CANCEL, true, false},
+		{true, false, MISMATCH_TRANSLATE, false, false},
+		{false, true, MISMATCH_AS_IS, false, false},
+		{true, true, MISMATCH_CANCEL, false, true},
+	}
+	for _, test := range tests {
+		mismatch, err := mismatchChoice(test.translate, test.asIs)
+		if (err != nil) != test.wantErr {
+			t.Errorf("mismatchChoice(%v, %v): error %v", test.translate, test.asIs, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		cli := &cliFrontend{mismatch: mismatch}
+		var got MismatchChoice = -1
+		cli.ConfirmSectorSizeMismatch(4096, 512, func(choice MismatchChoice) { got = choice })
+		if got != test.want || cli.failed != test.wantFailed {
+			t.Errorf(
+				"translate %v, as is %v: answered %d, failed %v, want %d, %v",
+				test.translate, test.asIs, got, cli.failed, test.want, test.wantFailed,
+			)
+		}
+	}
+}
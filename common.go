@@ -5,7 +5,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -15,8 +17,135 @@ const (
 	START_WRITE TaskType = iota
 	START_READ
 	START_VERIFY
+	START_CLONE
+	START_WIPE
+	START_FORMAT
+	// START_RESTORE puts a snapshot taken before a write back on the drive.
+	START_RESTORE
+	// START_TABLE_BACKUP and START_TABLE_RESTORE save and restore only the
+	// partition structures of a drive, to and from the file in imagePath.
+	START_TABLE_BACKUP
+	START_TABLE_RESTORE
+	// START_BOARD writes the bootloader files of a board profile at their
+	// offsets of the drive.
+	START_BOARD
+	// START_COMPOSE composes the disk a layout file describes on the drive,
+	// START_COMPOSE_IMAGE into the image file in imagePath.
+	START_COMPOSE
+	START_COMPOSE_IMAGE
 )
 
+// Frontend is what a job reports its progress and outcome to, the GUI or the
+// command line.
+type Frontend interface {
+	SetStatus(status string)
+	SetSpeed(speed string)
+	SetElapsed(elapsed string)
+	SetProgress(done int64, total int64)
+	// ShowRescueMap shows which parts of the drive a rescue has read so far.
+	ShowRescueMap(rescueMap *RescueMap)
+	// HandleError reports a failed job. JobFinished follows once the job
+	// has released the drive.
+	HandleError(data *MainData, err error)
+	HandleSuccess(message string)
+	JobFinished(data MainData)
+	ConfirmSectorSizeMismatch(imageSector int, diskSector int, callback func(MismatchChoice))
+}
+
+// Disk is a drive that can be selected as the source or target of a job.
+type Disk struct {
+	Path string
+	// Bus is the way the drive is attached, such as usb, mmc or nvme.
+	Bus       string
+	Removable bool
+	ReadOnly  bool
+	// ReadOnlyReason explains where the write protection comes from.
+	ReadOnlyReason string
+	// System is set for drives the running system depends on.
+	System bool
+	// Size is the capacity of the medium, 0 for a card reader with no card.
+	Size int64
+}
+
+// DiskIdentity pins down a drive independently of the name the system gave
+// it, which can be handed to another drive after a reset or a replug.
+type DiskIdentity struct {
+	// ByID is a persistent path such as /dev/disk/by-id/usb-... on Linux or
+	// the physical drive path on Windows.
+	ByID   string
+	Serial string
+	Vendor string
+	Model  string
+	Size   int64
+}
+
+func (identity DiskIdentity) String() string {
+	str := identity.Model
+	if len(identity.Serial) > 0 {
+		str += " (serial " + identity.Serial + ")"
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s, %d bytes", str, identity.Size))
+}
+
+// Matches reports whether two identities describe the same drive. Fields
+// that could not be determined for either of them are not compared.
+func (identity DiskIdentity) Matches(other DiskIdentity) bool {
+	if identity.Size != other.Size {
+		return false
+	}
+	// udev may not have caught up with a drive that was just plugged in.
+	differ := func(a string, b string) bool {
+		return len(a) > 0 && len(b) > 0 && a != b
+	}
+	return !differ(identity.Serial, other.Serial) && !differ(identity.ByID, other.ByID)
+}
+
+// CheckDiskIdentity makes sure devPath still is the drive that was selected.
+func CheckDiskIdentity(devPath string, identity DiskIdentity) error {
+	current, err := GetDiskIdentity(devPath)
+	if err != nil {
+		return errors.Join(errors.New("CheckDiskIdentity(): GetDiskIdentity failed"), err)
+	}
+	if !identity.Matches(current) {
+		return fmt.Errorf(
+			"%s is no longer the selected drive.\nSelected: %s\nFound: %s",
+			devPath,
+			identity,
+			current,
+		)
+	}
+	return nil
+}
+
+func (disk Disk) Label() string {
+	label := disk.Path
+	if len(disk.Bus) > 0 {
+		label += " [" + disk.Bus + "]"
+	}
+	if disk.System {
+		label += " (system disk)"
+	} else if disk.ReadOnly {
+		label += " (read-only)"
+	}
+	return label
+}
+
+// CheckDiskPolicy refuses jobs the selected drive must not be used for.
+// Drives of the running system are refused for every job, since even reading
+// them means unmounting their filesystems first.
+func CheckDiskPolicy(disk Disk, taskType TaskType) error {
+	if disk.System {
+		return errors.New(
+			"The drive holds filesystems or swap the running system depends on\n" +
+				"and cannot be used by Utkirna.",
+		)
+	}
+	if disk.ReadOnly && taskType != START_READ && taskType != START_VERIFY && taskType != START_TABLE_BACKUP {
+		return errors.New(disk.ReadOnlyReason)
+	}
+	return nil
+}
+
 func fmtDuration(d time.Duration) string {
 	d = d.Round(time.Second)
 	h := d / time.Hour
@@ -27,7 +156,22 @@ func fmtDuration(d time.Duration) string {
 	return fmt.Sprintf("%02d:%02d:%02d", h, m, s)
 }
 
-func StartTimer(start time.Time, widgets GUI) chan struct{} {
+// fmtBytes formats a byte count with a binary unit.
+func fmtBytes(n int64) string {
+	units := []string{"bytes", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+func StartTimer(start time.Time, ui Frontend) chan struct{} {
 	chQuit := make(chan struct{})
 	go func() {
 		for range time.Tick(time.Second) {
@@ -37,69 +181,316 @@ func StartTimer(start time.Time, widgets GUI) chan struct{} {
 			default:
 				elapsed := time.Since(start)
 				elapsedStr := fmtDuration(elapsed)
-				widgets.elapsedLabel.SetText(elapsedStr)
+				ui.SetElapsed(elapsedStr)
 			}
 		}
 	}()
 	return chQuit
 }
 
-func cleanUp(data *MainData, gui GUI, handles Handles) {
+// chunkSectors is the number of sectors the chunk starting at sector i covers
+// when a job of numSectors sectors is processed 1024 sectors at a time.
+func chunkSectors(i int64, numSectors int64) int64 {
+	return min(1024, numSectors-i)
+}
+
+// readDiskSectors reads the sectors of the part of the drive the job works on
+// from sector on.
+func readDiskSectors(handles Handles, buf *[]byte, sector int64, sectorSize int) error {
+	return ReadSectorDataFromHandle(handles.hDisk, buf, sector+handles.diskOffset/int64(sectorSize), sectorSize)
+}
+
+// writeDiskSectors is the counterpart of readDiskSectors for writes.
+func writeDiskSectors(handles Handles, buf *[]byte, sector int64, sectorSize int) error {
+	return WriteSectorDataFromHandle(handles.hDisk, buf, sector+handles.diskOffset/int64(sectorSize), sectorSize)
+}
+
+// readImageSectors reads the image from sector on, counting from the input
+// offset of the job. An image opened with O_DIRECT only accepts reads of
+// whole aligned blocks, so an offset that is not aligned goes through a
+// bounce buffer.
+func readImageSectors(handles Handles, buf *[]byte, sector int64, sectorSize int) error {
+	offset := sector*int64(sectorSize) + handles.imageOffset
+	lead := int(offset % ioAlignment)
+	if lead == 0 {
+		return ReadSectorDataFromHandle(handles.hImage, buf, offset, 1)
+	}
+	bounce := alignedBuffer(roundUp(lead+len(*buf), ioAlignment), ioAlignment)
+	err := ReadSectorDataFromHandle(handles.hImage, &bounce, offset-int64(lead), 1)
+	if err != nil {
+		return err
+	}
+	copy(*buf, bounce[lead:])
+	return nil
+}
+
+// getTargetSectors is GetNumDiskSector for the part of the drive the job
+// works on.
+func getTargetSectors(handles Handles) (int64, int, error) {
+	numSectors, sectorSize, err := GetNumDiskSector(handles.hDisk)
+	if err != nil {
+		return 0, 0, err
+	}
+	numSectors -= handles.diskOffset / int64(sectorSize)
+	if handles.diskLength > 0 {
+		numSectors = min(numSectors, handles.diskLength/int64(sectorSize))
+	}
+	return numSectors, sectorSize, nil
+}
+
+// imageBytesInChunk is how much of a chunk starting at sector i is backed by
+// real image data. It is shorter than the chunk only for the final chunk of
+// an image whose size is not a multiple of the sector size.
+func imageBytesInChunk(imageSize int64, i int64, sectorSize int, chunkLen int) int {
+	return int(min(int64(chunkLen), imageSize-i*int64(sectorSize)))
+}
+
+func roundUp(n int, align int) int {
+	return (n + align - 1) / align * align
+}
+
+func updateSpeed(ui Frontend, sectorSize int, sectorsDone int64, updateTimer time.Time) bool {
+	if time.Since(updateTimer).Milliseconds() < 1000 {
+		return false
+	}
+	mbPerSec := float64(
+		(int64(sectorSize) * sectorsDone),
+	) * (1000 / float64(time.Since(updateTimer).Milliseconds())) / 1024.0 / 1024.0
+	setText := fmt.Sprintf("%.02f MB/s", mbPerSec)
+	ui.SetSpeed(setText)
+	return true
+}
+
+func cleanUp(data *MainData, ui Frontend, handles Handles) {
+	CloseRequiredHandles(handles)
+	finishJob(data, ui)
+}
+
+// finishJob stops the timer of a job whose handles have been closed, saves its
+// report and hands control back to the user.
+func finishJob(data *MainData, ui Frontend) {
 	data.bQuitTimer <- struct{}{}
 	close(data.bQuitTimer)
-	CloseRequiredHandles(handles)
-	DisableCancelButton(gui, *data)
+	data.resume = nil
+
+	reportPath, err := data.report.Save()
+	if err != nil {
+		log.Printf("finishJob(): %s", err)
+	} else {
+		log.Printf("finishJob(): job report saved to %s", reportPath)
+	}
+	ui.JobFinished(*data)
 }
 
-func StartMainTask(data *MainData, gui GUI) {
+// StartMainTask starts the job set up in data. The job is cancelled through
+// the data.bQuitTask it makes, which the caller picks up once StartMainTask
+// has returned.
+func StartMainTask(data *MainData, ui Frontend) {
 	var err error
 	var handles Handles
 
+	data.bQuitTask = make(chan struct{}, 1)
+
+	// Composing an image needs no drive.
+	if data.taskType == START_COMPOSE_IMAGE {
+		data.report = NewJobReport(data)
+		ComposeImage(data, ui)
+		return
+	}
+
+	err = CheckDiskPolicy(data.selectedDisk, data.taskType)
+	if err != nil {
+		ui.HandleError(
+			data,
+			errors.Join(errors.New("StartMainTask(): CheckDiskPolicy failed"), err),
+		)
+		ui.JobFinished(*data)
+		return
+	}
+
+	if data.taskType == START_CLONE {
+		err = checkCloneSource(data)
+		if err != nil {
+			ui.HandleError(
+				data,
+				errors.Join(errors.New("StartMainTask(): checkCloneSource failed"), err),
+			)
+			ui.JobFinished(*data)
+			return
+		}
+	}
+
 	err = GetRequiredHandles(
 		&handles,
 		data.taskType,
 		data.selectedDrive,
+		data.selectedIdentity,
 		data.imagePath,
 	)
 	if err != nil {
-		HandleError(
-			gui,
+		ui.HandleError(
 			data,
 			errors.Join(errors.New("StartMainTask(): GetRequiredHandle failed"), err),
 		)
+		ui.JobFinished(*data)
 		return
 	}
 
-	if data.taskType == START_WRITE {
-		WriteDisk(data, gui, handles)
+	if data.partition.Index > 0 &&
+		(data.taskType == START_WRITE || data.taskType == START_READ || data.taskType == START_VERIFY) {
+		err = selectPartition(data, &handles)
+		if err != nil {
+			CloseRequiredHandles(handles)
+			ui.HandleError(data, errors.Join(errors.New("StartMainTask(): selectPartition failed"), err))
+			ui.JobFinished(*data)
+			return
+		}
+	}
+
+	if data.rawRange.IsSet() && (data.taskType == START_WRITE || data.taskType == START_VERIFY) {
+		err = selectRawRange(data, &handles)
+		if err != nil {
+			CloseRequiredHandles(handles)
+			ui.HandleError(data, errors.Join(errors.New("StartMainTask(): selectRawRange failed"), err))
+			ui.JobFinished(*data)
+			return
+		}
+	}
+
+	data.report = NewJobReport(data)
+	if data.partition.Index > 0 {
+		data.report.AddNote(
+			"Partition %d only: %d bytes from byte %d",
+			data.partition.Index,
+			handles.diskLength,
+			handles.diskOffset,
+		)
+	}
+	if data.rawRange.IsSet() {
+		data.report.AddNote("Offset write: %s", data.rawRange)
+	}
+	if data.taskType == START_WRITE || data.taskType == START_CLONE {
+		WriteDisk(data, ui, handles)
 	} else if data.taskType == START_VERIFY {
-		VerifyDisk(data, gui, handles)
+		VerifyDisk(data, ui, handles)
 	} else if data.taskType == START_READ {
-		ReadDisk(data, gui, handles)
+		ReadDisk(data, ui, handles)
+	} else if data.taskType == START_WIPE {
+		WipeDisk(data, ui, handles)
+	} else if data.taskType == START_FORMAT {
+		FormatDisk(data, ui, handles)
+	} else if data.taskType == START_RESTORE {
+		RestoreSnapshot(data, ui, handles)
+	} else if data.taskType == START_TABLE_BACKUP {
+		BackupPartitionTable(data, ui, handles)
+	} else if data.taskType == START_TABLE_RESTORE {
+		RestorePartitionTable(data, ui, handles)
+	} else if data.taskType == START_BOARD {
+		FlashBoard(data, ui, handles)
+	} else if data.taskType == START_COMPOSE {
+		ComposeDisk(data, ui, handles)
 	}
 }
 
-func ReadDisk(data *MainData, gui GUI, handles Handles) {
+// selectPartition confines the job to the partition selected, once the
+// partition table of the drive confirms it is still where it was when it
+// was selected.
+func selectPartition(data *MainData, handles *Handles) error {
+	numSectors, sectorSize, err := GetNumDiskSector(handles.hDisk)
+	if err != nil {
+		return errors.Join(errors.New("selectPartition(): GetNumDiskSector failed"), err)
+	}
+	alignment, err := GetDiskAlignment(handles.hDisk)
+	if err != nil {
+		return errors.Join(errors.New("selectPartition(): GetDiskAlignment failed"), err)
+	}
+	head := alignedBuffer(int(min(tableHeadSize, numSectors*int64(sectorSize))), alignment)
+	err = ReadSectorDataFromHandle(handles.hDisk, &head, 0, sectorSize)
+	if err != nil {
+		return errors.Join(errors.New("selectPartition(): ReadSectorDataFromHandle failed"), err)
+	}
+	table, err := ParsePartitionTable(head, sectorSize)
+	if err != nil {
+		return errors.Join(errors.New("selectPartition(): ParsePartitionTable failed"), err)
+	}
+	if data.partition.Index > 4 && table.Type == TABLE_MBR {
+		sector := alignedBuffer(sectorSize, alignment)
+		err = table.addLogicalPartitions(func(lba int64) ([]byte, error) {
+			return sector, ReadSectorDataFromHandle(handles.hDisk, &sector, lba, sectorSize)
+		})
+		if err != nil {
+			return errors.Join(errors.New("selectPartition(): addLogicalPartitions failed"), err)
+		}
+	}
+
+	for _, partition := range table.Partitions {
+		if partition.Index != data.partition.Index {
+			continue
+		}
+		if partition.Extended {
+			return fmt.Errorf("Partition %d is an extended partition, which only holds other partitions.", partition.Index)
+		}
+		if partition.StartLBA != data.partition.StartLBA || partition.NumSectors != data.partition.NumSectors {
+			return fmt.Errorf("Partition %d has changed since it was selected.", partition.Index)
+		}
+		if partition.StartLBA < 1 || partition.NumSectors < 1 || partition.StartLBA+partition.NumSectors > numSectors {
+			return fmt.Errorf("Partition %d does not lie within the drive.", partition.Index)
+		}
+		handles.diskOffset = partition.StartLBA * int64(sectorSize)
+		handles.diskLength = partition.NumSectors * int64(sectorSize)
+		return nil
+	}
+	return fmt.Errorf("The drive has no partition %d any more.", data.partition.Index)
+}
+
+// checkCloneSource makes sure the source of a clone can be read and is still
+// the drive that was selected.
+func checkCloneSource(data *MainData) error {
+	if data.sourceDisk.Path == data.selectedDrive ||
+		(len(data.sourceIdentity.ByID) > 0 && data.sourceIdentity.ByID == data.selectedIdentity.ByID) {
+		return errors.New("The source and the target are the same drive.")
+	}
+	err := CheckDiskPolicy(data.sourceDisk, START_READ)
+	if err != nil {
+		return err
+	}
+	return CheckDiskIdentity(data.sourceDisk.Path, data.sourceIdentity)
+}
+
+func ReadDisk(data *MainData, ui Frontend, handles Handles) {
 	elapsedTimer := time.Now()
-	data.bQuitTimer = StartTimer(elapsedTimer, gui)
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	diskNumSectors, diskSector, err := getTargetSectors(handles)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("ReadDisk(): GatherSizeInBytes failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
 
-	diskNumSectors, diskSector, err := GetNumDiskSector(handles.hDisk)
+	alignment, err := GetDiskAlignment(handles.hDisk)
 	if err != nil {
-		cleanUp(data, gui, handles)
-		HandleError(gui, data, errors.Join(errors.New("ReadDisk(): GatherSizeInBytes failed"), err))
+		ui.HandleError(
+			data,
+			errors.Join(errors.New("ReadDisk(): GetDiskAlignment failed"), err),
+		)
+		cleanUp(data, ui, handles)
 		return
 	}
+	pool := NewBufferPool(diskSector*1024, alignment)
 
-	if gui.mbrCheck.Checked {
-		mbrData := make([]byte, 512)
+	if data.resume != nil {
+		// The size read may have been limited to the partitions.
+		diskNumSectors = data.resume.TotalSectors
+	} else if data.mbrCheck && data.partition.Index == 0 {
+		mbrData := alignedBuffer(512, alignment)
 		err := ReadSectorDataFromHandle(handles.hDisk, &mbrData, 0, 512)
 		if err != nil {
-			cleanUp(data, gui, handles)
-			HandleError(
-				gui,
+			ui.HandleError(
 				data,
 				errors.Join(errors.New("ReadDisk(): ReadSectorDataFromHandle failed"), err),
 			)
+			cleanUp(data, ui, handles)
 			return
 		}
 		diskNumSectors = int64(1)
@@ -113,48 +504,51 @@ func ReadDisk(data *MainData, gui GUI, handles Handles) {
 		}
 	}
 
-	data.bQuitTask = make(chan struct{})
+	if data.rescue {
+		rescueImage(data, ui, handles, diskSector, diskNumSectors, pool)
+		return
+	}
+
+	journal, sum, err := openJournal(data, diskSector, diskNumSectors)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("ReadDisk(): openJournal failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+	start := int64(0)
+	if data.resume != nil {
+		start = data.resume.Done
+	}
 
 	go func() {
-		defer cleanUp(data, gui, handles)
+		defer cleanUp(data, ui, handles)
 
-		sectorData := make([]byte, diskSector*1024)
-		gui.rwProgressBar.Max = float64(diskNumSectors - 1024)
-		lasti := int64(0)
+		sectorData := pool.Get()
+		lasti := start
 		updateTimer := time.Now()
 
-		for i := int64(0); i < diskNumSectors; i += 1024 {
+		for i := start; i < diskNumSectors; i += 1024 {
 			select {
 			case <-data.bQuitTask:
-				close(data.bQuitTask)
 				return
 			default:
-				if diskNumSectors-int64(diskSector) < int64(1024) {
-					sectorData = make([]byte, int64(diskSector)*(diskNumSectors-int64(diskSector)))
-				}
+				chunk := sectorData[:chunkSectors(i, diskNumSectors)*int64(diskSector)]
 
-				err := ReadSectorDataFromHandle(
-					handles.hDisk,
-					&sectorData,
-					i,
-					diskSector,
-				)
+				err := readDiskChunk(data, handles, chunk, i, diskSector, alignment)
 				if err != nil {
-					HandleError(
-						gui,
+					ui.HandleError(
 						data,
 						errors.Join(
-							errors.New("ReadDisk(): ReadSectorDataFromHandle failed"),
+							errors.New("ReadDisk(): readDiskChunk failed"),
 							err,
 						),
 					)
 					return
 				}
 
-				err = WriteSectorDataFromHandle(handles.hImage, &sectorData, i, diskSector)
+				err = WriteSectorDataFromHandle(handles.hImage, &chunk, i, diskSector)
 				if err != nil {
-					HandleError(
-						gui,
+					ui.HandleError(
 						data,
 						errors.Join(
 							errors.New("ReadDisk(): WriteSectorDataFromHandle failed"),
@@ -163,175 +557,383 @@ func ReadDisk(data *MainData, gui GUI, handles Handles) {
 					)
 					return
 				}
+				sum.Write(chunk)
 
-				gui.rwProgressBar.SetValue(float64(i))
-				if time.Since(updateTimer).Milliseconds() >= 1000 {
-					mbPerSec := float64(
-						(int64(diskSector) * (i - lasti)),
-					) * (1000 / float64(time.Since(updateTimer).Milliseconds())) / 1024.0 / 1024.0
-					setText := fmt.Sprintf("%.02f MB/s", mbPerSec)
-					gui.speedLabel.SetText(setText)
+				done := i + int64(len(chunk)/diskSector)
+				if (i/1024)%16 == 15 || done >= diskNumSectors {
+					err = SyncImage(handles)
+					if err != nil {
+						ui.HandleError(data, errors.Join(errors.New("ReadDisk(): SyncImage failed"), err))
+						return
+					}
+					saveJournal(journal, done, sum)
+				}
+
+				ui.SetProgress(done, diskNumSectors)
+				if updateSpeed(ui, diskSector, i-lasti, updateTimer) {
 					lasti = i
 					updateTimer = time.Now()
 				}
 			}
 		}
-		gui.statusLabel.SetText("Success!")
+		pool.Put(sectorData)
+		removeJournal(journal)
+		ui.HandleSuccess(fmt.Sprintf("Image saved.\nSHA-256: %x", sum.Sum(nil)))
 	}()
 }
 
-func WriteDisk(data *MainData, gui GUI, handles Handles) {
-	elapsedTimer := time.Now()
-	data.bQuitTimer = StartTimer(elapsedTimer, gui)
+// imageSectors returns the size of the image in bytes and in sectors of the
+// target device. A trailing partial sector counts as a whole one; how it is
+// filled is decided by the "pad last sector" option when writing.
+func imageSectors(ignoreSize bool, imageSize int64, diskNumSectors int64, diskSector int) (int64, int64, error) {
+	imageNumSectors := (imageSize + int64(diskSector) - 1) / int64(diskSector)
 
-	diskNumSectors, diskSector, err := GetNumDiskSector(handles.hDisk)
+	if imageNumSectors > diskNumSectors {
+		if !ignoreSize {
+			return 0, 0, errors.New("Size of image is larger than of device")
+		}
+		imageNumSectors = diskNumSectors
+		imageSize = diskNumSectors * int64(diskSector)
+	}
+	return imageSize, imageNumSectors, nil
+}
+
+// imageLayout describes how an image maps onto the device of a write or
+// verify job once both handles are open.
+type imageLayout struct {
+	diskSector      int
+	diskNumSectors  int64
+	alignment       int
+	pool            *BufferPool
+	imageSize       int64
+	imageNumSectors int64
+	// imageSector is the sector size of the source drive of a clone.
+	imageSector int
+	head        []byte
+	patches     []Patch
+	// translateFrom is the sector size the patches translate the partition
+	// table from, 0 when the table is used as is.
+	translateFrom int
+}
+
+func getImageLayout(data *MainData, handles Handles) (*imageLayout, error) {
+	var err error
+	layout := &imageLayout{}
+
+	layout.diskNumSectors, layout.diskSector, err = getTargetSectors(handles)
 	if err != nil {
-		cleanUp(data, gui, handles)
-		HandleError(
-			gui,
-			data,
-			errors.Join(errors.New("WriteVerifyDisk(): GatherSizeInBytes failed"), err),
+		return nil, errors.Join(errors.New("getImageLayout(): GatherSizeInBytes failed"), err)
+	}
+
+	layout.alignment, err = GetDiskAlignment(handles.hDisk)
+	if err != nil {
+		return nil, errors.Join(errors.New("getImageLayout(): GetDiskAlignment failed"), err)
+	}
+	layout.pool = NewBufferPool(layout.diskSector*1024, layout.alignment)
+
+	layout.head, err = ReadImageHead(data.imagePath)
+	if err != nil {
+		return nil, errors.Join(errors.New("getImageLayout(): ReadImageHead failed"), err)
+	}
+
+	imageSize, err := sourceSize(data, handles, layout)
+	if err != nil {
+		return nil, errors.Join(errors.New("getImageLayout(): sourceSize failed"), err)
+	}
+	// A partition or an offset write is never written past its end, into
+	// what follows.
+	layout.imageSize, layout.imageNumSectors, err = imageSectors(
+		data.ignoreSize && data.partition.Index == 0 && !data.rawRange.IsSet(),
+		imageSize,
+		layout.diskNumSectors,
+		layout.diskSector,
+	)
+	if err != nil {
+		return nil, errors.Join(errors.New("getImageLayout(): imageSectors failed"), err)
+	}
+	return layout, nil
+}
+
+// sourceSize returns the number of bytes to copy: the size of the image, or
+// for a clone the size of the source drive, limited to its partitions when
+// only those are to be copied.
+func sourceSize(data *MainData, handles Handles, layout *imageLayout) (int64, error) {
+	if data.taskType != START_CLONE {
+		imageStat, err := os.Stat(data.imagePath)
+		if err != nil {
+			return 0, err
+		}
+		if data.rawRange.IsSet() {
+			return data.rawRange.Length(imageStat.Size())
+		}
+		return imageStat.Size(), nil
+	}
+
+	sourceNumSectors, sourceSector, err := GetNumDiskSector(handles.hImage)
+	if err != nil {
+		return 0, err
+	}
+	layout.imageSector = sourceSector
+	size := sourceNumSectors * int64(sourceSector)
+	if data.mbrCheck {
+		table, err := ParsePartitionTable(layout.head, sourceSector)
+		if err == nil && table.EndLBA() > 0 {
+			size = min(size, table.EndLBA()*int64(sourceSector))
+		}
+	}
+	if size > layout.diskNumSectors*int64(layout.diskSector) && !data.ignoreSize {
+		return 0, fmt.Errorf(
+			"The source drive holds %d bytes, the target only %d bytes.\n"+
+				"Copying only the allocated partitions may make it fit.",
+			size,
+			layout.diskNumSectors*int64(layout.diskSector),
 		)
+	}
+	return size, nil
+}
+
+// checkTableSectorSize makes sure the partition table of the image was built
+// for the sector size of the device. When it was not, the user decides whether
+// to go on as is, to go on with a translated table or to stop; start is only
+// called in the first two cases.
+func checkTableSectorSize(data *MainData, ui Frontend, handles Handles, layout *imageLayout, start func()) {
+	// The image of a partition is a filesystem, and an offset write puts a
+	// blob such as a bootloader, with no partition table to match to the
+	// drive.
+	if data.partition.Index > 0 || data.rawRange.IsSet() {
+		start()
 		return
 	}
+	imageSector := layout.imageSector
+	if data.taskType != START_CLONE {
+		imageSector = DetectTableSectorSize(data.imagePath, layout.head, layout.imageSize)
+	}
+	if data.resume != nil {
+		// The choice was made when the job was started.
+		imageSector = data.resume.TranslateFrom
+	}
 
-	imageStat, err := os.Stat(data.imagePath)
-	if err != nil {
-		cleanUp(data, gui, handles)
-		HandleError(gui, data, err)
+	translate := func() bool {
+		patches, err := TranslatePartitionTable(
+			layout.head,
+			imageSector,
+			layout.diskSector,
+			layout.diskNumSectors,
+		)
+		if err != nil {
+			ui.HandleError(
+				data,
+				errors.Join(errors.New("checkTableSectorSize(): TranslatePartitionTable failed"), err),
+			)
+			cleanUp(data, ui, handles)
+			return false
+		}
+		layout.patches = patches
+		layout.translateFrom = imageSector
+		return true
+	}
+	if imageSector == 0 || imageSector == layout.diskSector {
+		// The backup GPT of a clone belongs at the end of the target drive,
+		// which rarely has the size of the source drive.
+		_, isGPT := readGPTHeader(layout.head, layout.diskSector)
+		if data.taskType == START_CLONE && isGPT && !translate() {
+			return
+		}
+		start()
+		return
+	}
+	if data.resume != nil {
+		if translate() {
+			start()
+		}
+		return
 	}
-	imageNumSectors := (imageStat.Size() / int64(diskSector)) + (imageStat.Size() % int64(diskSector))
 
-	if imageNumSectors > diskNumSectors {
-		if gui.ignoreSize.Checked {
-			imageNumSectors = diskNumSectors
-		} else {
-			cleanUp(data, gui, handles)
-			HandleError(gui, data, errors.New("WriteVerifyDisk(): Size of image is larger than of device"))
+	ui.ConfirmSectorSizeMismatch(imageSector, layout.diskSector, func(choice MismatchChoice) {
+		if choice == MISMATCH_CANCEL {
+			cleanUp(data, ui, handles)
+			return
+		}
+		if choice == MISMATCH_TRANSLATE && !translate() {
 			return
 		}
+		start()
+	})
+}
+
+// patchSectors returns the first sector and the number of sectors of the
+// device a patch touches, clamped to the device.
+func patchSectors(patch Patch, layout *imageLayout) (int64, int64) {
+	startSector := patch.Offset / int64(layout.diskSector)
+	endSector := (patch.Offset + int64(len(patch.Data)) + int64(layout.diskSector) - 1) / int64(layout.diskSector)
+	endSector = min(endSector, layout.diskNumSectors)
+	return startSector, endSector - startSector
+}
+
+// writeOutlyingPatches writes the patches that reach past the end of the
+// image, such as the backup GPT of a translated table.
+func writeOutlyingPatches(handles Handles, layout *imageLayout) error {
+	for _, patch := range layout.patches {
+		startSector, numSectors := patchSectors(patch, layout)
+		if startSector+numSectors <= layout.imageNumSectors || numSectors <= 0 {
+			continue
+		}
+
+		buf := alignedBuffer(int(numSectors)*layout.diskSector, layout.alignment)
+		err := readDiskSectors(handles, &buf, startSector, layout.diskSector)
+		if err != nil {
+			return err
+		}
+		applyPatches(buf, startSector*int64(layout.diskSector), []Patch{patch})
+		err = writeDiskSectors(handles, &buf, startSector, layout.diskSector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyOutlyingPatches(handles Handles, layout *imageLayout) error {
+	for _, patch := range layout.patches {
+		startSector, numSectors := patchSectors(patch, layout)
+		if startSector+numSectors <= layout.imageNumSectors || numSectors <= 0 {
+			continue
+		}
+
+		buf := alignedBuffer(int(numSectors)*layout.diskSector, layout.alignment)
+		err := readDiskSectors(handles, &buf, startSector, layout.diskSector)
+		if err != nil {
+			return err
+		}
+		expected := bytes.Clone(buf)
+		applyPatches(expected, startSector*int64(layout.diskSector), layout.patches)
+		if !bytes.Equal(buf, expected) {
+			return fmt.Errorf("Verification failed at sector: %d", startSector)
+		}
+	}
+	return nil
+}
+
+func WriteDisk(data *MainData, ui Frontend, handles Handles) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	layout, err := getImageLayout(data, handles)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("WriteVerifyDisk(): getImageLayout failed"), err))
+		cleanUp(data, ui, handles)
+		return
 	}
 
-	data.bQuitTask = make(chan struct{})
-	gui.rwProgressBar.Max = float64(imageNumSectors - 1024)
+	checkTableSectorSize(data, ui, handles, layout, func() {
+		writeImage(data, ui, handles, layout)
+	})
+}
+
+func writeImage(data *MainData, ui Frontend, handles Handles, layout *imageLayout) {
+	diskSector := layout.diskSector
+	imageNumSectors := layout.imageNumSectors
+	padTail := data.padTail
+	taskType := data.taskType
+
+	journal, sum, err := openJournal(data, diskSector, imageNumSectors)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("WriteVerifyDisk(): openJournal failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+	if journal != nil {
+		journal.TranslateFrom = layout.translateFrom
+	}
+	start := int64(0)
+	if data.resume != nil {
+		start = data.resume.Done
+	}
 
 	go func() {
-		defer cleanUp(data, gui, handles)
+		// The handles are replaced when the drive is reinserted after a removal.
+		defer func() { cleanUp(data, ui, handles) }()
 
-		sectorData := make([]byte, diskSector*1024)
-		lasti := int64(0)
+		sectorData := layout.pool.Get()
+		var current []byte
+		var delta deltaStats
+		if data.deltaWrite {
+			current = layout.pool.Get()
+		}
+		lasti := start
 		updateTimer := time.Now()
+		// Everything before confirmed has been written and synced to the
+		// drive, so a job resumed after a removal goes on from there.
+		confirmed := start
+		confirmedHash := hashState(sum)
 
-		for i := int64(0); i < imageNumSectors; i += 1024 {
-			select {
-			case <-data.bQuitTask:
-				close(data.bQuitTask)
-				return
-			default:
-				if imageNumSectors-int64(diskSector) < int64(1024) {
-					sectorData = make([]byte, int64(diskSector)*(imageNumSectors-int64(diskSector)))
-				}
-
-				err := ReadSectorDataFromHandle(
-					handles.hImage,
-					&sectorData,
-					i,
-					diskSector,
-				)
-				if err != nil {
-					HandleError(
-						gui,
-						data,
-						errors.Join(
-							errors.New("WriteVerifyDisk(): ReadSectorDataFromHandle failed"),
-							err,
-						),
-					)
-					return
-				}
+		skipZeros := false
+		skipped := int64(0)
+		notes := []string{}
 
-				err = WriteSectorDataFromHandle(
-					handles.hDisk,
-					&sectorData,
-					i,
-					diskSector,
-				)
-				if err != nil {
-					HandleError(
-						gui,
-						data,
-						errors.Join(
-							errors.New(
-								"WriteVerifyDisk(): WriteSectorDataFromHandle failed",
-							),
-							err,
-						),
-					)
-					return
+		// The snapshot is taken before anything is changed, a resumed
+		// write has overwritten part of the drive already.
+		if data.snapshot && data.resume == nil {
+			snapshot, err := TakeSnapshot(data, ui, handles, layout)
+			if err != nil {
+				if !errors.Is(err, errCancelled) {
+					ui.HandleError(data, errors.Join(errors.New("WriteVerifyDisk(): TakeSnapshot failed"), err))
 				}
+				return
+			}
+			if snapshot != nil {
+				data.report.AddNote("Snapshot of %d bytes saved to %s", snapshot.Size(), snapshot.path)
+				notes = append(notes, "A snapshot of the drive was saved, the write can be undone.")
+			}
+			ui.SetStatus("Writing...")
+		}
 
-				gui.rwProgressBar.SetValue(float64(i))
-				if time.Since(updateTimer).Milliseconds() >= 1000 {
-					mbPerSec := float64(
-						(int64(diskSector) * (i - lasti)),
-					) * (1000 / float64(time.Since(updateTimer).Milliseconds())) / 1024.0 / 1024.0
-					setText := fmt.Sprintf("%.02f MB/s", mbPerSec)
-					gui.speedLabel.SetText(setText)
-					lasti = i
-					updateTimer = time.Now()
+		// A delta write finds zeros on the drive by itself, zeroing it first
+		// would only make it rewrite the rest.
+		if data.skipZeros && !data.deltaWrite {
+			var err error
+			skipZeros, err = prepareSkipZeros(data, ui, handles, layout, start)
+			if err != nil {
+				if !errors.Is(err, errCancelled) {
+					ui.HandleError(data, errors.Join(errors.New("WriteVerifyDisk(): prepareSkipZeros failed"), err))
 				}
+				return
 			}
+			ui.SetStatus("Writing...")
 		}
 
-		data.taskType = START_VERIFY
-		gui.statusLabel.SetText("Verifying....")
-		diskSectorData := make([]byte, diskSector*1024)
-		imageSectorData := make([]byte, diskSector*1024)
-		lasti = int64(0)
-
-		for i := int64(0); i < imageNumSectors; i += 1024 {
+		for i := start; i < imageNumSectors; i += 1024 {
 			select {
 			case <-data.bQuitTask:
 				return
 			default:
-				if imageNumSectors-int64(diskSector) < int64(1024) {
-					diskSectorData = make(
-						[]byte,
-						int64(diskSector)*(imageNumSectors-int64(diskSector)),
-					)
-					imageSectorData = make(
-						[]byte,
-						int64(diskSector)*(imageNumSectors-int64(diskSector)),
-					)
-				}
+				chunk := sectorData[:chunkSectors(i, imageNumSectors)*int64(diskSector)]
+				imageBytes := imageBytesInChunk(layout.imageSize, i, diskSector, len(chunk))
 
-				err := ReadSectorDataFromHandle(
-					handles.hImage,
-					&imageSectorData,
-					i,
-					diskSector,
-				)
-				if err != nil {
-					HandleError(
-						gui,
-						data,
-						errors.Join(
-							errors.New("WriteVerifyDisk(): ReadSectorDataFromHandle failed"),
-							err,
-						),
-					)
-					return
+				if imageBytes < len(chunk) {
+					lastSector := chunk[len(chunk)-diskSector:]
+					if padTail {
+						clear(lastSector)
+					} else {
+						lastSectorNum := i + int64(len(chunk)/diskSector) - 1
+						err := readDiskSectors(handles, &lastSector, lastSectorNum, diskSector)
+						if err != nil {
+							ui.HandleError(
+								data,
+								errors.Join(
+									errors.New("WriteVerifyDisk(): ReadSectorDataFromHandle failed"),
+									err,
+								),
+							)
+							return
+						}
+					}
 				}
 
-				err = ReadSectorDataFromHandle(
-					handles.hDisk,
-					&diskSectorData,
-					i,
-					diskSector,
-				)
+				imageChunk := chunk[:imageBytes]
+				err := readImageSectors(handles, &imageChunk, i, diskSector)
 				if err != nil {
-					HandleError(
-						gui,
+					ui.HandleError(
 						data,
 						errors.Join(
 							errors.New("WriteVerifyDisk(): ReadSectorDataFromHandle failed"),
@@ -340,148 +942,218 @@ func WriteDisk(data *MainData, gui GUI, handles Handles) {
 					)
 					return
 				}
+				sum.Write(imageChunk)
+				applyPatches(chunk, i*int64(diskSector), layout.patches)
 
-				if !bytes.Equal(diskSectorData, imageSectorData) {
-					strError := fmt.Sprintf(
-						"WriteVerifyDisk(): Verification failed at sector: %d\n",
-						i,
+				// The drive already holds zeros where a chunk is skipped.
+				if skipZeros && allZero(chunk) {
+					skipped += int64(len(chunk))
+				} else if data.deltaWrite {
+					err = writeChangedChunk(data, handles, chunk, current, i, diskSector, layout.alignment, &delta)
+				} else {
+					err = writeDiskChunk(data, handles, chunk, i, diskSector, layout.alignment)
+				}
+				if err == nil && ((i/1024)%16 == 15 || i+1024 >= imageNumSectors) {
+					err = SyncDisk(handles)
+					if err == nil {
+						confirmed = i + int64(len(chunk)/diskSector)
+						confirmedHash = hashState(sum)
+						saveJournal(journal, confirmed, sum)
+					}
+				}
+				if err != nil {
+					err = errors.Join(
+						errors.New("WriteVerifyDisk(): writeDiskChunk failed"),
+						err,
 					)
-					HandleError(gui, data, errors.New(strError))
+					if resumeAfterRemoval(data, ui, &handles, taskType, confirmed, imageNumSectors, err) {
+						// The loop steps forward to the first unconfirmed chunk.
+						i = confirmed - 1024
+						lasti = confirmed
+						restoreHash(sum, confirmedHash)
+						continue
+					}
 					return
 				}
 
-				gui.rwProgressBar.SetValue(float64(i))
-				if time.Since(updateTimer).Milliseconds() >= 1000 {
-					mbPerSec := float64(
-						(int64(diskSector) * (i - lasti)),
-					) * (1000 / float64(time.Since(updateTimer).Milliseconds())) / 1024.0 / 1024.0
-					setText := fmt.Sprintf("%.02f MB/s", mbPerSec)
-					gui.speedLabel.SetText(setText)
+				ui.SetProgress(i+int64(len(chunk)/diskSector), imageNumSectors)
+				if updateSpeed(ui, diskSector, i-lasti, updateTimer) {
 					lasti = i
 					updateTimer = time.Now()
 				}
 			}
 		}
-		gui.statusLabel.SetText("Success!")
-	}()
-}
+		layout.pool.Put(sectorData)
 
-func VerifyDisk(data *MainData, gui GUI, handles Handles) {
-	elapsedTimer := time.Now()
-	data.bQuitTimer = StartTimer(elapsedTimer, gui)
+		if skipZeros {
+			data.report.AddNote("Skipped %d bytes of zeros", skipped)
+			notes = append(notes, fmt.Sprintf("%s of zeros were skipped.", fmtBytes(skipped)))
+		}
+		if data.deltaWrite {
+			layout.pool.Put(current)
+			data.report.AddNote(
+				"Delta write: %d chunks unchanged, %d chunks rewritten",
+				delta.unchanged,
+				delta.rewritten,
+			)
+			notes = append(notes, delta.String())
+		}
 
-	diskNumSectors, diskSector, err := GetNumDiskSector(handles.hDisk)
-	if err != nil {
-		cleanUp(data, gui, handles)
-		HandleError(
-			gui,
-			data,
-			errors.Join(errors.New("WriteVerifyDisk(): GatherSizeInBytes failed"), err),
-		)
-		return
-	}
+		// The tail is cleared first, since a relocated backup GPT is
+		// written beyond the image.
+		if data.clearTail {
+			note, err := clearTail(data, ui, handles, layout)
+			if err != nil {
+				if !errors.Is(err, errCancelled) {
+					ui.HandleError(data, errors.Join(errors.New("WriteVerifyDisk(): clearTail failed"), err))
+				}
+				return
+			}
+			notes = append(notes, note)
+		}
 
-	imageStat, err := os.Stat(data.imagePath)
-	if err != nil {
-		cleanUp(data, gui, handles)
-		HandleError(gui, data, err)
-	}
-	imageNumSectors := (imageStat.Size() / int64(diskSector)) + (imageStat.Size() % int64(diskSector))
+		err := writeOutlyingPatches(handles, layout)
+		if err != nil {
+			ui.HandleError(
+				data,
+				errors.Join(errors.New("WriteVerifyDisk(): writeOutlyingPatches failed"), err),
+			)
+			return
+		}
 
-	if imageNumSectors > diskNumSectors {
-		if gui.ignoreSize.Checked {
-			imageNumSectors = diskNumSectors
-		} else {
-			cleanUp(data, gui, handles)
-			HandleError(gui, data, errors.New("WriteVerifyDisk(): Size of image is larger than of device"))
+		if taskType == START_CLONE && !data.verify {
+			ui.HandleSuccess(strings.TrimSpace("Drive cloned.\n" + strings.Join(notes, "\n")))
 			return
 		}
-	}
+		if taskType == START_WRITE {
+			data.taskType = START_VERIFY
+		}
+		err = FlushDiskCache(handles)
+		if err != nil {
+			ui.HandleError(
+				data,
+				errors.Join(errors.New("WriteVerifyDisk(): FlushDiskCache failed"), err),
+			)
+			return
+		}
+		verifyMode := DiskIOMode(handles)
+		ui.SetStatus("Verifying (" + verifyMode + ")...")
 
-	data.bQuitTask = make(chan struct{})
-	gui.rwProgressBar.Max = float64(imageNumSectors - 1024)
+		if verifyImage(data, ui, &handles, taskType, layout) {
+			removeJournal(journal)
+			ui.HandleSuccess(strings.TrimSpace(fmt.Sprintf(
+				"Verification passed using %s.\nSHA-256 of the written data: %x\n%s",
+				verifyMode,
+				sum.Sum(nil),
+				strings.Join(notes, "\n"),
+			)))
+		}
+	}()
+}
 
-	go func() {
-		defer cleanUp(data, gui, handles)
+// verifyImage compares the device against the image chunk by chunk. Only the
+// bytes that come from the image are compared, so whatever ended up in the
+// rest of a trailing partial sector does not fail the verification. It
+// reports any failure itself and returns whether the job should go on. When
+// the drive is removed, it is reopened for taskType once it comes back.
+func verifyImage(data *MainData, ui Frontend, handles *Handles, taskType TaskType, layout *imageLayout) bool {
+	diskSector := layout.diskSector
+	imageNumSectors := layout.imageNumSectors
+	diskSectorData := layout.pool.Get()
+	imageSectorData := layout.pool.Get()
+	defer layout.pool.Put(diskSectorData)
+	defer layout.pool.Put(imageSectorData)
+	lasti := int64(0)
+	updateTimer := time.Now()
 
-		diskSectorData := make([]byte, diskSector*1024)
-		imageSectorData := make([]byte, diskSector*1024)
-		lasti := int64(0)
-		updateTimer := time.Now()
+	ui.SetProgress(0, imageNumSectors)
+	for i := int64(0); i < imageNumSectors; i += 1024 {
+		select {
+		case <-data.bQuitTask:
+			return false
+		default:
+			diskChunk := diskSectorData[:chunkSectors(i, imageNumSectors)*int64(diskSector)]
+			imageBytes := imageBytesInChunk(layout.imageSize, i, diskSector, len(diskChunk))
+			// The image may be opened with O_DIRECT, which only accepts
+			// reads of whole aligned blocks; a short read at EOF is fine.
+			imageChunk := imageSectorData[:min(roundUp(imageBytes, layout.alignment), len(imageSectorData))]
 
-		for i := int64(0); i < imageNumSectors; i += 1024 {
-			select {
-			case <-data.bQuitTask:
-				return
-			default:
-				if imageNumSectors-int64(diskSector) < int64(1024) {
-					diskSectorData = make(
-						[]byte,
-						int64(diskSector)*(imageNumSectors-int64(diskSector)),
-					)
-					imageSectorData = make(
-						[]byte,
-						int64(diskSector)*(imageNumSectors-int64(diskSector)),
-					)
-				}
+			err := readImageSectors(*handles, &imageChunk, i, diskSector)
+			if err != nil {
+				ui.HandleError(
+					data,
+					errors.Join(
+						errors.New("WriteVerifyDisk(): ReadSectorDataFromHandle failed"),
+						err,
+					),
+				)
+				return false
+			}
+			applyPatches(imageChunk[:imageBytes], i*int64(diskSector), layout.patches)
 
-				err := ReadSectorDataFromHandle(
-					handles.hImage,
-					&imageSectorData,
-					i,
-					diskSector,
+			err = readDiskChunk(data, *handles, diskChunk, i, diskSector, layout.alignment)
+			if err != nil {
+				err = errors.Join(
+					errors.New("WriteVerifyDisk(): readDiskChunk failed"),
+					err,
 				)
-				if err != nil {
-					HandleError(
-						gui,
-						data,
-						errors.Join(
-							errors.New("WriteVerifyDisk(): ReadSectorDataFromHandle failed"),
-							err,
-						),
-					)
-					return
+				if resumeAfterRemoval(data, ui, handles, taskType, i, imageNumSectors, err) {
+					lasti = i
+					i -= 1024
+					continue
 				}
+				return false
+			}
 
-				err = ReadSectorDataFromHandle(
-					handles.hDisk,
-					&diskSectorData,
+			if !bytes.Equal(diskChunk[:imageBytes], imageChunk[:imageBytes]) {
+				strError := fmt.Sprintf(
+					"WriteVerifyDisk(): Verification failed at sector: %d\n",
 					i,
-					diskSector,
 				)
-				if err != nil {
-					HandleError(
-						gui,
-						data,
-						errors.Join(
-							errors.New("WriteVerifyDisk(): ReadSectorDataFromHandle failed"),
-							err,
-						),
-					)
-					return
-				}
-
-				if !bytes.Equal(diskSectorData, imageSectorData) {
-					strError := fmt.Sprintf(
-						"WriteVerifyDisk(): Verification failed at sector: %d\n",
-						i,
-					)
-					HandleError(gui, data, errors.New(strError))
-					return
-				}
+				ui.HandleError(data, errors.New(strError))
+				return false
+			}
 
-				gui.rwProgressBar.SetValue(float64(i))
-				if time.Since(updateTimer).Milliseconds() >= 1000 {
-					mbPerSec := float64(
-						(int64(diskSector) * (i - lasti)),
-					) * (1000 / float64(time.Since(updateTimer).Milliseconds())) / 1024.0 / 1024.0
-					setText := fmt.Sprintf("%.02f MB/s", mbPerSec)
-					gui.speedLabel.SetText(setText)
-					lasti = i
-					updateTimer = time.Now()
-				}
+			ui.SetProgress(i+int64(len(diskChunk)/diskSector), imageNumSectors)
+			if updateSpeed(ui, diskSector, i-lasti, updateTimer) {
+				lasti = i
+				updateTimer = time.Now()
 			}
 		}
-		gui.statusLabel.SetText("Success!")
-	}()
+	}
+
+	err := verifyOutlyingPatches(*handles, layout)
+	if err != nil {
+		ui.HandleError(
+			data,
+			errors.Join(errors.New("WriteVerifyDisk(): verifyOutlyingPatches failed"), err),
+		)
+		return false
+	}
+	return true
+}
+
+func VerifyDisk(data *MainData, ui Frontend, handles Handles) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	layout, err := getImageLayout(data, handles)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("WriteVerifyDisk(): getImageLayout failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+
+	checkTableSectorSize(data, ui, handles, layout, func() {
+		verifyMode := DiskIOMode(handles)
+		ui.SetStatus("Verifying (" + verifyMode + ")...")
+
+		go func() {
+			defer func() { cleanUp(data, ui, handles) }()
+
+			if verifyImage(data, ui, &handles, START_VERIFY, layout) {
+				ui.HandleSuccess("Verification passed using " + verifyMode + ".")
+			}
+		}()
+	})
 }
@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestImageSectors(t *testing.T) {
+	tests := []struct {
+		imageSize      int64
+		ignoreSize     bool
+		diskNumSectors int64
+		wantSize       int64
+		wantSectors    int64
+		wantErr        bool
+	}{
+		{imageSize: 1, diskNumSectors: 8, wantSize: 1, wantSectors: 1},
+		{imageSize: 511, diskNumSectors: 8, wantSize: 511, wantSectors: 1},
+		{imageSize: 512, diskNumSectors: 8, wantSize: 512, wantSectors: 1},
+		{imageSize: 513, diskNumSectors: 8, wantSize: 513, wantSectors: 2},
+		{imageSize: 8*512 + 7, diskNumSectors: 9, wantSize: 8*512 + 7, wantSectors: 9},
+		{imageSize: 8*512 + 7, diskNumSectors: 8, wantErr: true},
+		{imageSize: 8*512 + 7, ignoreSize: true, diskNumSectors: 8, wantSize: 8 * 512, wantSectors: 8},
+	}
+	for _, test := range tests {
+		size, sectors, err := imageSectors(test.ignoreSize, test.imageSize, test.diskNumSectors, 512)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("imageSectors(%d bytes, %d sectors): no error", test.imageSize, test.diskNumSectors)
+			}
+			continue
+		}
+		if err != nil || size != test.wantSize || sectors != test.wantSectors {
+			t.Errorf(
+				"imageSectors(%d bytes, %d sectors) = %d, %d, %v, want %d, %d",
+				test.imageSize, test.diskNumSectors, size, sectors, err, test.wantSize, test.wantSectors,
+			)
+		}
+	}
+}
+
+func TestChunkSectors(t *testing.T) {
+	tests := []struct {
+		i, numSectors, want int64
+	}{
+		{0, 1, 1},
+		{0, 1024, 1024},
+		{0, 3000, 1024},
+		{2048, 3000, 952},
+		{1024, 1025, 1},
+	}
+	for _, test := range tests {
+		got := chunkSectors(test.i, test.numSectors)
+		if got != test.want {
+			t.Errorf("chunkSectors(%d, %d) = %d, want %d", test.i, test.numSectors, got, test.want)
+		}
+	}
+}
+
+func TestImageBytesInChunk(t *testing.T) {
+	tests := []struct {
+		imageSize int64
+		i         int64
+		chunkLen  int
+		want      int
+	}{
+		{1, 0, 512, 1},
+		{511, 0, 512, 511},
+		{513, 0, 1024, 513},
+		{3000*512 + 7, 0, 1024 * 512, 1024 * 512},
+		{3000*512 + 7, 2048, 953 * 512, 952*512 + 7},
+	}
+	for _, test := range tests {
+		got := imageBytesInChunk(test.imageSize, test.i, 512, test.chunkLen)
+		if got != test.want {
+			t.Errorf(
+				"imageBytesInChunk(%d, %d, 512, %d) = %d, want %d",
+				test.imageSize, test.i, test.chunkLen, got, test.want,
+			)
+		}
+	}
+}
+
+func TestDiskIdentityMatches(t *testing.T) {
+	selected := DiskIdentity{ByID: "/dev/disk/by-id/usb-Card_0001", Serial: "0001", Size: 1 << 30}
+	tests := []struct {
+		name  string
+		other DiskIdentity
+		want  bool
+	}{
+		{"same", selected, true},
+		{"no udev data", DiskIdentity{Size: 1 << 30}, true},
+		{"no serial", DiskIdentity{ByID: selected.ByID, Size: 1 << 30}, true},
+		{"other serial", DiskIdentity{ByID: selected.ByID, Serial: "0002", Size: 1 << 30}, false},
+		{"other path", DiskIdentity{ByID: "/dev/disk/by-id/usb-Card_0002", Size: 1 << 30}, false},
+		{"other size", DiskIdentity{ByID: selected.ByID, Serial: "0001", Size: 2 << 30}, false},
+	}
+	for _, test := range tests {
+		if got := selected.Matches(test.other); got != test.want {
+			t.Errorf("%s: Matches() = %v, want %v", test.name, got, test.want)
+		}
+		if got := test.other.Matches(selected); got != test.want {
+			t.Errorf("%s, reversed: Matches() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// testFrontend records what a job reports, and is done once the job has
+// released its handles.
+type testFrontend struct {
+	errs     []error
+	success  string
+	finished chan struct{}
+}
+
+func newTestFrontend() *testFrontend {
+	return &testFrontend{finished: make(chan struct{})}
+}
+
+func (ui *testFrontend) SetStatus(status string)             {}
+func (ui *testFrontend) SetSpeed(speed string)               {}
+func (ui *testFrontend) SetElapsed(elapsed string)           {}
+func (ui *testFrontend) SetProgress(done int64, total int64) {}
+func (ui *testFrontend) ShowRescueMap(rescueMap *RescueMap)  {}
+func (ui *testFrontend) HandleError(data *MainData, err error) {
+	ui.errs = append(ui.errs, err)
+}
+func (ui *testFrontend) HandleSuccess(message string) { ui.success = message }
+func (ui *testFrontend) JobFinished(data MainData)    { close(ui.finished) }
+func (ui *testFrontend) ConfirmSectorSizeMismatch(imageSector int, diskSector int, callback func(MismatchChoice)) {
+	callback(MISMATCH_AS_IS)
+}
+
+// runFileJob runs job on the file at devPath as if it were the drive, and
+// waits for it to finish.
+func runFileJob(t *testing.T, data *MainData, job func(*MainData, Frontend, Handles)) *testFrontend {
+	t.Helper()
+	var handles Handles
+	var err error
+	handles.hDisk, handles.diskDirect, err = openHandle(data.selectedDrive, unix.O_RDWR, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles.hImage, handles.imageDirect, err = openHandle(data.imagePath, unix.O_RDONLY, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ui := newTestFrontend()
+	data.report = NewJobReport(data)
+	job(data, ui, handles)
+	select {
+	case <-ui.finished:
+	case <-time.After(time.Minute):
+		t.Fatal("the job did not finish")
+	}
+	return ui
+}
+
+// TestOddSizedImages writes and verifies images that end in a partial sector
+// on a file-backed device filled with 0xAA.
+func TestOddSizedImages(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	const deviceSize = 4 << 20
+
+	for _, imageSize := range []int64{1, 511, 513, 2500*512 + 7} {
+		for _, padTail := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%d bytes, pad %v", imageSize, padTail), func(t *testing.T) {
+				dir := t.TempDir()
+				devPath := filepath.Join(dir, "device")
+				imagePath := filepath.Join(dir, "image")
+
+				image := make([]byte, imageSize)
+				rand.New(rand.NewSource(imageSize)).Read(image)
+				if imageSize > 510 {
+					// Keep the image from passing for a partition table.
+					image[510] = 0
+				}
+				err := os.WriteFile(imagePath, image, 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(devPath, bytes.Repeat([]byte{0xAA}, deviceSize), 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				data := &MainData{
+					taskType:      START_WRITE,
+					selectedDrive: devPath,
+					imagePath:     imagePath,
+					padTail:       padTail,
+				}
+				ui := runFileJob(t, data, WriteDisk)
+				if len(ui.errs) > 0 || !strings.Contains(ui.success, "Verification passed") {
+					t.Fatalf("write failed: %v", ui.errs)
+				}
+
+				device, err := os.ReadFile(devPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tailEnd := (imageSize + 511) / 512 * 512
+				if !bytes.Equal(device[:imageSize], image) {
+					t.Fatal("the image was not written")
+				}
+				tailByte := byte(0xAA)
+				if padTail {
+					tailByte = 0
+				}
+				if !bytes.Equal(device[imageSize:tailEnd], bytes.Repeat([]byte{tailByte}, int(tailEnd-imageSize))) {
+					t.Fatalf("the tail of the last sector is not %#x", tailByte)
+				}
+				if !bytes.Equal(device[tailEnd:], bytes.Repeat([]byte{0xAA}, int(deviceSize-tailEnd))) {
+					t.Fatal("the drive was written past the last sector of the image")
+				}
+
+				verify := func() *testFrontend {
+					return runFileJob(t, &MainData{
+						taskType:      START_VERIFY,
+						selectedDrive: devPath,
+						imagePath:     imagePath,
+					}, VerifyDisk)
+				}
+
+				// What follows the image in its last sector is not compared.
+				if tailEnd > imageSize {
+					device[tailEnd-1] ^= 0xFF
+					err = os.WriteFile(devPath, device, 0o600)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				ui = verify()
+				if len(ui.errs) > 0 {
+					t.Fatalf("verify failed on a changed tail: %v", ui.errs)
+				}
+
+				device[imageSize-1] ^= 0xFF
+				err = os.WriteFile(devPath, device, 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ui = verify()
+				if len(ui.errs) == 0 {
+					t.Fatal("verify passed on a changed image byte")
+				}
+			})
+		}
+	}
+}
+
+func TestIsBlank(t *testing.T) {
+	const diskSize = 256 << 20
+	devPath := filepath.Join(t.TempDir(), "device")
+	device, err := os.Create(devPath)
+	if err == nil {
+		err = device.Truncate(diskSize)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	var handles Handles
+	handles.hDisk, handles.diskDirect, err = openHandle(devPath, unix.O_RDONLY, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(handles.hDisk)
+
+	data := &MainData{selectedDrive: devPath}
+	layout := &imageLayout{
+		diskSector:     512,
+		diskNumSectors: diskSize / 512,
+		alignment:      512,
+		pool:           NewBufferPool(512*1024, 512),
+	}
+	ui := newTestFrontend()
+	whole := []Extent{{0, diskSize}}
+	blank, err := isBlank(data, ui, handles, layout, whole)
+	if err != nil || !blank {
+		t.Fatalf("isBlank() = %t, %v on an empty drive", blank, err)
+	}
+
+	// A single byte deep into a drive whose start was wiped is found, but
+	// only when it lies in what the snapshot would keep.
+	_, err = device.WriteAt([]byte{0x42}, 40<<20+2560)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blank, err = isBlank(data, ui, handles, layout, whole)
+	if err != nil || blank {
+		t.Fatalf("isBlank() = %t, %v on a drive holding data", blank, err)
+	}
+	blank, err = isBlank(data, ui, handles, layout, []Extent{{0, 32 << 20}, {diskSize - 8<<20, 8 << 20}})
+	if err != nil || !blank {
+		t.Fatalf("isBlank() = %t, %v on data outside the extents", blank, err)
+	}
+}
+
+// TestFailOnRemoval checks that a duplicator job gives up on a removed drive
+// instead of waiting for it.
+func TestFailOnRemoval(t *testing.T) {
+	data := &MainData{selectedDrive: "/dev/sdz", failOnRemoval: true, bQuitTask: make(chan struct{}, 1)}
+	ui := newTestFrontend()
+	var handles Handles
+	if resumeAfterRemoval(data, ui, &handles, START_WRITE, 5, 10, unix.ENODEV) {
+		t.Fatal("resumed after the drive was removed")
+	}
+	if len(ui.errs) != 1 || !strings.Contains(ui.errs[0].Error(), "removed") {
+		t.Fatalf("removal not reported: %v", ui.errs)
+	}
+}
+
+// TestOpenHandleProbe checks that probing a write-only handle for O_DIRECT
+// leaves the file as it was, whether or not the filesystem takes O_DIRECT.
+func TestOpenHandleProbe(t *testing.T) {
+	for _, content := range [][]byte{nil, []byte("short"), bytes.Repeat([]byte{0xAA}, 3*ioAlignment)} {
+		t.Run(fmt.Sprintf("%d bytes", len(content)), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image")
+			err := os.WriteFile(path, content, 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd, _, err := openHandle(path, unix.O_WRONLY, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unix.Close(fd)
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("the probe changed the file to %d bytes", len(got))
+			}
+		})
+	}
+}
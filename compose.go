@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiskLayout describes a disk to compose from partition images and raw
+// blobs, in the spirit of genimage. Offsets and sizes take the forms
+// ParseSize reads, and image paths are relative to the layout file.
+type DiskLayout struct {
+	// Table is mbr or gpt.
+	Table string `json:"table"`
+	// Size is the size of the image composed. A drive is always composed
+	// whole, so that the backup GPT lands at its end.
+	Size string `json:"size,omitempty"`
+	// SectorSize is the sector size of the image composed, 512 by default.
+	SectorSize int               `json:"sector_size,omitempty"`
+	Partitions []LayoutPartition `json:"partitions"`
+	Raw        []LayoutRaw       `json:"raw,omitempty"`
+
+	// dir is the directory of the layout file.
+	dir string
+}
+
+type LayoutPartition struct {
+	Name string `json:"name,omitempty"`
+	// Type is a GPT type GUID, an MBR type byte such as 0x83, or one of
+	// the names in partitionTypes.
+	Type string `json:"type"`
+	// Offset is where the partition starts, by default at the next MiB
+	// after the previous one.
+	Offset string `json:"offset,omitempty"`
+	// Size is the size of the partition, by default that of its image.
+	// The last partition without either fills the rest of the disk.
+	Size     string `json:"size,omitempty"`
+	Image    string `json:"image,omitempty"`
+	Bootable bool   `json:"bootable,omitempty"`
+}
+
+// LayoutRaw is a blob, such as a bootloader, put at an offset of the disk
+// outside the partitions.
+type LayoutRaw struct {
+	Image  string `json:"image"`
+	Offset string `json:"offset"`
+}
+
+type partitionType struct {
+	mbr byte
+	gpt string
+}
+
+var partitionTypes = map[string]partitionType{
+	"linux": {0x83, "0FC63DAF-8483-4772-8E79-3D69D8477DE4"},
+	"efi":   {0xEF, "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"},
+	"fat32": {0x0C, basicDataTypeGUID},
+	"data":  {0x07, basicDataTypeGUID},
+	"swap":  {0x82, "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"},
+}
+
+// mbrBootCode is the part of the MBR before the disk signature. It is left
+// to a raw blob, such as the boot code of a bootloader.
+const mbrBootCode = 440
+
+// composeSource is a file placed at an offset of the disk.
+type composeSource struct {
+	name   string
+	path   string
+	offset int64
+	length int64
+}
+
+// Composition is what composing a disk writes: every extent, filled with the
+// sources and the patches that fall into it and zeros elsewhere.
+type Composition struct {
+	Size       int64
+	SectorSize int
+	Extents    []Extent
+	Patches    []Patch
+	Sources    []composeSource
+	// Partitions is the table the composition holds, for the report.
+	Partitions []Partition
+
+	files map[string]*os.File
+}
+
+func LoadDiskLayout(path string) (*DiskLayout, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Join(errors.New("LoadDiskLayout(): ReadFile failed"), err)
+	}
+	layout := &DiskLayout{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(layout)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("%s is not a disk layout", path), err)
+	}
+	layout.dir = filepath.Dir(path)
+	return layout, nil
+}
+
+func (layout *DiskLayout) imagePath(image string) string {
+	if filepath.IsAbs(image) {
+		return image
+	}
+	return filepath.Join(layout.dir, image)
+}
+
+func imageSize(path string) (int64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// validGUID tells whether guid reads as a GUID such as
+// 0FC63DAF-8483-4772-8E79-3D69D8477DE4.
+func validGUID(guid string) bool {
+	groups := strings.Split(guid, "-")
+	if len(groups) != 5 {
+		return false
+	}
+	for i, group := range groups {
+		_, err := hex.DecodeString(group)
+		if err != nil || len(group) != []int{8, 4, 4, 4, 12}[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (partition LayoutPartition) gptType() (string, error) {
+	if known, ok := partitionTypes[strings.ToLower(partition.Type)]; ok {
+		return known.gpt, nil
+	}
+	if !validGUID(partition.Type) {
+		return "", fmt.Errorf("%q is not a GPT partition type", partition.Type)
+	}
+	return strings.ToUpper(partition.Type), nil
+}
+
+func (partition LayoutPartition) mbrType() (byte, error) {
+	if known, ok := partitionTypes[strings.ToLower(partition.Type)]; ok {
+		return known.mbr, nil
+	}
+	partType, err := strconv.ParseUint(partition.Type, 0, 8)
+	if err != nil || partType == 0 {
+		return 0, fmt.Errorf("%q is not an MBR partition type", partition.Type)
+	}
+	return byte(partType), nil
+}
+
+// Plan lays the disk out. diskSize is the size of the drive composed to, 0
+// when an image is composed.
+func (layout *DiskLayout) Plan(diskSize int64, sectorSize int) (*Composition, error) {
+	tableType, err := ParseTableType(layout.Table)
+	if err != nil {
+		return nil, err
+	}
+	if len(layout.Partitions) < 1 {
+		return nil, errors.New("The layout has no partitions.")
+	}
+	if tableType == TABLE_MBR && len(layout.Partitions) > 4 {
+		return nil, errors.New("An MBR holds 4 partitions at most.")
+	}
+	if tableType == TABLE_GPT && len(layout.Partitions) > gptEntryCount {
+		return nil, fmt.Errorf("A GPT holds %d partitions at most.", gptEntryCount)
+	}
+	ss := int64(sectorSize)
+	entriesSectors := int64(gptEntryCount*gptEntrySize) / ss
+	// tableEnd is where the primary table ends, backupRoom is what the
+	// backup GPT takes at the end of the disk.
+	tableEnd, backupRoom := ss, int64(0)
+	if tableType == TABLE_GPT {
+		tableEnd, backupRoom = (2+entriesSectors)*ss, (1+entriesSectors)*ss
+	}
+
+	size := diskSize
+	if len(layout.Size) > 0 {
+		layoutSize, err := ParseSize(layout.Size)
+		if err != nil {
+			return nil, errors.Join(errors.New("size:"), err)
+		}
+		if diskSize > 0 && layoutSize > diskSize {
+			return nil, fmt.Errorf("The layout takes %d bytes, the drive only has %d.", layoutSize, diskSize)
+		}
+		if diskSize == 0 {
+			size = layoutSize
+		}
+	}
+	if size%ss != 0 {
+		return nil, fmt.Errorf("The size must be a multiple of the sector size (%d bytes).", sectorSize)
+	}
+
+	comp := &Composition{SectorSize: sectorSize}
+	next := int64(partitionAlignment)
+	for i, partition := range layout.Partitions {
+		name := partition.Name
+		if len(name) < 1 {
+			name = fmt.Sprintf("partition %d", i+1)
+		}
+		start := roundUp64(next, partitionAlignment)
+		if len(partition.Offset) > 0 {
+			start, err = ParseSize(partition.Offset)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("%s:", name), err)
+			}
+		}
+		if start%ss != 0 || start < tableEnd {
+			return nil, fmt.Errorf("%s must start on a sector after the partition table.", name)
+		}
+
+		var source composeSource
+		if len(partition.Image) > 0 {
+			source = composeSource{name: name, path: layout.imagePath(partition.Image), offset: start}
+			source.length, err = imageSize(source.path)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("%s:", name), err)
+			}
+		}
+		length := roundUp64(source.length, ss)
+		if len(partition.Size) > 0 {
+			length, err = ParseSize(partition.Size)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("%s:", name), err)
+			}
+		} else if len(partition.Image) < 1 {
+			if i != len(layout.Partitions)-1 || size == 0 {
+				return nil, fmt.Errorf("%s needs a size or an image.", name)
+			}
+			length = (size-backupRoom)/partitionAlignment*partitionAlignment - start
+		}
+		if length <= 0 || length%ss != 0 {
+			return nil, fmt.Errorf("The size of %s must be a positive multiple of the sector size.", name)
+		}
+		if source.length > length {
+			return nil, fmt.Errorf("The image of %s is %d bytes, the partition only %d.", name, source.length, length)
+		}
+		if source.length > 0 {
+			comp.Sources = append(comp.Sources, source)
+		}
+		comp.Partitions = append(comp.Partitions, Partition{
+			Index:      i + 1,
+			Type:       partition.Type,
+			Name:       name,
+			StartLBA:   start / ss,
+			NumSectors: length / ss,
+		})
+		next = start + length
+	}
+
+	raws := []composeSource{}
+	for _, raw := range layout.Raw {
+		source := composeSource{name: raw.Image, path: layout.imagePath(raw.Image)}
+		source.offset, err = ParseSize(raw.Offset)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("%s:", raw.Image), err)
+		}
+		source.length, err = imageSize(source.path)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("%s:", raw.Image), err)
+		}
+		raws = append(raws, source)
+		next = max(next, source.offset+source.length)
+	}
+
+	if size == 0 {
+		size = roundUp64(next+backupRoom, partitionAlignment)
+	}
+	comp.Size = size
+	err = comp.buildTable(tableType, layout.Partitions)
+	if err != nil {
+		return nil, err
+	}
+	err = comp.check(backupRoom, raws)
+	if err != nil {
+		return nil, err
+	}
+	comp.Sources = append(comp.Sources, raws...)
+	comp.plan()
+	return comp, nil
+}
+
+func roundUp64(n int64, align int64) int64 {
+	return (n + align - 1) / align * align
+}
+
+func (comp *Composition) buildTable(tableType TableType, partitions []LayoutPartition) error {
+	ss := int64(comp.SectorSize)
+	numSectors := comp.Size / ss
+	if tableType == TABLE_GPT {
+		entries := make([]byte, gptEntryCount*gptEntrySize)
+		for i, partition := range partitions {
+			typeGUID, err := partition.gptType()
+			if err != nil {
+				return err
+			}
+			attributes := uint64(0)
+			if partition.Bootable {
+				// The legacy BIOS bootable attribute.
+				attributes = 1 << 2
+			}
+			err = putGPTEntry(
+				entries[i*gptEntrySize:],
+				typeGUID,
+				comp.Partitions[i].StartLBA,
+				comp.Partitions[i].NumSectors,
+				partition.Name,
+				attributes,
+			)
+			if err != nil {
+				return errors.Join(errors.New("Composition.buildTable(): putGPTEntry failed"), err)
+			}
+		}
+		patches, err := newGPTStructures(numSectors, comp.SectorSize, entries)
+		if err != nil {
+			return err
+		}
+		// The boot code of the protective MBR is left to the raw blobs.
+		patches[0] = Patch{Offset: mbrBootCode, Data: patches[0].Data[mbrBootCode:]}
+		comp.Patches = patches
+		return nil
+	}
+
+	if numSectors > 0xFFFFFFFF {
+		return errors.New("The disk is too large for an MBR. Use GPT instead.")
+	}
+	mbr := make([]byte, 512)
+	_, err := rand.Read(mbr[0x1B8:0x1BC])
+	if err != nil {
+		return errors.Join(errors.New("Composition.buildTable(): Read failed"), err)
+	}
+	mbr[510], mbr[511] = 0x55, 0xAA
+	for i, partition := range partitions {
+		partType, err := partition.mbrType()
+		if err != nil {
+			return err
+		}
+		putMBREntry(mbr[0x1BE+16*i:], partType, comp.Partitions[i].StartLBA, comp.Partitions[i].NumSectors, partition.Bootable)
+	}
+	comp.Patches = []Patch{{Offset: mbrBootCode, Data: mbr[mbrBootCode:]}}
+	return nil
+}
+
+// check makes sure no partition or raw blob lies outside the disk or on top
+// of something else.
+func (comp *Composition) check(backupRoom int64, raws []composeSource) error {
+	type item struct {
+		name string
+		Extent
+	}
+	items := []item{}
+	for _, patch := range comp.Patches {
+		items = append(items, item{"the partition table", Extent{patch.Offset, int64(len(patch.Data))}})
+	}
+	ss := int64(comp.SectorSize)
+	for _, partition := range comp.Partitions {
+		extent := Extent{partition.StartLBA * ss, partition.NumSectors * ss}
+		if extent.Offset+extent.Length > comp.Size-backupRoom {
+			return fmt.Errorf("%s reaches past the end of the disk.", partition.Name)
+		}
+		items = append(items, item{partition.Name, extent})
+	}
+	for _, source := range raws {
+		if source.offset+source.length > comp.Size {
+			return fmt.Errorf("%s reaches past the end of the disk.", source.name)
+		}
+		items = append(items, item{source.name, Extent{source.offset, source.length}})
+	}
+
+	slices.SortFunc(items, func(a item, b item) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	for i := 1; i < len(items); i++ {
+		if items[i-1].Offset+items[i-1].Length > items[i].Offset {
+			return fmt.Errorf("%s runs into %s at byte %d.", items[i-1].name, items[i].name, items[i].Offset)
+		}
+	}
+	return nil
+}
+
+// plan works out the extents to write: the sources and the table, the space
+// before the first partition, the first MiB of every partition and the last
+// MiB of the disk, so that no stale filesystem or partition table is found
+// there later. Everything else is left as it is on a drive.
+func (comp *Composition) plan() {
+	ss := int64(comp.SectorSize)
+	extents := []Extent{}
+	add := func(offset int64, length int64) {
+		end := min(roundUp64(offset+length, ss), comp.Size)
+		offset = offset / ss * ss
+		if end > offset {
+			extents = append(extents, Extent{offset, end - offset})
+		}
+	}
+	for _, patch := range comp.Patches {
+		add(patch.Offset, int64(len(patch.Data)))
+	}
+	for _, source := range comp.Sources {
+		add(source.offset, source.length)
+	}
+	add(0, comp.Partitions[0].StartLBA*ss)
+	for _, partition := range comp.Partitions {
+		add(partition.StartLBA*ss, min(partition.NumSectors*ss, partitionAlignment))
+	}
+	add(comp.Size-partitionAlignment, partitionAlignment)
+
+	slices.SortFunc(extents, func(a Extent, b Extent) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	comp.Extents = []Extent{}
+	for _, extent := range extents {
+		last := len(comp.Extents) - 1
+		if last >= 0 && comp.Extents[last].Offset+comp.Extents[last].Length >= extent.Offset {
+			end := max(comp.Extents[last].Offset+comp.Extents[last].Length, extent.Offset+extent.Length)
+			comp.Extents[last].Length = end - comp.Extents[last].Offset
+			continue
+		}
+		comp.Extents = append(comp.Extents, extent)
+	}
+}
+
+// Written is the number of bytes the composition writes.
+func (comp *Composition) Written() int64 {
+	written := int64(0)
+	for _, extent := range comp.Extents {
+		written += extent.Length
+	}
+	return written
+}
+
+func (comp *Composition) open() error {
+	comp.files = map[string]*os.File{}
+	for _, source := range comp.Sources {
+		if _, ok := comp.files[source.path]; ok {
+			continue
+		}
+		file, err := os.Open(source.path)
+		if err != nil {
+			comp.close()
+			return err
+		}
+		comp.files[source.path] = file
+	}
+	return nil
+}
+
+func (comp *Composition) close() {
+	for _, file := range comp.files {
+		file.Close()
+	}
+}
+
+// fill puts what belongs at byte offset of the disk into chunk.
+func (comp *Composition) fill(chunk []byte, offset int64) error {
+	clear(chunk)
+	end := offset + int64(len(chunk))
+	for _, source := range comp.Sources {
+		from := max(offset, source.offset)
+		to := min(end, source.offset+source.length)
+		if from >= to {
+			continue
+		}
+		n, err := comp.files[source.path].ReadAt(chunk[from-offset:to-offset], from-source.offset)
+		if err != nil && (err != io.EOF || n < int(to-from)) {
+			return errors.Join(fmt.Errorf("Composition.fill(): reading %s failed", source.path), err)
+		}
+	}
+	applyPatches(chunk, offset, comp.Patches)
+	return nil
+}
+
+// composeChunks calls step with every chunk of the extents of comp, filled
+// with what belongs there, and keeps the progress up to date.
+func composeChunks(
+	data *MainData,
+	ui Frontend,
+	comp *Composition,
+	pool *BufferPool,
+	step func(expected []byte, sector int64) error,
+) error {
+	buf := pool.Get()
+	defer pool.Put(buf)
+	ss := int64(comp.SectorSize)
+	total := comp.Written() / ss
+	done := int64(0)
+	lastDone := int64(0)
+	updateTimer := time.Now()
+
+	ui.SetProgress(0, total)
+	for _, extent := range comp.Extents {
+		first := extent.Offset / ss
+		numSectors := extent.Length / ss
+		for i := int64(0); i < numSectors; i += 1024 {
+			select {
+			case <-data.bQuitTask:
+				return errCancelled
+			default:
+				chunk := buf[:chunkSectors(i, numSectors)*ss]
+				err := comp.fill(chunk, (first+i)*ss)
+				if err == nil {
+					err = step(chunk, first+i)
+				}
+				if err != nil {
+					return err
+				}
+
+				done += int64(len(chunk)) / ss
+				ui.SetProgress(done, total)
+				if updateSpeed(ui, comp.SectorSize, done-lastDone, updateTimer) {
+					lastDone = done
+					updateTimer = time.Now()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (comp *Composition) addNotes(report *JobReport) {
+	for _, partition := range comp.Partitions {
+		report.AddNote(
+			"%s: %d sectors at sector %d",
+			partition.Name,
+			partition.NumSectors,
+			partition.StartLBA,
+		)
+	}
+	for _, source := range comp.Sources {
+		report.AddNote("%s at byte %d", source.path, source.offset)
+	}
+}
+
+// ComposeDisk composes the layout in data.composeLayout onto the selected
+// drive, and reads everything it wrote back.
+func ComposeDisk(data *MainData, ui Frontend, handles Handles) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	geometry, err := getDiskGeometry(handles)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("ComposeDisk(): getDiskGeometry failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+	layout, err := LoadDiskLayout(data.composeLayout)
+	var comp *Composition
+	if err == nil {
+		comp, err = layout.Plan(geometry.numSectors*int64(geometry.sectorSize), geometry.sectorSize)
+	}
+	if err == nil {
+		err = comp.open()
+	}
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("ComposeDisk(): Plan failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+
+	go func() {
+		defer func() { cleanUp(data, ui, handles) }()
+		defer comp.close()
+
+		ui.SetStatus("Composing...")
+		err := composeChunks(data, ui, comp, geometry.pool, func(expected []byte, sector int64) error {
+			err := writeDiskChunk(data, handles, expected, sector, geometry.sectorSize, geometry.alignment)
+			if err != nil {
+				return errors.Join(errors.New("ComposeDisk(): writeDiskChunk failed"), err)
+			}
+			return nil
+		})
+		if err == nil {
+			err = SyncDisk(handles)
+		}
+		if err == nil {
+			err = FlushDiskCache(handles)
+		}
+		if err != nil {
+			if !errors.Is(err, errCancelled) {
+				ui.HandleError(data, err)
+			}
+			return
+		}
+
+		ui.SetStatus("Verifying (" + DiskIOMode(handles) + ")...")
+		diskData := geometry.pool.Get()
+		defer geometry.pool.Put(diskData)
+		err = composeChunks(data, ui, comp, geometry.pool, func(expected []byte, sector int64) error {
+			diskChunk := diskData[:len(expected)]
+			err := readDiskChunk(data, handles, diskChunk, sector, geometry.sectorSize, geometry.alignment)
+			if err != nil {
+				return errors.Join(errors.New("ComposeDisk(): readDiskChunk failed"), err)
+			}
+			if !bytes.Equal(diskChunk, expected) {
+				return fmt.Errorf("Verification failed at sector: %d", sector)
+			}
+			return nil
+		})
+		if err != nil {
+			if !errors.Is(err, errCancelled) {
+				ui.HandleError(data, err)
+			}
+			return
+		}
+
+		comp.addNotes(data.report)
+		ui.HandleSuccess(fmt.Sprintf(
+			"The disk was composed with %d partitions, %s were written.",
+			len(comp.Partitions),
+			fmtBytes(comp.Written()),
+		))
+	}()
+}
+
+// ComposeImage composes the layout in data.composeLayout into the image file
+// data.imagePath. Only the extents are written, the rest of the file is left
+// sparse.
+func ComposeImage(data *MainData, ui Frontend) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	fail := func(err error) {
+		ui.HandleError(data, err)
+		finishJob(data, ui)
+	}
+	layout, err := LoadDiskLayout(data.composeLayout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	sectorSize := layout.SectorSize
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+	if sectorSize < 512 || sectorSize > 4096 || sectorSize&(sectorSize-1) != 0 {
+		fail(fmt.Errorf("%d-byte sectors are not supported.", sectorSize))
+		return
+	}
+	comp, err := layout.Plan(0, sectorSize)
+	if err == nil {
+		err = comp.open()
+	}
+	if err != nil {
+		fail(errors.Join(errors.New("ComposeImage(): Plan failed"), err))
+		return
+	}
+	image, err := os.OpenFile(data.imagePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err == nil {
+		err = image.Truncate(comp.Size)
+	}
+	if err != nil {
+		comp.close()
+		fail(errors.Join(errors.New("ComposeImage(): OpenFile failed"), err))
+		return
+	}
+
+	go func() {
+		defer func() { finishJob(data, ui) }()
+		defer image.Close()
+		defer comp.close()
+
+		ui.SetStatus("Composing...")
+		err := composeChunks(data, ui, comp, NewBufferPool(sectorSize*1024, ioAlignment), func(expected []byte, sector int64) error {
+			_, err := image.WriteAt(expected, sector*int64(sectorSize))
+			return err
+		})
+		if err == nil {
+			err = image.Sync()
+		}
+		if err != nil {
+			if !errors.Is(err, errCancelled) {
+				ui.HandleError(data, errors.Join(errors.New("ComposeImage(): WriteAt failed"), err))
+			}
+			return
+		}
+
+		comp.addNotes(data.report)
+		ui.HandleSuccess(fmt.Sprintf(
+			"%s (%s) was composed with %d partitions.",
+			data.imagePath,
+			fmtBytes(comp.Size),
+			len(comp.Partitions),
+		))
+	}()
+}
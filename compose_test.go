@@ -0,0 +1,217 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskLayoutPlan(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{"boot.img": 100 << 10, "big.img": 3 << 20, "spl.bin": 1 << 10} {
+		err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		layout   DiskLayout
+		diskSize int64
+		wantErr  bool
+		// want holds the start and the length of every partition in
+		// sectors.
+		want     [][2]int64
+		wantSize int64
+	}{
+		{
+			name: "MBR filling the drive",
+			layout: DiskLayout{Table: "mbr", Partitions: []LayoutPartition{
+				{Type: "fat32", Image: "boot.img"},
+				{Type: "linux"},
+			}},
+			diskSize: 64 << 20,
+			want:     [][2]int64{{2048, 200}, {4096, 126976}},
+			wantSize: 64 << 20,
+		},
+		{
+			name: "GPT keeping room for its backup",
+			layout: DiskLayout{Table: "gpt", Partitions: []LayoutPartition{
+				{Type: "efi", Image: "boot.img"},
+				{Type: "linux"},
+			}},
+			diskSize: 64 << 20,
+			want:     [][2]int64{{2048, 200}, {4096, 124928}},
+			wantSize: 64 << 20,
+		},
+		{
+			name: "image sized by its contents",
+			layout: DiskLayout{
+				Table:      "mbr",
+				Partitions: []LayoutPartition{{Type: "0x83", Size: "4M"}},
+				Raw:        []LayoutRaw{{Image: "spl.bin", Offset: "8K"}},
+			},
+			want:     [][2]int64{{2048, 8192}},
+			wantSize: 5 << 20,
+		},
+		{
+			name: "image of a given size",
+			layout: DiskLayout{Table: "gpt", Size: "32M", Partitions: []LayoutPartition{
+				{Type: "linux", Offset: "2M", Size: "16M"},
+			}},
+			want:     [][2]int64{{4096, 32768}},
+			wantSize: 32 << 20,
+		},
+		{
+			name:    "unknown table",
+			layout:  DiskLayout{Table: "apm", Partitions: []LayoutPartition{{Type: "linux", Size: "1M"}}},
+			wantErr: true,
+		},
+		{name: "no partitions", layout: DiskLayout{Table: "gpt"}, wantErr: true},
+		{
+			name: "five MBR partitions",
+			layout: DiskLayout{Table: "mbr", Partitions: []LayoutPartition{
+				{Type: "linux", Size: "1M"}, {Type: "linux", Size: "1M"}, {Type: "linux", Size: "1M"},
+				{Type: "linux", Size: "1M"}, {Type: "linux", Size: "1M"},
+			}},
+			wantErr: true,
+		},
+		{
+			name:     "layout larger than the drive",
+			layout:   DiskLayout{Table: "mbr", Size: "128M", Partitions: []LayoutPartition{{Type: "linux", Size: "1M"}}},
+			diskSize: 64 << 20,
+			wantErr:  true,
+		},
+		{
+			name:    "partition inside the GPT",
+			layout:  DiskLayout{Table: "gpt", Partitions: []LayoutPartition{{Type: "linux", Offset: "8K", Size: "1M"}}},
+			wantErr: true,
+		},
+		{
+			name: "partition without a size before the last",
+			layout: DiskLayout{Table: "mbr", Partitions: []LayoutPartition{
+				{Type: "linux"}, {Type: "linux", Size: "1M"},
+			}},
+			diskSize: 64 << 20,
+			wantErr:  true,
+		},
+		{
+			name:    "image larger than its partition",
+			layout:  DiskLayout{Table: "mbr", Partitions: []LayoutPartition{{Type: "linux", Size: "1M", Image: "big.img"}}},
+			wantErr: true,
+		},
+		{
+			name:    "size not in sectors",
+			layout:  DiskLayout{Table: "mbr", Partitions: []LayoutPartition{{Type: "linux", Size: "1000"}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown partition type",
+			layout:  DiskLayout{Table: "gpt", Partitions: []LayoutPartition{{Type: "0x83", Size: "1M"}}},
+			wantErr: true,
+		},
+		{
+			name: "overlapping partitions",
+			layout: DiskLayout{Table: "mbr", Partitions: []LayoutPartition{
+				{Type: "linux", Size: "4M"}, {Type: "linux", Offset: "2M", Size: "4M"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "raw blob on a partition",
+			layout: DiskLayout{
+				Table:      "mbr",
+				Partitions: []LayoutPartition{{Type: "linux", Size: "4M"}},
+				Raw:        []LayoutRaw{{Image: "spl.bin", Offset: "2M"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:     "partition past the end of the drive",
+			layout:   DiskLayout{Table: "gpt", Partitions: []LayoutPartition{{Type: "linux", Size: "63M"}}},
+			diskSize: 64 << 20,
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout := test.layout
+			layout.dir = dir
+			comp, err := layout.Plan(test.diskSize, 512)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("Plan() accepted the layout")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if comp.Size != test.wantSize {
+				t.Errorf("the disk is %d bytes, want %d", comp.Size, test.wantSize)
+			}
+			if len(comp.Partitions) != len(test.want) {
+				t.Fatalf("got %d partitions, want %d", len(comp.Partitions), len(test.want))
+			}
+			for i, want := range test.want {
+				got := [2]int64{comp.Partitions[i].StartLBA, comp.Partitions[i].NumSectors}
+				if got != want {
+					t.Errorf("partition %d spans sectors %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompositionCheck(t *testing.T) {
+	const backupRoom = 33 * 512
+	tests := []struct {
+		name       string
+		partitions []Partition
+		raws       []composeSource
+		wantErr    bool
+	}{
+		{
+			name:       "apart",
+			partitions: []Partition{{Name: "boot", StartLBA: 2048, NumSectors: 2048}, {Name: "root", StartLBA: 4096, NumSectors: 4096}},
+			raws:       []composeSource{{name: "boot code", offset: 0, length: mbrBootCode}, {name: "spl", offset: 8192, length: 1024}},
+		},
+		{
+			name:       "partitions overlapping",
+			partitions: []Partition{{Name: "boot", StartLBA: 2048, NumSectors: 2049}, {Name: "root", StartLBA: 4096, NumSectors: 4096}},
+			wantErr:    true,
+		},
+		{
+			name:       "partition in the room of the backup GPT",
+			partitions: []Partition{{Name: "root", StartLBA: 2048, NumSectors: 16384 - 2048 - 32}},
+			wantErr:    true,
+		},
+		{
+			name:       "boot code over the partition table",
+			partitions: []Partition{{Name: "root", StartLBA: 2048, NumSectors: 2048}},
+			raws:       []composeSource{{name: "boot code", offset: 0, length: 446}},
+			wantErr:    true,
+		},
+		{
+			name:       "raw blob past the end",
+			partitions: []Partition{{Name: "root", StartLBA: 2048, NumSectors: 2048}},
+			raws:       []composeSource{{name: "env", offset: 8<<20 - 512, length: 1024}},
+			wantErr:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			comp := &Composition{
+				Size:       8 << 20,
+				SectorSize: 512,
+				Partitions: test.partitions,
+				Patches:    []Patch{{Offset: mbrBootCode, Data: make([]byte, 512-mbrBootCode)}},
+			}
+			err := comp.check(backupRoom, test.raws)
+			if (err != nil) != test.wantErr {
+				t.Errorf("check() = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// deltaStats counts what a delta write did with the chunks of an image.
+type deltaStats struct {
+	unchanged int64
+	rewritten int64
+	// unchangedBytes is what did not have to be written.
+	unchangedBytes int64
+}
+
+func (stats deltaStats) String() string {
+	return fmt.Sprintf(
+		"%d of %d chunks (%s) were already on the drive, %d were rewritten.",
+		stats.unchanged,
+		stats.unchanged+stats.rewritten,
+		fmtBytes(stats.unchangedBytes),
+		stats.rewritten,
+	)
+}
+
+// writeChangedChunk reads what the drive holds where chunk goes and writes
+// chunk only when it differs. current is a buffer at least as large as chunk.
+// Reading is much cheaper than writing on flash, and every write skipped
+// spares the drive wear.
+func writeChangedChunk(
+	data *MainData,
+	handles Handles,
+	chunk []byte,
+	current []byte,
+	chunkStart int64,
+	sectorSize int,
+	alignment int,
+	stats *deltaStats,
+) error {
+	current = current[:len(chunk)]
+	err := readDiskChunk(data, handles, current, chunkStart, sectorSize, alignment)
+	if err != nil {
+		return errors.Join(errors.New("writeChangedChunk(): readDiskChunk failed"), err)
+	}
+	if bytes.Equal(current, chunk) {
+		stats.unchanged++
+		stats.unchangedBytes += int64(len(chunk))
+		return nil
+	}
+
+	stats.rewritten++
+	return writeDiskChunk(data, handles, chunk, chunkStart, sectorSize, alignment)
+}
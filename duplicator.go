@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DuplicatorFilter selects the drives a duplicator writes to. Zero values
+// do not restrict anything.
+type DuplicatorFilter struct {
+	MinSize int64
+	MaxSize int64
+	// Vendor is matched case-insensitively against the vendor and the model
+	// of the drive, since card readers often report the brand as the model.
+	Vendor string
+}
+
+func (filter DuplicatorFilter) Matches(identity DiskIdentity) bool {
+	if filter.MinSize > 0 && identity.Size < filter.MinSize {
+		return false
+	}
+	if filter.MaxSize > 0 && identity.Size > filter.MaxSize {
+		return false
+	}
+	if len(filter.Vendor) > 0 {
+		vendor := strings.ToLower(filter.Vendor)
+		return strings.Contains(strings.ToLower(identity.Vendor), vendor) ||
+			strings.Contains(strings.ToLower(identity.Model), vendor)
+	}
+	return true
+}
+
+type SlotState int
+
+const (
+	SLOT_IDLE SlotState = iota
+	SLOT_BUSY
+	SLOT_PASSED
+	SLOT_FAILED
+)
+
+// Slot is a place a drive shows up at, named after its device path.
+type Slot struct {
+	Path     string
+	State    SlotState
+	Status   string
+	Progress float64
+}
+
+// DuplicatorBoard shows the slots of a duplicator and its session counters.
+type DuplicatorBoard interface {
+	UpdateSlot(slot Slot)
+	UpdateCounts(passed int, failed int)
+}
+
+// Duplicator writes and verifies the same image on every matching drive that
+// is inserted while it runs. Drives present when it starts are left alone.
+type Duplicator struct {
+	imagePath string
+	filter    DuplicatorFilter
+	retry     RetryPolicy
+	board     DuplicatorBoard
+
+	mutex sync.Mutex
+	slots map[string]*Slot
+	// jobs holds the job running on each busy slot, until it is finished or
+	// cancelled.
+	jobs map[string]*MainData
+	// pulled holds the slots whose drive was removed while their job ran.
+	pulled  map[string]bool
+	passed  int
+	failed  int
+	stopped bool
+	quit    chan struct{}
+}
+
+func NewDuplicator(imagePath string, filter DuplicatorFilter, retry RetryPolicy, board DuplicatorBoard) *Duplicator {
+	return &Duplicator{
+		imagePath: imagePath,
+		filter:    filter,
+		retry:     retry,
+		board:     board,
+		slots:     map[string]*Slot{},
+		jobs:      map[string]*MainData{},
+		pulled:    map[string]bool{},
+		quit:      make(chan struct{}),
+	}
+}
+
+// Start watches for drives being inserted and removed until Stop is called.
+// A card reader stays listed with no card in it, so a card going in or out
+// shows as the size of the reader changing from or to 0.
+func (duplicator *Duplicator) Start() {
+	known := map[string]int64{}
+	for _, disk := range GetDisks(false) {
+		known[disk.Path] = disk.Size
+	}
+
+	go func() {
+		for {
+			select {
+			case <-duplicator.quit:
+				return
+			case <-time.After(time.Second):
+				present := map[string]bool{}
+				for _, disk := range GetDisks(false) {
+					present[disk.Path] = true
+					size, ok := known[disk.Path]
+					known[disk.Path] = disk.Size
+					if disk.Size > 0 && (!ok || size == 0) {
+						duplicator.inserted(disk)
+					} else if disk.Size == 0 && size > 0 {
+						duplicator.removed(disk.Path)
+					}
+				}
+				for path := range known {
+					if !present[path] {
+						delete(known, path)
+						duplicator.removed(path)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops watching for drives and cancels the jobs still running.
+func (duplicator *Duplicator) Stop() {
+	close(duplicator.quit)
+
+	duplicator.mutex.Lock()
+	defer duplicator.mutex.Unlock()
+	duplicator.stopped = true
+	for path := range duplicator.jobs {
+		duplicator.cancel(path)
+	}
+}
+
+// Cancel stops the job running on the slot at path, which then counts as
+// failed.
+func (duplicator *Duplicator) Cancel(path string) {
+	duplicator.mutex.Lock()
+	defer duplicator.mutex.Unlock()
+	duplicator.cancel(path)
+}
+
+// cancel is Cancel with the lock held. A job is only asked once, since it is
+// taken off the jobs when it is.
+func (duplicator *Duplicator) cancel(path string) {
+	data, ok := duplicator.jobs[path]
+	if !ok {
+		return
+	}
+	delete(duplicator.jobs, path)
+	select {
+	case data.bQuitTask <- struct{}{}:
+	default:
+	}
+}
+
+// update changes a slot under the lock and hands a copy to the board.
+func (duplicator *Duplicator) update(path string, change func(slot *Slot)) {
+	duplicator.mutex.Lock()
+	slot, ok := duplicator.slots[path]
+	if !ok {
+		slot = &Slot{Path: path}
+		duplicator.slots[path] = slot
+	}
+	change(slot)
+	copied := *slot
+	duplicator.mutex.Unlock()
+
+	duplicator.board.UpdateSlot(copied)
+}
+
+func (duplicator *Duplicator) setSlot(path string, state SlotState, status string) {
+	duplicator.update(path, func(slot *Slot) {
+		slot.State = state
+		slot.Status = status
+	})
+}
+
+func (duplicator *Duplicator) inserted(disk Disk) {
+	if disk.System || disk.Size == 0 || duplicator.busy(disk.Path) {
+		return
+	}
+
+	identity, err := GetDiskIdentity(disk.Path)
+	if err != nil {
+		duplicator.setSlot(disk.Path, SLOT_IDLE, "Cannot identify the drive")
+		log.Printf("Duplicator: GetDiskIdentity failed for %s: %s", disk.Path, err)
+		return
+	}
+	if !duplicator.filter.Matches(identity) {
+		duplicator.setSlot(disk.Path, SLOT_IDLE, "Ignored: "+identity.String())
+		return
+	}
+
+	data := &MainData{
+		taskType:         START_WRITE,
+		selectedDrive:    disk.Path,
+		selectedDisk:     disk,
+		selectedIdentity: identity,
+		imagePath:        duplicator.imagePath,
+		padTail:          true,
+		retry:            duplicator.retry,
+		failOnRemoval:    true,
+	}
+	duplicator.update(disk.Path, func(slot *Slot) {
+		slot.State = SLOT_BUSY
+		slot.Status = "Writing..."
+		slot.Progress = 0
+	})
+	ui := &slotFrontend{duplicator: duplicator, path: disk.Path}
+	StartMainTask(data, ui)
+
+	// The job can be cancelled once StartMainTask has made its quit
+	// channel, unless it has already finished.
+	duplicator.mutex.Lock()
+	defer duplicator.mutex.Unlock()
+	if !ui.finished {
+		duplicator.jobs[disk.Path] = data
+		if duplicator.stopped {
+			duplicator.cancel(disk.Path)
+		}
+	}
+}
+
+// busy tells whether a job runs on the slot.
+func (duplicator *Duplicator) busy(path string) bool {
+	duplicator.mutex.Lock()
+	defer duplicator.mutex.Unlock()
+	slot, ok := duplicator.slots[path]
+	return ok && slot.State == SLOT_BUSY
+}
+
+// removed fails the job running on the slot, if any: the drive that comes
+// back is not necessarily the one that was pulled, and a half-written drive
+// must not pass.
+func (duplicator *Duplicator) removed(path string) {
+	duplicator.mutex.Lock()
+	_, ok := duplicator.slots[path]
+	if _, running := duplicator.jobs[path]; running {
+		duplicator.pulled[path] = true
+		duplicator.cancel(path)
+	}
+	duplicator.mutex.Unlock()
+
+	if ok && !duplicator.busy(path) {
+		duplicator.setSlot(path, SLOT_IDLE, "Insert a drive")
+	}
+}
+
+func (duplicator *Duplicator) finished(ui *slotFrontend, err error) {
+	path := ui.path
+	duplicator.mutex.Lock()
+	ui.finished = true
+	delete(duplicator.jobs, path)
+	if duplicator.pulled[path] {
+		delete(duplicator.pulled, path)
+		err = errors.New("the drive was removed")
+	}
+	if err == nil {
+		duplicator.passed++
+	} else {
+		duplicator.failed++
+	}
+	passed, failed := duplicator.passed, duplicator.failed
+	duplicator.mutex.Unlock()
+
+	if err == nil {
+		duplicator.setSlot(path, SLOT_PASSED, "PASS - remove the drive")
+	} else {
+		duplicator.setSlot(path, SLOT_FAILED, "FAIL - "+strings.ReplaceAll(err.Error(), "\n", " "))
+	}
+	duplicator.board.UpdateCounts(passed, failed)
+}
+
+// slotFrontend runs the job of one slot without anyone watching: any
+// question is answered with the safe choice.
+type slotFrontend struct {
+	duplicator *Duplicator
+	path       string
+	succeeded  bool
+	err        error
+	// finished is set under the lock of the duplicator.
+	finished bool
+}
+
+func (ui *slotFrontend) SetStatus(status string) {
+	ui.duplicator.update(ui.path, func(slot *Slot) { slot.Status = status })
+}
+
+func (ui *slotFrontend) SetSpeed(speed string) {}
+
+func (ui *slotFrontend) SetElapsed(elapsed string) {}
+
+func (ui *slotFrontend) SetProgress(done int64, total int64) {
+	ui.duplicator.update(ui.path, func(slot *Slot) {
+		slot.Progress = float64(done) / float64(max(total, 1))
+	})
+}
+
+func (ui *slotFrontend) ShowRescueMap(rescueMap *RescueMap) {}
+
+func (ui *slotFrontend) HandleError(data *MainData, err error) {
+	ui.err = err
+	log.Printf("Duplicator: %s failed: %s", ui.path, err)
+}
+
+func (ui *slotFrontend) HandleSuccess(message string) {
+	ui.succeeded = true
+}
+
+func (ui *slotFrontend) JobFinished(data MainData) {
+	err := ui.err
+	if err == nil && !ui.succeeded {
+		err = errors.New("the job was stopped")
+	}
+	ui.duplicator.finished(ui, err)
+}
+
+func (ui *slotFrontend) ConfirmSectorSizeMismatch(imageSector int, diskSector int, callback func(MismatchChoice)) {
+	ui.err = fmt.Errorf(
+		"the image was built for %d-byte sectors, the drive uses %d-byte sectors",
+		imageSector,
+		diskSector,
+	)
+	callback(MISMATCH_CANCEL)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+)
+
+// The builders below lay out an empty filesystem on a partition of numSectors
+// sectors. They return the structures as patches relative to the start of the
+// partition, and how many bytes from its start have to be cleared beneath
+// them.
+
+const (
+	fat32MinClusters = 65525
+	fat32MaxClusters = 0x0FFFFFF5
+	fatReserved      = 32
+)
+
+// fatLabel checks a FAT volume label and pads it to its 11 bytes. Lower case
+// letters are turned to upper case, as Windows does.
+func fatLabel(label string) ([11]byte, error) {
+	var padded [11]byte
+	copy(padded[:], "NO NAME    ")
+	if len(label) < 1 {
+		return padded, nil
+	}
+
+	label = strings.ToUpper(label)
+	if len(label) > 11 {
+		return padded, errors.New("A FAT32 label is at most 11 characters long.")
+	}
+	for _, r := range label {
+		if r < 0x20 || r > 0x7E || strings.ContainsRune("\"*+,./:;<=>?[\\]|", r) {
+			return padded, fmt.Errorf("A FAT32 label cannot contain %q.", r)
+		}
+	}
+	copy(padded[:], label+strings.Repeat(" ", 11-len(label)))
+	return padded, nil
+}
+
+// exfatLabel checks an exFAT volume label, which is up to 11 UTF-16 units.
+func exfatLabel(label string) ([]uint16, error) {
+	units := utf16.Encode([]rune(label))
+	if len(units) > 11 {
+		return nil, errors.New("An exFAT label is at most 11 characters long.")
+	}
+	for _, r := range label {
+		if r < 0x20 || strings.ContainsRune("\"*/:<>?\\|", r) {
+			return nil, fmt.Errorf("An exFAT label cannot contain %q.", r)
+		}
+	}
+	return units, nil
+}
+
+func volumeSerial() uint32 {
+	now := time.Now()
+	return uint32(now.Unix()) ^ uint32(now.Nanosecond())
+}
+
+// fat32ClusterSize follows the defaults of Windows, which stops at 32 GB
+// only because it refuses to format larger FAT32 volumes. Smaller clusters are
+// used where the volume would end up with too few of them to be FAT32.
+func fat32ClusterSize(size int64) int {
+	if size <= 8<<30 {
+		return 4096
+	} else if size <= 16<<30 {
+		return 8192
+	} else if size <= 32<<30 {
+		return 16384
+	}
+	return 32768
+}
+
+// fat32Layout works out the reserved area and FAT size that align the data
+// area to a cluster and leave room for the most clusters.
+func fat32Layout(numSectors int64, sectorsPerCluster int64, sectorSize int) (reserved int64, fatSectors int64, clusters int64) {
+	reserved = fatReserved
+	fatSectors = 1
+	for {
+		clusters = (numSectors - reserved - 2*fatSectors) / sectorsPerCluster
+		needed := ((clusters+2)*4 + int64(sectorSize) - 1) / int64(sectorSize)
+		if needed <= fatSectors {
+			break
+		}
+		fatSectors = needed
+	}
+	if rem := (reserved + 2*fatSectors) % sectorsPerCluster; rem != 0 {
+		reserved += sectorsPerCluster - rem
+	}
+	clusters = (numSectors - reserved - 2*fatSectors) / sectorsPerCluster
+	return reserved, fatSectors, clusters
+}
+
+func buildFAT32(numSectors int64, sectorSize int, partitionStart int64, label string) ([]Patch, int64, error) {
+	volumeLabel, err := fatLabel(label)
+	if err != nil {
+		return nil, 0, err
+	}
+	if numSectors > 0xFFFFFFFF {
+		return nil, 0, errors.New("The drive is too large for FAT32. Use exFAT instead.")
+	}
+
+	clusterSize := max(fat32ClusterSize(numSectors*int64(sectorSize)), sectorSize)
+	var reserved, fatSectors, clusters, sectorsPerCluster int64
+	for ; clusterSize >= sectorSize; clusterSize /= 2 {
+		sectorsPerCluster = int64(clusterSize / sectorSize)
+		reserved, fatSectors, clusters = fat32Layout(numSectors, sectorsPerCluster, sectorSize)
+		if clusters >= fat32MinClusters {
+			break
+		}
+	}
+	if clusters < fat32MinClusters {
+		return nil, 0, errors.New("The drive is too small for FAT32. Use exFAT instead.")
+	}
+	if clusters > fat32MaxClusters {
+		return nil, 0, errors.New("The drive is too large for FAT32. Use exFAT instead.")
+	}
+
+	boot := make([]byte, sectorSize)
+	copy(boot[0:], []byte{0xEB, 0x58, 0x90})
+	copy(boot[3:], "UTKIRNA ")
+	binary.LittleEndian.PutUint16(boot[11:], uint16(sectorSize))
+	boot[13] = byte(sectorsPerCluster)
+	binary.LittleEndian.PutUint16(boot[14:], uint16(reserved))
+	boot[16] = 2
+	boot[21] = 0xF8
+	binary.LittleEndian.PutUint16(boot[24:], 63)
+	binary.LittleEndian.PutUint16(boot[26:], 255)
+	binary.LittleEndian.PutUint32(boot[28:], uint32(min(partitionStart, 0xFFFFFFFF)))
+	binary.LittleEndian.PutUint32(boot[32:], uint32(numSectors))
+	binary.LittleEndian.PutUint32(boot[36:], uint32(fatSectors))
+	binary.LittleEndian.PutUint32(boot[44:], 2)
+	binary.LittleEndian.PutUint16(boot[48:], 1)
+	binary.LittleEndian.PutUint16(boot[50:], 6)
+	boot[64] = 0x80
+	boot[66] = 0x29
+	binary.LittleEndian.PutUint32(boot[67:], volumeSerial())
+	copy(boot[71:], volumeLabel[:])
+	copy(boot[82:], "FAT32   ")
+	boot[510], boot[511] = 0x55, 0xAA
+
+	fsInfo := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(fsInfo[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(fsInfo[484:], 0x61417272)
+	// The root directory takes the first cluster.
+	binary.LittleEndian.PutUint32(fsInfo[488:], uint32(clusters-1))
+	binary.LittleEndian.PutUint32(fsInfo[492:], 3)
+	binary.LittleEndian.PutUint32(fsInfo[508:], 0xAA550000)
+
+	fat := make([]byte, 12)
+	binary.LittleEndian.PutUint32(fat[0:], 0x0FFFFFF8)
+	binary.LittleEndian.PutUint32(fat[4:], 0x0FFFFFFF)
+	binary.LittleEndian.PutUint32(fat[8:], 0x0FFFFFFF)
+
+	dataStart := (reserved + 2*fatSectors) * int64(sectorSize)
+	ss := int64(sectorSize)
+	patches := []Patch{
+		{Offset: 0, Data: boot},
+		{Offset: ss, Data: fsInfo},
+		{Offset: 6 * ss, Data: boot},
+		{Offset: 7 * ss, Data: fsInfo},
+		{Offset: reserved * ss, Data: fat},
+		{Offset: (reserved + fatSectors) * ss, Data: fat},
+	}
+	if len(label) > 0 {
+		entry := make([]byte, 32)
+		copy(entry, volumeLabel[:])
+		entry[11] = 0x08
+		patches = append(patches, Patch{Offset: dataStart, Data: entry})
+	}
+	return patches, dataStart + sectorsPerCluster*ss, nil
+}
+
+// exfatClusterSize follows the defaults of Windows.
+func exfatClusterSize(size int64) int {
+	if size <= 256<<20 {
+		return 4096
+	} else if size <= 32<<30 {
+		return 32768
+	}
+	return 131072
+}
+
+// exfatChecksum is the rotating checksum exFAT uses for its boot region and
+// its up-case table. skip tells which bytes are left out.
+func exfatChecksum(data []byte, skip func(i int) bool) uint32 {
+	var checksum uint32
+	for i, b := range data {
+		if skip != nil && skip(i) {
+			continue
+		}
+		checksum = bits.RotateLeft32(checksum, -1) + uint32(b)
+	}
+	return checksum
+}
+
+// exfatUpcaseTable maps every character of the basic multilingual plane to
+// its upper case, in the compressed form where a run of characters that map
+// to themselves is stored as 0xFFFF and the length of the run.
+func exfatUpcaseTable() []byte {
+	table := []uint16{}
+	identity := 0
+	flush := func() {
+		if identity > 0 {
+			table = append(table, 0xFFFF, uint16(identity))
+			identity = 0
+		}
+	}
+	for c := 0; c < 0x10000; c++ {
+		upper := c
+		if c < 0xD800 || c > 0xDFFF {
+			if u := unicode.ToUpper(rune(c)); u < 0x10000 {
+				upper = int(u)
+			}
+		}
+		if upper == c {
+			identity++
+			continue
+		}
+		flush()
+		table = append(table, uint16(upper))
+	}
+	flush()
+
+	data := make([]byte, 2*len(table))
+	for i, unit := range table {
+		binary.LittleEndian.PutUint16(data[2*i:], unit)
+	}
+	return data
+}
+
+// exfatChain chains count clusters from first on in the FAT.
+func exfatChain(fat []byte, first uint32, count uint32) {
+	for cluster := first; cluster < first+count; cluster++ {
+		next := cluster + 1
+		if next == first+count {
+			next = 0xFFFFFFFF
+		}
+		binary.LittleEndian.PutUint32(fat[4*cluster:], next)
+	}
+}
+
+func buildExFAT(numSectors int64, sectorSize int, partitionStart int64, label string) ([]Patch, int64, error) {
+	labelUnits, err := exfatLabel(label)
+	if err != nil {
+		return nil, 0, err
+	}
+	ss := int64(sectorSize)
+	if numSectors*ss < 1<<20 {
+		return nil, 0, errors.New("The drive is too small for exFAT.")
+	}
+
+	clusterSize := int64(max(exfatClusterSize(numSectors*ss), sectorSize))
+	sectorsPerCluster := clusterSize / ss
+	fatOffset := (24 + sectorsPerCluster - 1) / sectorsPerCluster * sectorsPerCluster
+	fatLength := ((numSectors/sectorsPerCluster+2)*4 + ss - 1) / ss
+	heapOffset := (fatOffset + fatLength + sectorsPerCluster - 1) / sectorsPerCluster * sectorsPerCluster
+	clusters := (numSectors - heapOffset) / sectorsPerCluster
+	if clusters < 16 {
+		return nil, 0, errors.New("The drive is too small for exFAT.")
+	}
+	if clusters > 0xFFFFFFF5 {
+		return nil, 0, errors.New("The drive is too large for exFAT.")
+	}
+
+	upcase := exfatUpcaseTable()
+	bitmapClusters := ((clusters+7)/8 + clusterSize - 1) / clusterSize
+	upcaseClusters := (int64(len(upcase)) + clusterSize - 1) / clusterSize
+	bitmapFirst := int64(2)
+	upcaseFirst := bitmapFirst + bitmapClusters
+	rootFirst := upcaseFirst + upcaseClusters
+	used := bitmapClusters + upcaseClusters + 1
+
+	region := make([]byte, 12*ss)
+	boot := region[:ss]
+	copy(boot[0:], []byte{0xEB, 0x76, 0x90})
+	copy(boot[3:], "EXFAT   ")
+	binary.LittleEndian.PutUint64(boot[64:], uint64(partitionStart))
+	binary.LittleEndian.PutUint64(boot[72:], uint64(numSectors))
+	binary.LittleEndian.PutUint32(boot[80:], uint32(fatOffset))
+	binary.LittleEndian.PutUint32(boot[84:], uint32(fatLength))
+	binary.LittleEndian.PutUint32(boot[88:], uint32(heapOffset))
+	binary.LittleEndian.PutUint32(boot[92:], uint32(clusters))
+	binary.LittleEndian.PutUint32(boot[96:], uint32(rootFirst))
+	binary.LittleEndian.PutUint32(boot[100:], volumeSerial())
+	binary.LittleEndian.PutUint16(boot[104:], 0x0100)
+	boot[108] = byte(bits.TrailingZeros64(uint64(ss)))
+	boot[109] = byte(bits.TrailingZeros64(uint64(sectorsPerCluster)))
+	boot[110] = 1
+	boot[111] = 0x80
+	boot[510], boot[511] = 0x55, 0xAA
+	for sector := int64(1); sector <= 8; sector++ {
+		binary.LittleEndian.PutUint32(region[(sector+1)*ss-4:], 0xAA550000)
+	}
+	// VolumeFlags and PercentInUse change while the volume is used and are
+	// left out of the checksum.
+	checksum := exfatChecksum(region[:11*ss], func(i int) bool {
+		return i == 106 || i == 107 || i == 112
+	})
+	for i := 11 * ss; i < 12*ss; i += 4 {
+		binary.LittleEndian.PutUint32(region[i:], checksum)
+	}
+
+	fat := make([]byte, 4*(2+used))
+	binary.LittleEndian.PutUint32(fat[0:], 0xFFFFFFF8)
+	binary.LittleEndian.PutUint32(fat[4:], 0xFFFFFFFF)
+	exfatChain(fat, uint32(bitmapFirst), uint32(bitmapClusters))
+	exfatChain(fat, uint32(upcaseFirst), uint32(upcaseClusters))
+	exfatChain(fat, uint32(rootFirst), 1)
+
+	bitmap := make([]byte, (used+7)/8)
+	for cluster := int64(0); cluster < used; cluster++ {
+		bitmap[cluster/8] |= 1 << (cluster % 8)
+	}
+
+	root := make([]byte, 3*32)
+	entries := root
+	if len(labelUnits) > 0 {
+		entries[0] = 0x83
+		entries[1] = byte(len(labelUnits))
+		for i, unit := range labelUnits {
+			binary.LittleEndian.PutUint16(entries[2+2*i:], unit)
+		}
+		entries = entries[32:]
+	} else {
+		root = root[:2*32]
+	}
+	entries[0] = 0x81
+	binary.LittleEndian.PutUint32(entries[20:], uint32(bitmapFirst))
+	binary.LittleEndian.PutUint64(entries[24:], uint64((clusters+7)/8))
+	entries = entries[32:]
+	entries[0] = 0x82
+	binary.LittleEndian.PutUint32(entries[4:], exfatChecksum(upcase, nil))
+	binary.LittleEndian.PutUint32(entries[20:], uint32(upcaseFirst))
+	binary.LittleEndian.PutUint64(entries[24:], uint64(len(upcase)))
+
+	heap := heapOffset * ss
+	clusterOffset := func(cluster int64) int64 {
+		return heap + (cluster-2)*clusterSize
+	}
+	patches := []Patch{
+		{Offset: 0, Data: region},
+		{Offset: 12 * ss, Data: region},
+		{Offset: fatOffset * ss, Data: fat},
+		{Offset: clusterOffset(bitmapFirst), Data: bitmap},
+		{Offset: clusterOffset(upcaseFirst), Data: upcase},
+		{Offset: clusterOffset(rootFirst), Data: root},
+	}
+	return patches, clusterOffset(rootFirst + 1), nil
+}
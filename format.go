@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+type FileSystem int
+
+const (
+	FS_FAT32 FileSystem = iota
+	FS_EXFAT
+)
+
+var fileSystemNames = []string{"FAT32", "exFAT"}
+
+func (fileSystem FileSystem) String() string {
+	return fileSystemNames[fileSystem]
+}
+
+func ParseFileSystem(name string) (FileSystem, error) {
+	for i, fileSystemName := range fileSystemNames {
+		if strings.EqualFold(fileSystemName, name) {
+			return FileSystem(i), nil
+		}
+	}
+	return FS_FAT32, fmt.Errorf("unknown filesystem %q", name)
+}
+
+func ParseTableType(name string) (TableType, error) {
+	switch strings.ToLower(name) {
+	case "mbr":
+		return TABLE_MBR, nil
+	case "gpt":
+		return TABLE_GPT, nil
+	}
+	return TABLE_NONE, fmt.Errorf("unknown partition table %q", name)
+}
+
+// FormatOptions is what a drive is restored to: a partition table with a
+// single partition that spans the drive and holds an empty filesystem.
+type FormatOptions struct {
+	Table      TableType
+	FileSystem FileSystem
+	Label      string
+}
+
+// CheckLabel tells whether label can be the volume label of the filesystem.
+func (options FormatOptions) CheckLabel() error {
+	if options.FileSystem == FS_EXFAT {
+		_, err := exfatLabel(options.Label)
+		return err
+	}
+	_, err := fatLabel(options.Label)
+	return err
+}
+
+// Extent is a range of bytes of a drive.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// FormatPlan is what formatting a drive writes: every extent is cleared,
+// with the patches laid over it. Everything else is left as it is.
+type FormatPlan struct {
+	Clear            []Extent
+	Patches          []Patch
+	PartitionStart   int64
+	PartitionSectors int64
+}
+
+// Size is the number of bytes the plan writes.
+func (plan *FormatPlan) Size() int64 {
+	size := int64(0)
+	for _, extent := range plan.Clear {
+		size += extent.Length
+	}
+	return size
+}
+
+// partitionAlignment is where the partition starts, and what its size is
+// rounded down to, as partitioning tools do nowadays.
+const partitionAlignment = 1 << 20
+
+const (
+	gptEntryCount     = 128
+	gptEntrySize      = 128
+	basicDataTypeGUID = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+)
+
+// guidBytes is the inverse of guidString.
+func guidBytes(guid string) []byte {
+	raw, _ := hex.DecodeString(strings.ReplaceAll(guid, "-", ""))
+	binary.LittleEndian.PutUint32(raw[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(raw[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(raw[6:], binary.BigEndian.Uint16(raw[6:]))
+	return raw
+}
+
+// newGUID returns a random version 4 GUID in the byte order of a GPT.
+func newGUID() ([16]byte, error) {
+	var guid [16]byte
+	_, err := rand.Read(guid[:])
+	guid[7] = guid[7]&0x0F | 0x40
+	guid[8] = guid[8]&0x3F | 0x80
+	return guid, err
+}
+
+func newMBR(numSectors int64, partitionStart int64, partitionSectors int64, fileSystem FileSystem) ([]byte, error) {
+	if numSectors > 0xFFFFFFFF {
+		return nil, errors.New("The drive is too large for an MBR. Use GPT instead.")
+	}
+
+	mbr := make([]byte, 512)
+	_, err := rand.Read(mbr[0x1B8:0x1BC])
+	if err != nil {
+		return nil, errors.Join(errors.New("newMBR(): Read failed"), err)
+	}
+	partType := byte(0x0C)
+	if fileSystem == FS_EXFAT {
+		partType = 0x07
+	}
+	putMBREntry(mbr[0x1BE:], partType, partitionStart, partitionSectors, false)
+	mbr[510], mbr[511] = 0x55, 0xAA
+	return mbr, nil
+}
+
+func putMBREntry(entry []byte, partType byte, start int64, numSectors int64, bootable bool) {
+	if bootable {
+		entry[0] = 0x80
+	}
+	// Only the LBA fields are used; the CHS fields say so.
+	copy(entry[1:4], []byte{0xFE, 0xFF, 0xFF})
+	entry[4] = partType
+	copy(entry[5:8], []byte{0xFE, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(entry[8:], uint32(start))
+	binary.LittleEndian.PutUint32(entry[12:], uint32(numSectors))
+}
+
+// newGPT returns the protective MBR, the primary and backup headers and the
+// entry array of a GPT with a single basic data partition.
+func newGPT(numSectors int64, sectorSize int, partitionStart int64, partitionSectors int64, name string) ([]Patch, error) {
+	entries := make([]byte, gptEntryCount*gptEntrySize)
+	err := putGPTEntry(entries, basicDataTypeGUID, partitionStart, partitionSectors, name, 0)
+	if err != nil {
+		return nil, errors.Join(errors.New("newGPT(): putGPTEntry failed"), err)
+	}
+	return newGPTStructures(numSectors, sectorSize, entries)
+}
+
+// putGPTEntry fills a GPT partition entry, with a new unique GUID.
+func putGPTEntry(entry []byte, typeGUID string, start int64, numSectors int64, name string, attributes uint64) error {
+	partitionGUID, err := newGUID()
+	if err != nil {
+		return err
+	}
+	copy(entry[0:], guidBytes(typeGUID))
+	copy(entry[16:], partitionGUID[:])
+	binary.LittleEndian.PutUint64(entry[32:], uint64(start))
+	binary.LittleEndian.PutUint64(entry[40:], uint64(start+numSectors-1))
+	binary.LittleEndian.PutUint64(entry[48:], attributes)
+	for i, unit := range utf16.Encode([]rune(name)) {
+		if i >= 36 {
+			break
+		}
+		binary.LittleEndian.PutUint16(entry[56+2*i:], unit)
+	}
+	return nil
+}
+
+// newGPTStructures returns the protective MBR, the primary and backup
+// headers and the copies of the entry array of a GPT.
+func newGPTStructures(numSectors int64, sectorSize int, entries []byte) ([]Patch, error) {
+	ss := int64(sectorSize)
+	entriesSectors := int64(gptEntryCount*gptEntrySize) / ss
+
+	diskGUID, err := newGUID()
+	if err != nil {
+		return nil, errors.Join(errors.New("newGPTStructures(): newGUID failed"), err)
+	}
+
+	header := gptHeader{
+		Revision:       0x00010000,
+		HeaderSize:     gptHeaderSize,
+		FirstUsableLBA: uint64(2 + entriesSectors),
+		LastUsableLBA:  uint64(numSectors - 2 - entriesSectors),
+		DiskGUID:       diskGUID,
+		NumEntries:     gptEntryCount,
+		EntrySize:      gptEntrySize,
+		EntriesCRC32:   crc32.ChecksumIEEE(entries),
+	}
+	copy(header.Signature[:], gptSignature)
+
+	primary := header
+	primary.MyLBA = 1
+	primary.AlternateLBA = uint64(numSectors - 1)
+	primary.EntriesLBA = 2
+
+	backup := header
+	backup.MyLBA = uint64(numSectors - 1)
+	backup.AlternateLBA = 1
+	backup.EntriesLBA = uint64(numSectors - 1 - entriesSectors)
+
+	pmbr := make([]byte, 512)
+	entry := pmbr[0x1BE:]
+	copy(entry[1:4], []byte{0x00, 0x02, 0x00})
+	entry[4] = 0xEE
+	copy(entry[5:8], []byte{0xFF, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(entry[8:], 1)
+	binary.LittleEndian.PutUint32(entry[12:], uint32(min(numSectors-1, 0xFFFFFFFF)))
+	pmbr[510], pmbr[511] = 0x55, 0xAA
+
+	return []Patch{
+		{Offset: 0, Data: pmbr},
+		{Offset: ss, Data: primary.marshal()},
+		{Offset: 2 * ss, Data: entries},
+		{Offset: int64(backup.EntriesLBA) * ss, Data: entries},
+		{Offset: int64(backup.MyLBA) * ss, Data: backup.marshal()},
+	}, nil
+}
+
+// BuildFormatPlan lays out a drive of numSectors sectors as options asks.
+// Besides the new structures, the space before the partition and after it is
+// cleared, so that no trace of an old partition table is left.
+func BuildFormatPlan(numSectors int64, sectorSize int, options FormatOptions) (*FormatPlan, error) {
+	if sectorSize < 512 || sectorSize > 4096 || sectorSize&(sectorSize-1) != 0 {
+		return nil, fmt.Errorf("BuildFormatPlan(): %d-byte sectors are not supported", sectorSize)
+	}
+	ss := int64(sectorSize)
+	alignSectors := int64(partitionAlignment) / ss
+
+	plan := &FormatPlan{PartitionStart: alignSectors}
+	end := numSectors
+	if options.Table == TABLE_GPT {
+		end = numSectors - 1 - int64(gptEntryCount*gptEntrySize)/ss
+	}
+	end = end / alignSectors * alignSectors
+	plan.PartitionSectors = end - plan.PartitionStart
+	if plan.PartitionSectors < alignSectors {
+		return nil, errors.New("The drive is too small to be formatted.")
+	}
+
+	var fileSystem []Patch
+	var fileSystemSize int64
+	var err error
+	if options.FileSystem == FS_EXFAT {
+		fileSystem, fileSystemSize, err = buildExFAT(plan.PartitionSectors, sectorSize, plan.PartitionStart, options.Label)
+	} else {
+		fileSystem, fileSystemSize, err = buildFAT32(plan.PartitionSectors, sectorSize, plan.PartitionStart, options.Label)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Table == TABLE_GPT {
+		name := options.Label
+		if len(name) < 1 {
+			name = "Basic data partition"
+		}
+		plan.Patches, err = newGPT(numSectors, sectorSize, plan.PartitionStart, plan.PartitionSectors, name)
+	} else {
+		var mbr []byte
+		mbr, err = newMBR(numSectors, plan.PartitionStart, plan.PartitionSectors, options.FileSystem)
+		plan.Patches = []Patch{{Offset: 0, Data: mbr}}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, patch := range fileSystem {
+		patch.Offset += plan.PartitionStart * ss
+		plan.Patches = append(plan.Patches, patch)
+	}
+	plan.Clear = []Extent{
+		{Offset: 0, Length: plan.PartitionStart*ss + fileSystemSize},
+		{Offset: end * ss, Length: (numSectors - end) * ss},
+	}
+	return plan, nil
+}
+
+// formatChunks calls step with every chunk of the extents of plan, filled
+// with what belongs there, and keeps the progress up to date.
+func formatChunks(
+	data *MainData,
+	ui Frontend,
+	layout diskGeometry,
+	plan *FormatPlan,
+	step func(expected []byte, sector int64) error,
+) error {
+	buf := layout.pool.Get()
+	defer layout.pool.Put(buf)
+	ss := int64(layout.sectorSize)
+	total := plan.Size() / ss
+	done := int64(0)
+	lastDone := int64(0)
+	updateTimer := time.Now()
+
+	ui.SetProgress(0, total)
+	for _, extent := range plan.Clear {
+		first := extent.Offset / ss
+		numSectors := extent.Length / ss
+		for i := int64(0); i < numSectors; i += 1024 {
+			select {
+			case <-data.bQuitTask:
+				return errCancelled
+			default:
+				chunk := buf[:chunkSectors(i, numSectors)*ss]
+				clear(chunk)
+				applyPatches(chunk, (first+i)*ss, plan.Patches)
+				err := step(chunk, first+i)
+				if err != nil {
+					return err
+				}
+
+				done += int64(len(chunk)) / ss
+				ui.SetProgress(done, total)
+				if updateSpeed(ui, layout.sectorSize, done-lastDone, updateTimer) {
+					lastDone = done
+					updateTimer = time.Now()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// FormatDisk gives the selected drive a new partition table and an empty
+// filesystem, and reads everything it wrote back.
+func FormatDisk(data *MainData, ui Frontend, handles Handles) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	layout, err := getDiskGeometry(handles)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("FormatDisk(): getDiskGeometry failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+	plan, err := BuildFormatPlan(layout.numSectors, layout.sectorSize, data.format)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("FormatDisk(): BuildFormatPlan failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+
+	go func() {
+		defer func() { cleanUp(data, ui, handles) }()
+
+		ui.SetStatus("Formatting...")
+		err := formatChunks(data, ui, layout, plan, func(expected []byte, sector int64) error {
+			err := writeDiskChunk(data, handles, expected, sector, layout.sectorSize, layout.alignment)
+			if err != nil {
+				return errors.Join(errors.New("FormatDisk(): writeDiskChunk failed"), err)
+			}
+			return nil
+		})
+		if err == nil {
+			err = SyncDisk(handles)
+		}
+		if err == nil {
+			err = FlushDiskCache(handles)
+		}
+		if err != nil {
+			if !errors.Is(err, errCancelled) {
+				ui.HandleError(data, err)
+			}
+			return
+		}
+
+		ui.SetStatus("Verifying (" + DiskIOMode(handles) + ")...")
+		diskData := layout.pool.Get()
+		defer layout.pool.Put(diskData)
+		err = formatChunks(data, ui, layout, plan, func(expected []byte, sector int64) error {
+			diskChunk := diskData[:len(expected)]
+			err := readDiskChunk(data, handles, diskChunk, sector, layout.sectorSize, layout.alignment)
+			if err != nil {
+				return errors.Join(errors.New("FormatDisk(): readDiskChunk failed"), err)
+			}
+			if !bytes.Equal(diskChunk, expected) {
+				return fmt.Errorf("Verification failed at sector: %d", sector)
+			}
+			return nil
+		})
+		if err != nil {
+			if !errors.Is(err, errCancelled) {
+				ui.HandleError(data, err)
+			}
+			return
+		}
+
+		tableName := "MBR"
+		if data.format.Table == TABLE_GPT {
+			tableName = "GPT"
+		}
+		data.report.AddNote(
+			"Formatted: %s, %s partition of %d sectors at sector %d",
+			tableName,
+			data.format.FileSystem,
+			plan.PartitionSectors,
+			plan.PartitionStart,
+		)
+		ui.HandleSuccess(fmt.Sprintf(
+			"The drive now holds a %s partition table and an empty %s filesystem.",
+			tableName,
+			data.format.FileSystem,
+		))
+	}()
+}
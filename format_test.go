@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// formatDevice writes plan the way FormatDisk does to a sparse file of
+// numSectors sectors, and returns the file.
+func formatDevice(t *testing.T, plan *FormatPlan, numSectors int64, sectorSize int) *os.File {
+	t.Helper()
+	device, err := os.Create(filepath.Join(t.TempDir(), "device"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { device.Close() })
+	err = device.Truncate(numSectors * int64(sectorSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const chunkSize = 1 << 20
+	for _, extent := range plan.Clear {
+		end := extent.Offset + extent.Length
+		for offset := extent.Offset; offset < end; offset += chunkSize {
+			chunk := make([]byte, min(chunkSize, end-offset))
+			applyPatches(chunk, offset, plan.Patches)
+			_, err = device.WriteAt(chunk, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return device
+}
+
+func readAt(t *testing.T, device *os.File, offset int64, length int) []byte {
+	t.Helper()
+	buf := make([]byte, length)
+	_, err := device.ReadAt(buf, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func hasBootSignature(sector []byte) bool {
+	return sector[510] == 0x55 && sector[511] == 0xAA
+}
+
+// testChecksum is the exFAT checksum as the specification writes it out.
+func testChecksum(data []byte, skip ...int) uint32 {
+	var checksum uint32
+	for i, b := range data {
+		skipped := false
+		for _, s := range skip {
+			skipped = skipped || s == i
+		}
+		if skipped {
+			continue
+		}
+		if checksum&1 != 0 {
+			checksum = 0x80000000 + checksum>>1 + uint32(b)
+		} else {
+			checksum = checksum>>1 + uint32(b)
+		}
+	}
+	return checksum
+}
+
+func expectMBR(t *testing.T, device *os.File, plan *FormatPlan, fileSystem FileSystem) {
+	mbr := readAt(t, device, 0, 512)
+	if !hasBootSignature(mbr) {
+		t.Fatal("the MBR has no boot signature")
+	}
+	partType := byte(0x0C)
+	if fileSystem == FS_EXFAT {
+		partType = 0x07
+	}
+	entry := mbr[0x1BE:]
+	if entry[4] != partType ||
+		int64(binary.LittleEndian.Uint32(entry[8:])) != plan.PartitionStart ||
+		int64(binary.LittleEndian.Uint32(entry[12:])) != plan.PartitionSectors {
+		t.Fatalf("wrong MBR entry % x", entry[:16])
+	}
+}
+
+// expectGPTHeader checks the header at lba and the CRCs of it and of its
+// entries, and returns the entries.
+func expectGPTHeader(t *testing.T, device *os.File, lba int64, sectorSize int) []byte {
+	header := readAt(t, device, lba*int64(sectorSize), sectorSize)
+	if string(header[:8]) != "EFI PART" {
+		t.Fatalf("no GPT header at LBA %d", lba)
+	}
+	if int64(binary.LittleEndian.Uint64(header[24:])) != lba {
+		t.Fatalf("the GPT header at LBA %d points to itself as LBA %d", lba, binary.LittleEndian.Uint64(header[24:]))
+	}
+	headerSize := binary.LittleEndian.Uint32(header[12:])
+	crc := binary.LittleEndian.Uint32(header[16:])
+	binary.LittleEndian.PutUint32(header[16:], 0)
+	if crc32.ChecksumIEEE(header[:headerSize]) != crc {
+		t.Fatalf("wrong CRC of the GPT header at LBA %d", lba)
+	}
+
+	entriesLBA := int64(binary.LittleEndian.Uint64(header[72:]))
+	numEntries := binary.LittleEndian.Uint32(header[80:])
+	entrySize := binary.LittleEndian.Uint32(header[84:])
+	entries := readAt(t, device, entriesLBA*int64(sectorSize), int(numEntries*entrySize))
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:]) {
+		t.Fatalf("wrong CRC of the GPT entries of the header at LBA %d", lba)
+	}
+	return entries
+}
+
+func expectGPT(t *testing.T, device *os.File, plan *FormatPlan, numSectors int64, sectorSize int) {
+	if !hasBootSignature(readAt(t, device, 0, 512)) {
+		t.Fatal("the protective MBR has no boot signature")
+	}
+	primary := expectGPTHeader(t, device, 1, sectorSize)
+	backup := expectGPTHeader(t, device, numSectors-1, sectorSize)
+	if !bytes.Equal(primary, backup) {
+		t.Fatal("the backup GPT entries differ")
+	}
+	if !bytes.Equal(primary[:16], guidBytes(basicDataTypeGUID)) ||
+		int64(binary.LittleEndian.Uint64(primary[32:])) != plan.PartitionStart ||
+		int64(binary.LittleEndian.Uint64(primary[40:])) != plan.PartitionStart+plan.PartitionSectors-1 {
+		t.Fatalf("wrong GPT entry % x", primary[:48])
+	}
+}
+
+func expectFAT32(t *testing.T, device *os.File, plan *FormatPlan, sectorSize int) {
+	ss := int64(sectorSize)
+	start := plan.PartitionStart * ss
+	boot := readAt(t, device, start, sectorSize)
+	if !hasBootSignature(boot) || string(boot[82:90]) != "FAT32   " {
+		t.Fatal("no FAT32 boot sector")
+	}
+	if int(binary.LittleEndian.Uint16(boot[11:])) != sectorSize ||
+		int64(binary.LittleEndian.Uint32(boot[32:])) != plan.PartitionSectors {
+		t.Fatal("the boot sector does not match the partition")
+	}
+	if !bytes.Equal(readAt(t, device, start+6*ss, sectorSize), boot) {
+		t.Fatal("the backup boot sector differs")
+	}
+
+	fsInfo := readAt(t, device, start+ss, sectorSize)
+	if binary.LittleEndian.Uint32(fsInfo[0:]) != 0x41615252 ||
+		binary.LittleEndian.Uint32(fsInfo[484:]) != 0x61417272 ||
+		binary.LittleEndian.Uint32(fsInfo[508:]) != 0xAA550000 {
+		t.Fatal("no FSInfo sector")
+	}
+	if !bytes.Equal(readAt(t, device, start+7*ss, sectorSize), fsInfo) {
+		t.Fatal("the backup FSInfo sector differs")
+	}
+
+	reserved := int64(binary.LittleEndian.Uint16(boot[14:]))
+	fat := readAt(t, device, start+reserved*ss, 12)
+	if binary.LittleEndian.Uint32(fat[8:]) != 0x0FFFFFFF {
+		t.Fatal("the root directory is not the end of its cluster chain")
+	}
+}
+
+func expectExFAT(t *testing.T, device *os.File, plan *FormatPlan, sectorSize int) {
+	ss := int64(sectorSize)
+	start := plan.PartitionStart * ss
+	region := readAt(t, device, start, 12*sectorSize)
+	boot := region[:ss]
+	if !hasBootSignature(boot) || string(boot[3:11]) != "EXFAT   " {
+		t.Fatal("no exFAT boot sector")
+	}
+	if int64(binary.LittleEndian.Uint64(boot[72:])) != plan.PartitionSectors || 1<<boot[108] != sectorSize {
+		t.Fatal("the boot sector does not match the partition")
+	}
+	checksum := testChecksum(region[:11*ss], 106, 107, 112)
+	for i := 11 * ss; i < 12*ss; i += 4 {
+		if binary.LittleEndian.Uint32(region[i:]) != checksum {
+			t.Fatalf("wrong boot checksum at byte %d of sector 11", i-11*ss)
+		}
+	}
+	if !bytes.Equal(readAt(t, device, start+12*ss, 12*sectorSize), region) {
+		t.Fatal("the backup boot region differs")
+	}
+
+	heap := start + int64(binary.LittleEndian.Uint32(boot[88:]))*ss
+	clusterSize := ss << boot[109]
+	clusterOffset := func(cluster uint32) int64 {
+		return heap + int64(cluster-2)*clusterSize
+	}
+	root := readAt(t, device, clusterOffset(binary.LittleEndian.Uint32(boot[96:])), int(clusterSize))
+	for i := 0; i < len(root) && root[i] != 0; i += 32 {
+		entry := root[i : i+32]
+		if entry[0] != 0x82 {
+			continue
+		}
+		upcase := readAt(
+			t,
+			device,
+			clusterOffset(binary.LittleEndian.Uint32(entry[20:])),
+			int(binary.LittleEndian.Uint64(entry[24:])),
+		)
+		if testChecksum(upcase) != binary.LittleEndian.Uint32(entry[4:]) {
+			t.Fatal("wrong checksum of the up-case table")
+		}
+		return
+	}
+	t.Fatal("the root directory has no up-case table entry")
+}
+
+func TestBuildFormatPlan(t *testing.T) {
+	tests := []struct {
+		size       int64
+		sectorSize int
+	}{
+		{512 << 20, 512},
+		{512 << 20, 4096},
+	}
+	for _, test := range tests {
+		for _, table := range []TableType{TABLE_MBR, TABLE_GPT} {
+			for _, fileSystem := range []FileSystem{FS_FAT32, FS_EXFAT} {
+				tableName := "MBR"
+				if table == TABLE_GPT {
+					tableName = "GPT"
+				}
+				name := fmt.Sprintf("%s %s %d", tableName, fileSystem, test.sectorSize)
+				t.Run(name, func(t *testing.T) {
+					numSectors := test.size / int64(test.sectorSize)
+					plan, err := BuildFormatPlan(numSectors, test.sectorSize, FormatOptions{
+						Table:      table,
+						FileSystem: fileSystem,
+						Label:      "UTKIRNA",
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					device := formatDevice(t, plan, numSectors, test.sectorSize)
+
+					if table == TABLE_GPT {
+						expectGPT(t, device, plan, numSectors, test.sectorSize)
+					} else {
+						expectMBR(t, device, plan, fileSystem)
+					}
+					if fileSystem == FS_EXFAT {
+						expectExFAT(t, device, plan, test.sectorSize)
+					} else {
+						expectFAT32(t, device, plan, test.sectorSize)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestBuildFormatPlanLargeFAT32 formats a FAT32 volume larger than the
+// 32 GiB Windows stops at, on a sparse file.
+func TestBuildFormatPlanLargeFAT32(t *testing.T) {
+	numSectors := int64(40<<30) / 512
+	plan, err := BuildFormatPlan(numSectors, 512, FormatOptions{Table: TABLE_MBR, FileSystem: FS_FAT32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := formatDevice(t, plan, numSectors, 512)
+	expectMBR(t, device, plan, FS_FAT32)
+	expectFAT32(t, device, plan, 512)
+	if boot := readAt(t, device, plan.PartitionStart*512, 512); boot[13] != 64 {
+		t.Fatalf("%d sectors per cluster, want 64", boot[13])
+	}
+}
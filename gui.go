@@ -1,8 +1,19 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
+	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
@@ -11,33 +22,101 @@ import (
 	"fyne.io/fyne/v2/widget"
 )
 
+type MismatchChoice int
+
+const (
+	MISMATCH_CANCEL MismatchChoice = iota
+	MISMATCH_AS_IS
+	MISMATCH_TRANSLATE
+)
+
 type MainData struct {
 	taskType      TaskType
 	selectedDrive string
-	imagePath     string
+	selectedDisk  Disk
+	// selectedIdentity is resolved when the drive is selected and checked
+	// again right before the job opens it.
+	selectedIdentity DiskIdentity
+	imagePath        string
+	// partition confines writing, reading and verifying to one partition of
+	// the drive. Its Index is 0 for the whole drive.
+	partition Partition
+	// rawRange writes or verifies a part of the image at an offset of the
+	// drive.
+	rawRange RawRange
+	// board is the profile a board job writes the bootloader of, with the
+	// file picked for each of the files it names.
+	board      BoardProfile
+	boardFiles map[string]string
+	// composeLayout is the layout file a compose job builds the disk from.
+	composeLayout string
+	mbrCheck      bool
+	ignoreSize    bool
+	padTail       bool
+	// clearTail discards or zero-fills the drive after the image.
+	clearTail bool
+	// skipZeros skips the chunks of an image that are all zeros, after
+	// having the drive discard or zero itself. assumeBlank takes the drive
+	// to hold zeros already instead.
+	skipZeros   bool
+	assumeBlank bool
+	// snapshot saves what a write overwrites first, snapshotPath is the
+	// snapshot a restore puts back.
+	snapshot     bool
+	snapshotPath string
+	// deltaWrite reads every chunk of the drive first and writes only the
+	// chunks that differ from the image.
+	deltaWrite bool
+	rescue     bool
+	// verify tells whether a clone or a wipe is read back afterwards;
+	// writes always are.
+	verify     bool
+	wipeMethod WipeMethod
+	format     FormatOptions
+	// sourceDisk is the drive a clone is copied from. imagePath then is
+	// the path its data is read through.
+	sourceDisk     Disk
+	sourceIdentity DiskIdentity
+	retry          RetryPolicy
+	// report collects the retries and statistics of the running job.
+	report *JobReport
+	// resume is the journal of the interrupted job being resumed.
+	resume *Journal
+	// failOnRemoval fails the job when the drive goes away instead of
+	// waiting for it to come back.
+	failOnRemoval bool
 	bQuitTimer    chan struct{}
-	bQuitTask     chan struct{}
+	// bQuitTask holds a request to cancel the running job until the job
+	// gets to it.
+	bQuitTask chan struct{}
 }
 
 type GUI struct {
-	cancelButton, readButton, writeButton, exitButton, openButton, reloadButton, verifyButton, saveButton *widget.Button
-	selectDrive                                                                                           *widget.Select
-	openPath, savePath                                                                                    *widget.Entry
-	statusLabel, elapsedLabel, speedLabel                                                                 *widget.Label
-	rwProgressBar                                                                                         *widget.ProgressBar
-	window                                                                                                fyne.Window
-	mbrCheck, ignoreSize                                                                                  *widget.Check
-	guiTabs                                                                                               *container.AppTabs
+	cancelButton, readButton, writeButton, exitButton, openButton, reloadButton, verifyButton, saveButton, resumeButton, undoButton, cloneButton, multiButton, wipeButton, formatButton, tableBrowseButton, tableSaveButton, tableRestoreButton, boardButton, composeBrowseButton, composeOutputButton, composeWriteButton, composeSaveButton *widget.Button
+	selectDrive, selectPartition, cloneSource, wipeMethod, formatTable, formatFS, boardProfile                                                                                                                                                                                                                                                *widget.Select
+	openPath, savePath, dupMinSize, dupMaxSize, dupVendor, formatLabel, tablePath, rawSkip, rawSeek, rawCount, composeLayout, composeOutput                                                                                                                                                                                                   *widget.Entry
+	statusLabel, elapsedLabel, speedLabel                                                                                                                                                                                                                                                                                                     *widget.Label
+	rwProgressBar                                                                                                                                                                                                                                                                                                                             *widget.ProgressBar
+	lockIcon                                                                                                                                                                                                                                                                                                                                  *widget.Icon
+	window                                                                                                                                                                                                                                                                                                                                    fyne.Window
+	mbrCheck, ignoreSize, padTail, clearTail, skipZeros, assumeBlank, deltaWrite, snapshot, showAllDisks, rescueMode, cloneAllocated, cloneVerify, wipeVerify                                                                                                                                                                                 *widget.Check
+	rescueMap                                                                                                                                                                                                                                                                                                                                 *rescueMapView
+	targetRows                                                                                                                                                                                                                                                                                                                                *multiTargetRows
+	// boardFiles and boardBrowse are the rows of the files the selected
+	// board profile needs.
+	boardFiles  []*widget.Entry
+	boardBrowse []*widget.Button
+	guiTabs     *container.AppTabs
 }
 
 func DisableCancelButton(widgets GUI, data MainData) {
-	if data.taskType == START_WRITE || data.taskType == START_VERIFY {
-		widgets.guiTabs.EnableIndex(1)
-	} else if data.taskType == START_READ {
-		widgets.guiTabs.EnableIndex(0)
+	for i := range widgets.guiTabs.Items {
+		widgets.guiTabs.EnableIndex(i)
 	}
 
 	widgets.selectDrive.Enable()
+	widgets.selectPartition.Enable()
+	widgets.cloneSource.Enable()
 	widgets.reloadButton.Enable()
 	widgets.openPath.Enable()
 	widgets.savePath.Enable()
@@ -47,8 +126,48 @@ func DisableCancelButton(widgets GUI, data MainData) {
 	widgets.writeButton.Enable()
 	widgets.saveButton.Enable()
 	widgets.verifyButton.Enable()
+	widgets.cloneButton.Enable()
+	widgets.multiButton.Enable()
+	widgets.resumeButton.Enable()
+	widgets.undoButton.Enable()
 	widgets.mbrCheck.Enable()
+	widgets.rescueMode.Enable()
+	widgets.showAllDisks.Enable()
 	widgets.ignoreSize.Enable()
+	widgets.padTail.Enable()
+	widgets.clearTail.Enable()
+	widgets.skipZeros.Enable()
+	widgets.assumeBlank.Enable()
+	widgets.deltaWrite.Enable()
+	widgets.snapshot.Enable()
+	widgets.rawSkip.Enable()
+	widgets.rawSeek.Enable()
+	widgets.rawCount.Enable()
+	widgets.cloneAllocated.Enable()
+	widgets.cloneVerify.Enable()
+	widgets.wipeButton.Enable()
+	widgets.wipeMethod.Enable()
+	widgets.wipeVerify.Enable()
+	widgets.formatButton.Enable()
+	widgets.formatTable.Enable()
+	widgets.formatFS.Enable()
+	widgets.formatLabel.Enable()
+	widgets.tablePath.Enable()
+	widgets.tableBrowseButton.Enable()
+	widgets.tableSaveButton.Enable()
+	widgets.tableRestoreButton.Enable()
+	widgets.boardProfile.Enable()
+	widgets.boardButton.Enable()
+	widgets.composeLayout.Enable()
+	widgets.composeOutput.Enable()
+	widgets.composeBrowseButton.Enable()
+	widgets.composeOutputButton.Enable()
+	widgets.composeWriteButton.Enable()
+	widgets.composeSaveButton.Enable()
+	for i := range widgets.boardFiles {
+		widgets.boardFiles[i].Enable()
+		widgets.boardBrowse[i].Enable()
+	}
 	widgets.cancelButton.Disable()
 	widgets.statusLabel.SetText("Standby...")
 	widgets.speedLabel.SetText("")
@@ -57,13 +176,16 @@ func DisableCancelButton(widgets GUI, data MainData) {
 }
 
 func enableCancelButton(widgets GUI, data MainData) {
-	if data.taskType == START_WRITE || data.taskType == START_VERIFY {
-		widgets.guiTabs.DisableIndex(1)
-	} else if data.taskType == START_READ {
-		widgets.guiTabs.DisableIndex(0)
+	// Only the tab the job was started from stays reachable.
+	for i := range widgets.guiTabs.Items {
+		if i != widgets.guiTabs.SelectedIndex() {
+			widgets.guiTabs.DisableIndex(i)
+		}
 	}
 
 	widgets.selectDrive.Disable()
+	widgets.selectPartition.Disable()
+	widgets.cloneSource.Disable()
 	widgets.reloadButton.Disable()
 	widgets.openPath.Disable()
 	widgets.savePath.Disable()
@@ -73,11 +195,59 @@ func enableCancelButton(widgets GUI, data MainData) {
 	widgets.writeButton.Disable()
 	widgets.saveButton.Disable()
 	widgets.verifyButton.Disable()
+	widgets.cloneButton.Disable()
+	widgets.multiButton.Disable()
+	widgets.resumeButton.Disable()
+	widgets.undoButton.Disable()
 	widgets.mbrCheck.Disable()
+	widgets.rescueMode.Disable()
+	widgets.showAllDisks.Disable()
 	widgets.ignoreSize.Disable()
+	widgets.padTail.Disable()
+	widgets.clearTail.Disable()
+	widgets.skipZeros.Disable()
+	widgets.assumeBlank.Disable()
+	widgets.deltaWrite.Disable()
+	widgets.snapshot.Disable()
+	widgets.rawSkip.Disable()
+	widgets.rawSeek.Disable()
+	widgets.rawCount.Disable()
+	widgets.cloneAllocated.Disable()
+	widgets.cloneVerify.Disable()
+	widgets.wipeButton.Disable()
+	widgets.wipeMethod.Disable()
+	widgets.wipeVerify.Disable()
+	widgets.formatButton.Disable()
+	widgets.formatTable.Disable()
+	widgets.formatFS.Disable()
+	widgets.formatLabel.Disable()
+	widgets.tablePath.Disable()
+	widgets.tableBrowseButton.Disable()
+	widgets.tableSaveButton.Disable()
+	widgets.tableRestoreButton.Disable()
+	widgets.boardProfile.Disable()
+	widgets.boardButton.Disable()
+	widgets.composeLayout.Disable()
+	widgets.composeOutput.Disable()
+	widgets.composeBrowseButton.Disable()
+	widgets.composeOutputButton.Disable()
+	widgets.composeWriteButton.Disable()
+	widgets.composeSaveButton.Disable()
+	for i := range widgets.boardFiles {
+		widgets.boardFiles[i].Disable()
+		widgets.boardBrowse[i].Disable()
+	}
 	widgets.cancelButton.Enable()
 }
 
+func diskLabels(disks []Disk) []string {
+	labels := []string{}
+	for _, disk := range disks {
+		labels = append(labels, disk.Label())
+	}
+	return labels
+}
+
 func FileOpenDialog(myApp fyne.App, gui GUI) {
 	window := myApp.NewWindow("Utkirna")
 	window.CenterOnScreen()
@@ -131,9 +301,422 @@ func FileSaveDialog(myApp fyne.App, gui GUI) {
 	window.Show()
 }
 
-func HandleError(gui GUI, data *MainData, err error) {
+func (gui GUI) SetStatus(status string) {
+	gui.statusLabel.SetText(status)
+}
+
+func (gui GUI) SetSpeed(speed string) {
+	gui.speedLabel.SetText(speed)
+}
+
+func (gui GUI) SetElapsed(elapsed string) {
+	gui.elapsedLabel.SetText(elapsed)
+}
+
+func (gui GUI) SetProgress(done int64, total int64) {
+	gui.rwProgressBar.Max = float64(total)
+	gui.rwProgressBar.SetValue(float64(done))
+}
+
+// rescueMapView draws a RescueMap as a bar, one column per part of the drive.
+type rescueMapView struct {
+	raster    *canvas.Raster
+	rescueMap *RescueMap
+}
+
+func newRescueMapView() *rescueMapView {
+	view := &rescueMapView{}
+	view.raster = canvas.NewRaster(view.draw)
+	view.raster.SetMinSize(fyne.NewSize(0, 12))
+	view.raster.Hide()
+	return view
+}
+
+func (view *rescueMapView) draw(w int, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	if view.rescueMap == nil || w < 1 {
+		return img
+	}
+
+	size := view.rescueMap.Size()
+	for x := 0; x < w; x++ {
+		var c color.Color
+		switch view.rescueMap.StatusAt(size*int64(x)/int64(w), size*int64(x+1)/int64(w)) {
+		case RESCUE_FINISHED:
+			c = theme.SuccessColor()
+		case RESCUE_BAD_SECTOR:
+			c = theme.ErrorColor()
+		case RESCUE_NON_TRIMMED, RESCUE_NON_SCRAPED:
+			c = theme.WarningColor()
+		default:
+			c = theme.DisabledColor()
+		}
+		for y := 0; y < h; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func (gui GUI) ShowRescueMap(rescueMap *RescueMap) {
+	gui.rescueMap.rescueMap = rescueMap
+	gui.rescueMap.raster.Show()
+	gui.rescueMap.raster.Refresh()
+}
+
+// multiTargetRows shows the state of every drive of a multi-target write in
+// a window of its own, one row per drive.
+type multiTargetRows struct {
+	window   fyne.Window
+	statuses []*widget.Label
+	bars     []*widget.ProgressBar
+}
+
+func newMultiTargetRows(myApp fyne.App, disks []Disk) *multiTargetRows {
+	rows := &multiTargetRows{window: myApp.NewWindow("Utkirna - Multiple Drives")}
+	grid := container.NewGridWithColumns(3)
+	for _, disk := range disks {
+		status := widget.NewLabel("Waiting...")
+		bar := widget.NewProgressBar()
+		rows.statuses = append(rows.statuses, status)
+		rows.bars = append(rows.bars, bar)
+		grid.Add(widget.NewLabel(disk.Label()))
+		grid.Add(bar)
+		grid.Add(status)
+	}
+	rows.window.SetContent(container.NewVScroll(grid))
+	rows.window.Resize(fyne.NewSize(600, 300))
+	return rows
+}
+
+func (gui GUI) SetTargetStatus(target int, status string) {
+	gui.targetRows.statuses[target].SetText(status)
+}
+
+func (gui GUI) SetTargetProgress(target int, done int64, total int64) {
+	gui.targetRows.bars[target].Max = float64(total)
+	gui.targetRows.bars[target].SetValue(float64(done))
+}
+
+func (gui GUI) JobFinished(data MainData) {
+	DisableCancelButton(gui, data)
+}
+
+func (gui GUI) HandleError(data *MainData, err error) {
 	dialog.ShowError(err, gui.window)
-	DisableCancelButton(gui, *data)
+}
+
+// ConfirmSectorSizeMismatch warns that the partition table of the image was
+// built for another sector size than the one of the selected drive.
+func (gui GUI) ConfirmSectorSizeMismatch(imageSector int, diskSector int, callback func(MismatchChoice)) {
+	message := widget.NewLabel(fmt.Sprintf(
+		"The partition table of the image was built for %d-byte sectors,\n"+
+			"but the selected drive uses %d-byte sectors. Written as is, the\n"+
+			"partitions will not be found and the drive will most likely not boot.\n\n"+
+			"The partition table can be translated while writing. Filesystems\n"+
+			"that record their own sector size may still need to support it.",
+		imageSector,
+		diskSector,
+	))
+
+	var mismatchDialog *dialog.CustomDialog
+	choose := func(choice MismatchChoice) func() {
+		return func() {
+			mismatchDialog.Hide()
+			callback(choice)
+		}
+	}
+	translateButton := widget.NewButton("Translate", choose(MISMATCH_TRANSLATE))
+	translateButton.Importance = widget.HighImportance
+
+	mismatchDialog = dialog.NewCustomWithoutButtons("Sector size mismatch", message, gui.window)
+	mismatchDialog.SetButtons([]fyne.CanvasObject{
+		widget.NewButton("Cancel", choose(MISMATCH_CANCEL)),
+		widget.NewButton("Continue as is", choose(MISMATCH_AS_IS)),
+		translateButton,
+	})
+	mismatchDialog.Show()
+}
+
+// HandleSuccess reports a finished job in a dialog, since the status label is
+// reset to standby as soon as the job's handles are released.
+func (gui GUI) HandleSuccess(message string) {
+	dialog.ShowInformation("Success", message, gui.window)
+}
+
+// ShowResumeDialog lets the user pick an interrupted job and resumes it.
+func ShowResumeDialog(gui GUI, data *MainData) {
+	journals, err := ListJournals()
+	if err != nil {
+		dialog.ShowError(errors.Join(errors.New("ListJournals failed"), err), gui.window)
+		return
+	}
+	if len(journals) < 1 {
+		dialog.ShowInformation("Resume", "There is no interrupted job to resume.", gui.window)
+		return
+	}
+
+	labels := []string{}
+	for _, journal := range journals {
+		labels = append(labels, journal.String())
+	}
+	selectJob := widget.NewSelect(labels, func(s string) {})
+	selectJob.SetSelectedIndex(0)
+
+	dialog.ShowForm(
+		"Resume",
+		"Resume",
+		"Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Job", selectJob)},
+		func(b bool) {
+			if !b {
+				return
+			}
+			journal := journals[selectJob.SelectedIndex()]
+			err := PrepareResume(data, journal)
+			if err != nil {
+				dialog.ShowError(err, gui.window)
+				return
+			}
+			enableCancelButton(gui, *data)
+			gui.statusLabel.SetText("Resuming...")
+			StartMainTask(data, gui)
+		},
+		gui.window,
+	)
+}
+
+// ShowMultiWriteDialog lets the user pick the drives to write the image to at
+// once and starts the job.
+func ShowMultiWriteDialog(myApp fyne.App, gui *GUI, data *MainData, disks []Disk) {
+	if len(gui.openPath.Text) < 1 {
+		dialog.ShowInformation("Insufficient fields", "Select an image to write from!", gui.window)
+		return
+	}
+
+	selectTargets := widget.NewCheckGroup(diskLabels(disks), func(s []string) {})
+	dialog.ShowForm(
+		"Write to several drives",
+		"Write",
+		"Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Drives", selectTargets)},
+		func(b bool) {
+			if !b {
+				return
+			}
+			targets := []Disk{}
+			identities := []DiskIdentity{}
+			for _, disk := range disks {
+				if !slices.Contains(selectTargets.Selected, disk.Label()) {
+					continue
+				}
+				identity, err := GetDiskIdentity(disk.Path)
+				if err != nil {
+					dialog.ShowError(errors.Join(errors.New("GetDiskIdentity failed"), err), gui.window)
+					return
+				}
+				targets = append(targets, disk)
+				identities = append(identities, identity)
+			}
+			if len(targets) < 1 {
+				dialog.ShowInformation("Insufficient fields", "Select the drives to write to!", gui.window)
+				return
+			}
+
+			options := *data
+			options.clearTail = gui.clearTail.Checked
+			options.skipZeros = gui.skipZeros.Checked
+			options.assumeBlank = gui.assumeBlank.Checked
+			options.deltaWrite = gui.deltaWrite.Checked
+			options.snapshot = gui.snapshot.Checked
+			droppedStr := ""
+			if dropped := multiWriteDropped(options); len(dropped) > 0 {
+				droppedStr = "\nWriting several drives leaves these options off:\n" + strings.Join(dropped, "\n") + "\n"
+			}
+
+			confirmStr := fmt.Sprintf(
+				"Everything on these %d drives will be destroyed:\n%s\n%sAre you sure to continue?",
+				len(targets),
+				strings.Join(diskLabels(targets), "\n"),
+				droppedStr,
+			)
+			dialog.ShowConfirm("Writing", confirmStr, func(b bool) {
+				if !b {
+					return
+				}
+				gui.targetRows = newMultiTargetRows(myApp, targets)
+				gui.targetRows.window.Show()
+
+				data.imagePath = gui.openPath.Text
+				data.taskType = START_WRITE
+				data.ignoreSize = gui.ignoreSize.Checked
+				data.partition = Partition{}
+				data.rawRange = RawRange{}
+				// StartMultiWrite turns these off again, noting them in the
+				// report.
+				data.clearTail = options.clearTail
+				data.skipZeros = options.skipZeros
+				data.assumeBlank = options.assumeBlank
+				data.deltaWrite = options.deltaWrite
+				data.snapshot = options.snapshot
+				enableCancelButton(*gui, *data)
+				gui.statusLabel.SetText("Writing...")
+				StartMultiWrite(data, *gui, targets, identities)
+			}, gui.window)
+		},
+		gui.window,
+	)
+}
+
+// duplicatorBoard is the fullscreen window of a running duplicator, with a
+// large tile per slot that can be read from across the room.
+type duplicatorBoard struct {
+	window fyne.Window
+	counts *canvas.Text
+	grid   *fyne.Container
+	mutex  sync.Mutex
+	tiles  map[string]*slotTile
+	// cancel stops the job of a slot.
+	cancel func(path string)
+}
+
+type slotTile struct {
+	background *canvas.Rectangle
+	title      *canvas.Text
+	status     *widget.Label
+	bar        *widget.ProgressBar
+	cancel     *widget.Button
+}
+
+func newDuplicatorBoard(myApp fyne.App) *duplicatorBoard {
+	board := &duplicatorBoard{
+		window: myApp.NewWindow("Utkirna - Duplicator"),
+		counts: canvas.NewText("Passed: 0    Failed: 0", theme.ForegroundColor()),
+		grid:   container.NewGridWrap(fyne.NewSize(320, 200)),
+		tiles:  map[string]*slotTile{},
+	}
+	board.counts.TextSize = 48
+	board.counts.TextStyle.Bold = true
+	board.counts.Alignment = fyne.TextAlignCenter
+
+	waiting := widget.NewLabel("Insert the drives to write to.")
+	waiting.Alignment = fyne.TextAlignCenter
+	board.window.SetContent(container.NewBorder(
+		container.NewVBox(board.counts, waiting),
+		nil,
+		nil,
+		nil,
+		container.NewVScroll(board.grid),
+	))
+	board.window.SetFullScreen(true)
+	return board
+}
+
+func slotColor(state SlotState) color.Color {
+	switch state {
+	case SLOT_BUSY:
+		return theme.PrimaryColor()
+	case SLOT_PASSED:
+		return theme.SuccessColor()
+	case SLOT_FAILED:
+		return theme.ErrorColor()
+	}
+	return theme.DisabledColor()
+}
+
+func (board *duplicatorBoard) UpdateSlot(slot Slot) {
+	board.mutex.Lock()
+	tile, ok := board.tiles[slot.Path]
+	if !ok {
+		tile = &slotTile{
+			background: canvas.NewRectangle(slotColor(slot.State)),
+			title:      canvas.NewText(slot.Path, color.White),
+			status:     widget.NewLabel(""),
+			bar:        widget.NewProgressBar(),
+		}
+		tile.title.TextSize = 32
+		tile.title.TextStyle.Bold = true
+		tile.status.Wrapping = fyne.TextWrapWord
+		path := slot.Path
+		tile.cancel = widget.NewButton("Cancel", func() {
+			dialog.ShowConfirm(
+				"Cancellation",
+				"The drive in "+path+" will count as failed. Are you sure to continue?",
+				func(b bool) {
+					if b {
+						board.cancel(path)
+					}
+				},
+				board.window,
+			)
+		})
+		board.tiles[slot.Path] = tile
+		board.grid.Add(container.NewStack(
+			tile.background,
+			container.NewPadded(container.NewBorder(
+				tile.title,
+				container.NewBorder(nil, nil, nil, tile.cancel, tile.bar),
+				nil,
+				nil,
+				tile.status,
+			)),
+		))
+	}
+	board.mutex.Unlock()
+
+	tile.background.FillColor = slotColor(slot.State)
+	tile.background.Refresh()
+	tile.status.SetText(slot.Status)
+	tile.bar.SetValue(slot.Progress)
+	if slot.State == SLOT_BUSY {
+		tile.cancel.Enable()
+	} else {
+		tile.cancel.Disable()
+	}
+}
+
+func (board *duplicatorBoard) UpdateCounts(passed int, failed int) {
+	board.counts.Text = fmt.Sprintf("Passed: %d    Failed: %d", passed, failed)
+	board.counts.Refresh()
+}
+
+// StartDuplicator checks the settings of the duplicator tab and runs a
+// duplicator until its board is closed.
+func StartDuplicator(myApp fyne.App, gui *GUI, data *MainData) {
+	if len(gui.openPath.Text) < 1 {
+		dialog.ShowInformation("Insufficient fields", "Select an image to write from!", gui.window)
+		return
+	}
+	filter := DuplicatorFilter{Vendor: strings.TrimSpace(gui.dupVendor.Text)}
+	for _, bound := range []struct {
+		entry *widget.Entry
+		size  *int64
+	}{{gui.dupMinSize, &filter.MinSize}, {gui.dupMaxSize, &filter.MaxSize}} {
+		text := strings.TrimSpace(bound.entry.Text)
+		if len(text) < 1 {
+			continue
+		}
+		gigabytes, err := strconv.ParseFloat(text, 64)
+		if err != nil || gigabytes < 0 {
+			dialog.ShowInformation("Invalid size", "Enter drive sizes in GB, like 7.5.", gui.window)
+			return
+		}
+		*bound.size = int64(gigabytes * 1e9)
+	}
+
+	confirmStr := "Every removable drive inserted from now on that matches the filter\n" +
+		"is overwritten without asking. Are you sure to continue?"
+	dialog.ShowConfirm("Duplicator", confirmStr, func(b bool) {
+		if !b {
+			return
+		}
+		board := newDuplicatorBoard(myApp)
+		duplicator := NewDuplicator(gui.openPath.Text, filter, data.retry, board)
+		board.cancel = duplicator.Cancel
+		board.window.SetOnClosed(duplicator.Stop)
+		board.window.Show()
+		duplicator.Start()
+	}, gui.window)
 }
 
 func HandleStartError() {
@@ -160,31 +743,132 @@ func HandleStartError() {
 	window.ShowAndRun()
 }
 
-func StartGui() {
-	var data MainData
+func StartGui(options Options) {
+	data := MainData{retry: options.Retry}
 	var gui GUI
 
 	myApp := app.New()
 
 	gui.window = myApp.NewWindow("Utkirna")
 	gui.window.CenterOnScreen()
-	gui.window.Resize(fyne.NewSize(600, 360))
+	gui.window.Resize(fyne.NewSize(600, 400))
 	gui.window.SetFixedSize(true)
 
 	drive_label := widget.NewLabel(("Select Drive:"))
 
-	gui.selectDrive = widget.NewSelect(GetDisks(), func(s string) {
-		data.selectedDrive = s
+	disks := GetDisks(options.AllDisks)
+	gui.lockIcon = widget.NewIcon(lockIcon)
+	gui.lockIcon.Hide()
+	wholeDrive := "Whole drive"
+	partitions := []Partition{}
+	gui.selectPartition = widget.NewSelect([]string{wholeDrive}, func(s string) {})
+	gui.selectPartition.SetSelectedIndex(0)
+	selectedPartition := func() Partition {
+		if i := gui.selectPartition.SelectedIndex(); i > 0 {
+			return partitions[i-1]
+		}
+		return Partition{}
+	}
+	listPartitions := func(disk Disk, identity DiskIdentity) {
+		partitions = []Partition{}
+		labels := []string{wholeDrive}
+		table, err := ListPartitions(disk, identity)
+		if err != nil {
+			log.Printf("ListPartitions(): %s", err)
+		} else {
+			for _, partition := range table.Partitions {
+				if partition.Extended {
+					continue
+				}
+				partitions = append(partitions, partition)
+				labels = append(labels, table.Describe(partition))
+			}
+		}
+		gui.selectPartition.Options = labels
+		gui.selectPartition.SetSelectedIndex(0)
+	}
+	gui.selectDrive = widget.NewSelect(diskLabels(disks), func(s string) {
+		data.selectedDrive = ""
+		data.selectedDisk = Disk{}
+		gui.lockIcon.Hide()
+		listPartitions(Disk{}, DiskIdentity{})
+		for _, disk := range disks {
+			if disk.Label() == s {
+				identity, err := GetDiskIdentity(disk.Path)
+				if err != nil {
+					dialog.ShowError(
+						errors.Join(errors.New("GetDiskIdentity failed"), err),
+						gui.window,
+					)
+					gui.selectDrive.ClearSelected()
+					return
+				}
+				data.selectedDrive = disk.Path
+				data.selectedDisk = disk
+				data.selectedIdentity = identity
+				if disk.ReadOnly {
+					gui.lockIcon.Show()
+				}
+				listPartitions(disk, identity)
+			}
+		}
 	})
-	gui.reloadButton = widget.NewButtonWithIcon("Reload", theme.ViewRefreshIcon(), func() {
+	gui.cloneSource = widget.NewSelect(diskLabels(disks), func(s string) {
+		data.sourceDisk = Disk{}
+		for _, disk := range disks {
+			if disk.Label() == s {
+				identity, err := GetDiskIdentity(disk.Path)
+				if err != nil {
+					dialog.ShowError(
+						errors.Join(errors.New("GetDiskIdentity failed"), err),
+						gui.window,
+					)
+					gui.cloneSource.ClearSelected()
+					return
+				}
+				data.sourceDisk = disk
+				data.sourceIdentity = identity
+			}
+		}
+	})
+	reloadDisks := func() {
 		data.selectedDrive = ""
+		data.selectedDisk = Disk{}
+		gui.lockIcon.Hide()
 		gui.selectDrive.ClearSelected()
-		gui.selectDrive.Options = GetDisks()
+		listPartitions(Disk{}, DiskIdentity{})
+		data.sourceDisk = Disk{}
+		gui.cloneSource.ClearSelected()
+		disks = GetDisks(gui.showAllDisks.Checked)
+		gui.selectDrive.Options = diskLabels(disks)
+		gui.cloneSource.Options = diskLabels(disks)
+	}
+	gui.reloadButton = widget.NewButtonWithIcon("Reload", theme.ViewRefreshIcon(), reloadDisks)
+	gui.showAllDisks = widget.NewCheck("Show all disks", func(b bool) {
+		if b {
+			drive_label.SetText("Select Drive (all disks are shown, double-check the target!):")
+			drive_label.Importance = widget.DangerImportance
+			dialog.ShowInformation(
+				"Show all disks",
+				"Every disk is listed now, including internal and virtual ones.\n"+
+					"Writing to the wrong disk destroys all data on it.\n"+
+					"Disks the running system depends on are listed but cannot be used.",
+				gui.window,
+			)
+		} else {
+			drive_label.SetText("Select Drive:")
+			drive_label.Importance = widget.MediumImportance
+		}
+		drive_label.Refresh()
+		reloadDisks()
 	})
+	gui.showAllDisks.SetChecked(options.AllDisks)
+	driveHeader := container.NewBorder(nil, nil, nil, gui.showAllDisks, drive_label)
 	drive := container.NewGridWithColumns(2,
-		gui.selectDrive,
+		container.NewBorder(nil, nil, gui.lockIcon, nil, gui.selectDrive),
 		gui.reloadButton,
 	)
+	partition := container.NewBorder(nil, nil, widget.NewLabel("Partition:"), nil, gui.selectPartition)
 
 	selectImageLabel := widget.NewLabel("Select Image:")
 	saveImageLabel := widget.NewLabel("Save Image:")
@@ -211,7 +895,51 @@ func StartGui() {
 	)
 
 	gui.mbrCheck = widget.NewCheck("Read only allocated partitions", func(b bool) {})
+	gui.rescueMode = widget.NewCheck("Rescue mode (skip and retry unreadable areas)", func(b bool) {})
+	gui.rescueMap = newRescueMapView()
 	gui.ignoreSize = widget.NewCheck("Ignore size limitations", func(b bool) {})
+	gui.padTail = widget.NewCheck("Pad last partial sector with zeros", func(b bool) {})
+	gui.padTail.SetChecked(true)
+	gui.clearTail = widget.NewCheck("Discard the rest of the drive after the image", func(b bool) {})
+	gui.skipZeros = widget.NewCheck("Skip chunks of zeros (the drive is cleared first)", func(b bool) {})
+	skipZerosHelp := widget.NewLabel(
+		"The drive is discarded first. Unless it promises to read back zeros then, it is asked to zero " +
+			"itself, and if it cannot, every chunk is written as usual.",
+	)
+	skipZerosHelp.Wrapping = fyne.TextWrapWord
+	gui.assumeBlank = widget.NewCheck("The drive is already blank, do not zero it", func(b bool) {})
+	gui.deltaWrite = widget.NewCheck("Only rewrite chunks that differ (reads the drive first)", func(b bool) {})
+	gui.snapshot = widget.NewCheck("Save what is overwritten so that the write can be undone", func(b bool) {})
+	gui.snapshot.SetChecked(true)
+	gui.rawSkip = widget.NewEntry()
+	gui.rawSkip.SetPlaceHolder("0")
+	gui.rawSeek = widget.NewEntry()
+	gui.rawSeek.SetPlaceHolder("0")
+	gui.rawCount = widget.NewEntry()
+	gui.rawCount.SetPlaceHolder("All of the image")
+	// The offsets take a number of bytes or one such as 8K, 1M or 64s, where
+	// s stands for 512-byte sectors.
+	readRawRange := func() (RawRange, error) {
+		var r RawRange
+		var err error
+		if r.Skip, err = ParseSize(gui.rawSkip.Text); err != nil {
+			return r, errors.Join(errors.New("Input offset:"), err)
+		}
+		if r.Seek, err = ParseSize(gui.rawSeek.Text); err != nil {
+			return r, errors.Join(errors.New("Output offset:"), err)
+		}
+		if r.Count, err = ParseSize(gui.rawCount.Text); err != nil {
+			return r, errors.Join(errors.New("Length:"), err)
+		}
+		return r, nil
+	}
+	advanced := widget.NewAccordion(widget.NewAccordionItem("Advanced", container.New(
+		layout.NewFormLayout(),
+		widget.NewLabel("Input offset (skip):"), gui.rawSkip,
+		widget.NewLabel("Output offset (seek):"), gui.rawSeek,
+		widget.NewLabel("Length (count):"), gui.rawCount,
+		layout.NewSpacer(), widget.NewLabel("In bytes, or such as 8K, 1M or 64s (512-byte sectors)"),
+	)))
 
 	gui.rwProgressBar = widget.NewProgressBar()
 
@@ -233,8 +961,12 @@ func StartGui() {
 			cancelStr = "Cancelling the current operation may corrupt the destination drive.\nAre you sure to continue?"
 		} else if data.taskType == START_VERIFY {
 			cancelStr = "Are you sure to skip the verification of the drive?"
-		} else if data.taskType == START_READ {
+		} else if data.taskType == START_READ || data.taskType == START_COMPOSE_IMAGE || data.taskType == START_TABLE_BACKUP {
 			cancelStr = "Current operation has not been finished. Are you sure to continue?"
+		} else if data.taskType == START_CLONE {
+			cancelStr = "Cancelling the current operation may corrupt the target drive.\nAre you sure to continue?"
+		} else {
+			cancelStr = "Cancelling the current operation may leave the drive unusable.\nAre you sure to continue?"
 		}
 
 		dialog.ShowConfirm(
@@ -242,8 +974,13 @@ func StartGui() {
 			cancelStr,
 			func(b bool) {
 				if b {
-					data.bQuitTask <- struct{}{}
-					gui.statusLabel.SetText("Cancelled")
+					// The job may be past its last check for cancellation, so
+					// the request is left for it rather than waited on.
+					select {
+					case data.bQuitTask <- struct{}{}:
+						gui.statusLabel.SetText("Cancelled")
+					default:
+					}
 				}
 			},
 			gui.window,
@@ -260,12 +997,19 @@ func StartGui() {
 			)
 		} else if len(gui.savePath.Text) < 1 {
 			dialog.ShowInformation("Insufficient fields", "Select an image to write to!", gui.window)
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_READ); err != nil {
+			dialog.ShowInformation("Drive cannot be read", err.Error(), gui.window)
 		} else {
 			dialog.ShowConfirm("Reading", "Are you sure to continue?", func(b bool) {
 				if b {
 					gui.statusLabel.SetText("Reading...")
 					data.imagePath = gui.savePath.Text
 					data.taskType = START_READ
+					data.partition = selectedPartition()
+					data.rawRange = RawRange{}
+					data.mbrCheck = gui.mbrCheck.Checked
+					data.rescue = gui.rescueMode.Checked
+					gui.rescueMap.raster.Hide()
 					enableCancelButton(gui, data)
 					StartMainTask(&data, gui)
 				}
@@ -273,15 +1017,47 @@ func StartGui() {
 		}
 	})
 	gui.writeButton = widget.NewButton("Write", func() {
+		rawRange, rangeErr := readRawRange()
 		if len(data.selectedDrive) < 1 {
 			dialog.ShowInformation("Insufficient fields", "Select a drive to write to!", gui.window)
 		} else if len(gui.openPath.Text) < 1 {
 			dialog.ShowInformation("Insufficient fields", "Select an image to write from!", gui.window)
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_WRITE); err != nil {
+			dialog.ShowInformation("Drive cannot be written", err.Error(), gui.window)
+		} else if rangeErr != nil {
+			dialog.ShowInformation("Invalid offset", rangeErr.Error(), gui.window)
 		} else {
-			dialog.ShowConfirm("Writing", "Are you sure to continue?", func(b bool) {
+			confirmStr := "Are you sure to continue?"
+			if rawRange.IsSet() {
+				check := data
+				check.imagePath = gui.openPath.Text
+				check.partition = selectedPartition()
+				check.clearTail = gui.clearTail.Checked
+				check.rawRange = rawRange
+				warnings, err := CheckRawRange(&check)
+				if err != nil {
+					dialog.ShowInformation("Invalid offset", err.Error(), gui.window)
+					return
+				}
+				confirmStr = "The image is written " + rawRange.String() + ".\n" +
+					strings.Join(warnings, "\n") + "\n" + confirmStr
+			} else if !data.selectedDisk.Removable {
+				confirmStr = data.selectedDisk.Path + " is not a removable drive. Everything on it will be destroyed.\n" +
+					confirmStr
+			}
+			dialog.ShowConfirm("Writing", confirmStr, func(b bool) {
 				if b {
 					data.imagePath = gui.openPath.Text
 					data.taskType = START_WRITE
+					data.partition = selectedPartition()
+					data.rawRange = rawRange
+					data.ignoreSize = gui.ignoreSize.Checked
+					data.padTail = gui.padTail.Checked
+					data.clearTail = gui.clearTail.Checked
+					data.skipZeros = gui.skipZeros.Checked || gui.assumeBlank.Checked
+					data.assumeBlank = gui.assumeBlank.Checked
+					data.deltaWrite = gui.deltaWrite.Checked
+					data.snapshot = gui.snapshot.Checked
 					enableCancelButton(gui, data)
 					gui.statusLabel.SetText("Writing...")
 					StartMainTask(&data, gui)
@@ -290,61 +1066,586 @@ func StartGui() {
 		}
 	})
 	gui.verifyButton = widget.NewButton("Verify Only", func() {
+		rawRange, rangeErr := readRawRange()
 		if len(data.selectedDrive) < 1 {
 			dialog.ShowInformation("Insufficient fields", "Select a drive to verify!", gui.window)
 		} else if len(gui.openPath.Text) < 1 {
 			dialog.ShowInformation("Insufficient fields", "Select an image to verify from!", gui.window)
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_VERIFY); err != nil {
+			dialog.ShowInformation("Drive cannot be verified", err.Error(), gui.window)
+		} else if rangeErr != nil {
+			dialog.ShowInformation("Invalid offset", rangeErr.Error(), gui.window)
 		} else {
 			dialog.ShowConfirm("Verifying", "Are you sure to continue?", func(b bool) {
 				if b {
 					gui.statusLabel.SetText("Verifying...")
 					data.imagePath = gui.openPath.Text
 					data.taskType = START_VERIFY
+					data.partition = selectedPartition()
+					data.rawRange = rawRange
+					data.ignoreSize = gui.ignoreSize.Checked
+					enableCancelButton(gui, data)
+					StartMainTask(&data, gui)
+				}
+			}, gui.window)
+		}
+	})
+	gui.cloneAllocated = widget.NewCheck("Copy only allocated partitions", func(b bool) {})
+	gui.cloneVerify = widget.NewCheck("Verify after cloning", func(b bool) {})
+	gui.cloneVerify.SetChecked(true)
+	gui.cloneButton = widget.NewButton("Clone", func() {
+		if len(data.sourceDisk.Path) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a drive to clone from!", gui.window)
+		} else if len(data.selectedDrive) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a drive to clone to!", gui.window)
+		} else if err := CheckDiskPolicy(data.sourceDisk, START_READ); err != nil {
+			dialog.ShowInformation("Drive cannot be read", err.Error(), gui.window)
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_CLONE); err != nil {
+			dialog.ShowInformation("Drive cannot be written", err.Error(), gui.window)
+		} else {
+			confirmStr := "Everything on " + data.selectedDisk.Path + " will be replaced by a copy of " +
+				data.sourceDisk.Path + ".\nAre you sure to continue?"
+			dialog.ShowConfirm("Cloning", confirmStr, func(b bool) {
+				if b {
+					data.imagePath = SourceDevicePath(data.sourceDisk, data.sourceIdentity)
+					data.taskType = START_CLONE
+					data.partition = Partition{}
+					data.rawRange = RawRange{}
+					data.mbrCheck = gui.cloneAllocated.Checked
+					data.verify = gui.cloneVerify.Checked
+					data.ignoreSize = false
+					data.padTail = true
+					data.clearTail = false
+					data.skipZeros = false
+					data.assumeBlank = false
+					data.deltaWrite = false
+					data.snapshot = false
+					enableCancelButton(gui, data)
+					gui.statusLabel.SetText("Cloning...")
+					StartMainTask(&data, gui)
+				}
+			}, gui.window)
+		}
+	})
+	gui.wipeButton = widget.NewButton("Wipe", func() {
+		if len(data.selectedDrive) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a drive to wipe!", gui.window)
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_WIPE); err != nil {
+			dialog.ShowInformation("Drive cannot be written", err.Error(), gui.window)
+		} else {
+			confirmStr := "Everything on " + data.selectedDisk.Path + " will be erased for good.\n" +
+				"Are you sure to continue?"
+			dialog.ShowConfirm("Wiping", confirmStr, func(b bool) {
+				if b {
+					data.imagePath = ""
+					data.taskType = START_WIPE
+					data.wipeMethod = WipeMethod(gui.wipeMethod.SelectedIndex())
+					data.verify = gui.wipeVerify.Checked
 					enableCancelButton(gui, data)
+					gui.statusLabel.SetText("Wiping...")
 					StartMainTask(&data, gui)
 				}
 			}, gui.window)
 		}
 	})
+	gui.formatButton = widget.NewButton("Format", func() {
+		options := FormatOptions{
+			Table:      TABLE_MBR,
+			FileSystem: FileSystem(gui.formatFS.SelectedIndex()),
+			Label:      gui.formatLabel.Text,
+		}
+		if gui.formatTable.SelectedIndex() == 1 {
+			options.Table = TABLE_GPT
+		}
+
+		if len(data.selectedDrive) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a drive to format!", gui.window)
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_FORMAT); err != nil {
+			dialog.ShowInformation("Drive cannot be written", err.Error(), gui.window)
+		} else if err := options.CheckLabel(); err != nil {
+			dialog.ShowInformation("Invalid label", err.Error(), gui.window)
+		} else {
+			confirmStr := "Everything on " + data.selectedDisk.Path + " will be lost.\n" +
+				"Are you sure to continue?"
+			dialog.ShowConfirm("Formatting", confirmStr, func(b bool) {
+				if b {
+					data.imagePath = ""
+					data.taskType = START_FORMAT
+					data.format = options
+					enableCancelButton(gui, data)
+					gui.statusLabel.SetText("Formatting...")
+					StartMainTask(&data, gui)
+				}
+			}, gui.window)
+		}
+	})
+	gui.multiButton = widget.NewButton("Write Many", func() {
+		ShowMultiWriteDialog(myApp, &gui, &data, disks)
+	})
+	gui.resumeButton = widget.NewButton("Resume", func() {
+		ShowResumeDialog(gui, &data)
+	})
+	gui.undoButton = widget.NewButton("Undo Last Write", func() {
+		if len(data.selectedDrive) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select the drive to undo the last write on!", gui.window)
+			return
+		}
+		snapshot, err := LatestSnapshot(data.selectedIdentity)
+		if err != nil {
+			dialog.ShowError(err, gui.window)
+			return
+		}
+		if snapshot == nil {
+			dialog.ShowInformation("Nothing to undo", "No snapshot was saved for this drive.", gui.window)
+			return
+		}
+		if err := CheckDiskPolicy(data.selectedDisk, START_RESTORE); err != nil {
+			dialog.ShowInformation("Drive cannot be written", err.Error(), gui.window)
+			return
+		}
+		confirmStr := "The snapshot of " + snapshot.String() + " will be put back.\n" +
+			"Everything written to the drive since is lost. Are you sure to continue?"
+		dialog.ShowConfirm("Undo Last Write", confirmStr, func(b bool) {
+			if b {
+				data.imagePath = ""
+				data.taskType = START_RESTORE
+				data.snapshotPath = snapshot.path
+				enableCancelButton(gui, data)
+				gui.statusLabel.SetText("Restoring...")
+				StartMainTask(&data, gui)
+			}
+		}, gui.window)
+	})
 	gui.exitButton = widget.NewButton("Exit", func() {
 		gui.window.Close()
 	})
-	writeButtons := container.NewGridWithColumns(4,
+	writeButtons := container.NewGridWithColumns(7,
 		gui.cancelButton,
 		gui.writeButton,
+		gui.multiButton,
 		gui.verifyButton,
+		gui.resumeButton,
+		gui.undoButton,
 		gui.exitButton)
-	readButtons := container.NewGridWithColumns(3,
+	readButtons := container.NewGridWithColumns(4,
 		gui.cancelButton,
 		gui.readButton,
+		gui.resumeButton,
 		gui.exitButton)
 
 	writeTab := container.NewVBox(
-		drive_label,
+		driveHeader,
 		drive,
+		partition,
 		selectImageLabel,
 		openImage,
 		gui.ignoreSize,
+		gui.padTail,
+		gui.clearTail,
+		gui.skipZeros,
+		skipZerosHelp,
+		gui.assumeBlank,
+		gui.deltaWrite,
+		gui.snapshot,
+		advanced,
 		layout.NewSpacer(),
 		gui.rwProgressBar,
 		writeButtons,
 		bottom_labels,
 	)
 	readTab := container.NewVBox(
-		drive_label,
+		driveHeader,
 		drive,
+		partition,
 		saveImageLabel,
 		saveImage,
 		gui.mbrCheck,
+		gui.rescueMode,
 		layout.NewSpacer(),
+		gui.rescueMap.raster,
 		gui.rwProgressBar,
 		readButtons,
 		bottom_labels,
 	)
 
+	cloneButtons := container.NewGridWithColumns(3,
+		gui.cancelButton,
+		gui.cloneButton,
+		gui.exitButton)
+	cloneTab := container.NewVBox(
+		widget.NewLabel("Source Drive:"),
+		gui.cloneSource,
+		driveHeader,
+		drive,
+		gui.cloneAllocated,
+		gui.cloneVerify,
+		layout.NewSpacer(),
+		gui.rwProgressBar,
+		cloneButtons,
+		bottom_labels,
+	)
+
+	wipeMethods := []string{}
+	for method := WIPE_ZERO; method <= WIPE_SECURE_DISCARD; method++ {
+		wipeMethods = append(wipeMethods, method.Description())
+	}
+	gui.wipeMethod = widget.NewSelect(wipeMethods, func(s string) {})
+	gui.wipeMethod.SetSelectedIndex(int(WIPE_ZERO))
+	gui.wipeVerify = widget.NewCheck("Read the drive back to verify the wipe", func(b bool) {})
+	gui.wipeVerify.SetChecked(true)
+	wipeButtons := container.NewGridWithColumns(3,
+		gui.cancelButton,
+		gui.wipeButton,
+		gui.exitButton)
+	wipeTab := container.NewVBox(
+		driveHeader,
+		drive,
+		widget.NewLabel("Method:"),
+		gui.wipeMethod,
+		gui.wipeVerify,
+		layout.NewSpacer(),
+		gui.rwProgressBar,
+		wipeButtons,
+		bottom_labels,
+	)
+
+	gui.formatTable = widget.NewSelect([]string{"MBR (most compatible)", "GPT"}, func(s string) {})
+	gui.formatTable.SetSelectedIndex(0)
+	gui.formatFS = widget.NewSelect(fileSystemNames, func(s string) {})
+	gui.formatFS.SetSelectedIndex(int(FS_FAT32))
+	gui.formatLabel = widget.NewEntry()
+	gui.formatLabel.SetPlaceHolder("Volume label (optional)")
+	formatButtons := container.NewGridWithColumns(3,
+		gui.cancelButton,
+		gui.formatButton,
+		gui.exitButton)
+	formatTab := container.NewVBox(
+		driveHeader,
+		drive,
+		widget.NewForm(
+			widget.NewFormItem("Partition table", gui.formatTable),
+			widget.NewFormItem("Filesystem", gui.formatFS),
+			widget.NewFormItem("Label", gui.formatLabel),
+		),
+		layout.NewSpacer(),
+		gui.rwProgressBar,
+		formatButtons,
+		bottom_labels,
+	)
+
+	gui.tablePath = widget.NewEntry()
+	gui.tablePath.SetPlaceHolder("Backup file (saved to the settings folder if left empty)")
+	gui.tableBrowseButton = widget.NewButton("Open Backup", func() {
+		dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil {
+				dialog.ShowError(err, gui.window)
+				return
+			}
+			if reader != nil {
+				gui.tablePath.SetText(reader.URI().Path())
+				reader.Close()
+			}
+		}, gui.window)
+	})
+	gui.tableSaveButton = widget.NewButton("Save Table", func() {
+		if len(data.selectedDrive) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a drive to save the partition table of!", gui.window)
+			return
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_TABLE_BACKUP); err != nil {
+			dialog.ShowInformation("Drive cannot be read", err.Error(), gui.window)
+			return
+		}
+		path := gui.tablePath.Text
+		if len(path) < 1 {
+			var err error
+			path, err = DefaultTableBackupPath(&data)
+			if err != nil {
+				dialog.ShowError(err, gui.window)
+				return
+			}
+			gui.tablePath.SetText(path)
+		}
+		data.imagePath = path
+		data.taskType = START_TABLE_BACKUP
+		enableCancelButton(gui, data)
+		gui.statusLabel.SetText("Saving the partition table...")
+		StartMainTask(&data, gui)
+	})
+	gui.tableRestoreButton = widget.NewButton("Restore Table", func() {
+		if len(data.selectedDrive) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a drive to restore the partition table to!", gui.window)
+			return
+		} else if len(gui.tablePath.Text) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a partition table backup to restore!", gui.window)
+			return
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_TABLE_RESTORE); err != nil {
+			dialog.ShowInformation("Drive cannot be written", err.Error(), gui.window)
+			return
+		}
+		backup, err := LoadTableBackup(gui.tablePath.Text)
+		if err != nil {
+			dialog.ShowError(err, gui.window)
+			return
+		}
+		confirmStr := "The partition table of " + data.selectedDisk.Path + " will be replaced by the\n" +
+			backup.String() + ".\nAre you sure to continue?"
+		dialog.ShowConfirm("Restoring the partition table", confirmStr, func(b bool) {
+			if b {
+				data.imagePath = gui.tablePath.Text
+				data.taskType = START_TABLE_RESTORE
+				enableCancelButton(gui, data)
+				gui.statusLabel.SetText("Restoring the partition table...")
+				StartMainTask(&data, gui)
+			}
+		}, gui.window)
+	})
+	tableButtons := container.NewGridWithColumns(4,
+		gui.cancelButton,
+		gui.tableSaveButton,
+		gui.tableRestoreButton,
+		gui.exitButton)
+	tableTab := container.NewVBox(
+		driveHeader,
+		drive,
+		widget.NewLabel("Save or restore the MBR and its EBRs, or both copies of the GPT:"),
+		container.NewGridWithColumns(2,
+			gui.tablePath,
+			gui.tableBrowseButton,
+		),
+		layout.NewSpacer(),
+		gui.rwProgressBar,
+		tableButtons,
+		bottom_labels,
+	)
+
+	profiles := LoadBoardProfiles()
+	profileNames := []string{}
+	for _, profile := range profiles {
+		profileNames = append(profileNames, profile.Name)
+	}
+	boardDescription := widget.NewLabel("")
+	boardDescription.Wrapping = fyne.TextWrapWord
+	boardRows := container.NewVBox()
+	gui.boardProfile = widget.NewSelect(profileNames, func(s string) {
+		gui.boardFiles = []*widget.Entry{}
+		gui.boardBrowse = []*widget.Button{}
+		boardRows.RemoveAll()
+		i := gui.boardProfile.SelectedIndex()
+		if i < 0 {
+			boardDescription.SetText("")
+			return
+		}
+		boardDescription.SetText(profiles[i].Description)
+		for _, file := range profiles[i].Files() {
+			entry := widget.NewEntry()
+			entry.SetPlaceHolder(file)
+			browse := widget.NewButton("Open "+file, func() {
+				dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+					if err != nil {
+						dialog.ShowError(err, gui.window)
+						return
+					}
+					if reader != nil {
+						entry.SetText(reader.URI().Path())
+						reader.Close()
+					}
+				}, gui.window)
+			})
+			gui.boardFiles = append(gui.boardFiles, entry)
+			gui.boardBrowse = append(gui.boardBrowse, browse)
+			boardRows.Add(container.NewGridWithColumns(2, entry, browse))
+		}
+	})
+	gui.boardProfile.PlaceHolder = "Select a board"
+	gui.boardButton = widget.NewButton("Write Bootloader", func() {
+		i := gui.boardProfile.SelectedIndex()
+		if len(data.selectedDrive) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a drive to write the bootloader to!", gui.window)
+			return
+		} else if i < 0 {
+			dialog.ShowInformation("Insufficient fields", "Select a board!", gui.window)
+			return
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_BOARD); err != nil {
+			dialog.ShowInformation("Drive cannot be written", err.Error(), gui.window)
+			return
+		}
+		files := map[string]string{}
+		for j, file := range profiles[i].Files() {
+			files[file] = gui.boardFiles[j].Text
+		}
+		check := data
+		check.board = profiles[i]
+		check.boardFiles = files
+		warnings, err := CheckBoard(&check)
+		if err != nil {
+			dialog.ShowInformation("Cannot write the bootloader", err.Error(), gui.window)
+			return
+		}
+		confirmStr := "The bootloader for " + profiles[i].Name + " will be written to " + data.selectedDisk.Path + ".\n" +
+			strings.Join(warnings, "\n") + "\nAre you sure to continue?"
+		dialog.ShowConfirm("Writing the bootloader", confirmStr, func(b bool) {
+			if b {
+				data.imagePath = ""
+				data.taskType = START_BOARD
+				data.board = profiles[i]
+				data.boardFiles = files
+				enableCancelButton(gui, data)
+				gui.statusLabel.SetText("Writing the bootloader...")
+				StartMainTask(&data, gui)
+			}
+		}, gui.window)
+	})
+	boardButtons := container.NewGridWithColumns(3,
+		gui.cancelButton,
+		gui.boardButton,
+		gui.exitButton)
+	boardTab := container.NewVBox(
+		driveHeader,
+		drive,
+		widget.NewLabel("Write the bootloader of a board at its offsets, leaving the partitions as they are:"),
+		gui.boardProfile,
+		boardDescription,
+		boardRows,
+		layout.NewSpacer(),
+		gui.rwProgressBar,
+		boardButtons,
+		bottom_labels,
+	)
+
+	gui.composeLayout = widget.NewEntry()
+	gui.composeLayout.SetPlaceHolder("Layout file describing the partitions and their images")
+	gui.composeOutput = widget.NewEntry()
+	gui.composeOutput.SetPlaceHolder("Image to compose into, when not written to the drive")
+	gui.composeBrowseButton = widget.NewButton("Open Layout", func() {
+		dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil {
+				dialog.ShowError(err, gui.window)
+				return
+			}
+			if reader != nil {
+				gui.composeLayout.SetText(reader.URI().Path())
+				reader.Close()
+			}
+		}, gui.window)
+	})
+	gui.composeOutputButton = widget.NewButton("Save Image As", func() {
+		dialog.ShowFileSave(func(writer fyne.URIWriteCloser, err error) {
+			if err != nil {
+				dialog.ShowError(err, gui.window)
+				return
+			}
+			if writer != nil {
+				gui.composeOutput.SetText(writer.URI().Path())
+				writer.Close()
+			}
+		}, gui.window)
+	})
+	gui.composeWriteButton = widget.NewButton("Write to Drive", func() {
+		if len(data.selectedDrive) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a drive to compose the disk on!", gui.window)
+			return
+		} else if len(gui.composeLayout.Text) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a layout file!", gui.window)
+			return
+		} else if err := CheckDiskPolicy(data.selectedDisk, START_COMPOSE); err != nil {
+			dialog.ShowInformation("Drive cannot be written", err.Error(), gui.window)
+			return
+		}
+		diskLayout, err := LoadDiskLayout(gui.composeLayout.Text)
+		if err == nil {
+			_, err = diskLayout.Plan(data.selectedIdentity.Size, 512)
+		}
+		if err != nil {
+			dialog.ShowInformation("Invalid layout", err.Error(), gui.window)
+			return
+		}
+		confirmStr := "Everything on " + data.selectedDisk.Path + " will be replaced by the disk the layout describes.\n" +
+			"Are you sure to continue?"
+		dialog.ShowConfirm("Composing", confirmStr, func(b bool) {
+			if b {
+				data.imagePath = ""
+				data.taskType = START_COMPOSE
+				data.composeLayout = gui.composeLayout.Text
+				enableCancelButton(gui, data)
+				gui.statusLabel.SetText("Composing...")
+				StartMainTask(&data, gui)
+			}
+		}, gui.window)
+	})
+	gui.composeSaveButton = widget.NewButton("Save Image", func() {
+		if len(gui.composeLayout.Text) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select a layout file!", gui.window)
+			return
+		} else if len(gui.composeOutput.Text) < 1 {
+			dialog.ShowInformation("Insufficient fields", "Select an image to compose into!", gui.window)
+			return
+		}
+		data.imagePath = gui.composeOutput.Text
+		data.taskType = START_COMPOSE_IMAGE
+		data.composeLayout = gui.composeLayout.Text
+		enableCancelButton(gui, data)
+		gui.statusLabel.SetText("Composing...")
+		StartMainTask(&data, gui)
+	})
+	composeButtons := container.NewGridWithColumns(4,
+		gui.cancelButton,
+		gui.composeWriteButton,
+		gui.composeSaveButton,
+		gui.exitButton)
+	composeTab := container.NewVBox(
+		driveHeader,
+		drive,
+		widget.NewLabel("Compose a disk from partition images and raw blobs, as a layout file describes:"),
+		container.NewGridWithColumns(2,
+			gui.composeLayout,
+			gui.composeBrowseButton,
+		),
+		container.NewGridWithColumns(2,
+			gui.composeOutput,
+			gui.composeOutputButton,
+		),
+		layout.NewSpacer(),
+		gui.rwProgressBar,
+		composeButtons,
+		bottom_labels,
+	)
+
+	gui.dupMinSize = widget.NewEntry()
+	gui.dupMinSize.SetPlaceHolder("Any")
+	gui.dupMaxSize = widget.NewEntry()
+	gui.dupMaxSize.SetPlaceHolder("Any")
+	gui.dupVendor = widget.NewEntry()
+	gui.dupVendor.SetPlaceHolder("Any vendor or model")
+	duplicatorButton := widget.NewButton("Start Duplicator", func() {
+		StartDuplicator(myApp, &gui, &data)
+	})
+	duplicatorButton.Importance = widget.HighImportance
+	duplicatorButtons := container.NewGridWithColumns(2,
+		duplicatorButton,
+		gui.exitButton)
+	duplicatorTab := container.NewVBox(
+		selectImageLabel,
+		openImage,
+		widget.NewLabel("Write and verify the image on every drive inserted that matches:"),
+		widget.NewForm(
+			widget.NewFormItem("Minimum size (GB)", gui.dupMinSize),
+			widget.NewFormItem("Maximum size (GB)", gui.dupMaxSize),
+			widget.NewFormItem("Vendor", gui.dupVendor),
+		),
+		layout.NewSpacer(),
+		duplicatorButtons,
+	)
+
 	gui.guiTabs = container.NewAppTabs(
 		container.NewTabItem("Write To Disk", writeTab),
 		container.NewTabItem("Read From Disk", readTab),
+		container.NewTabItem("Clone Disk", cloneTab),
+		container.NewTabItem("Wipe Disk", wipeTab),
+		container.NewTabItem("Format Disk", formatTab),
+		container.NewTabItem("Partition Table", tableTab),
+		container.NewTabItem("Bootloader", boardTab),
+		container.NewTabItem("Compose", composeTab),
+		container.NewTabItem("Duplicator", duplicatorTab),
 	)
 	gui.guiTabs.SetTabLocation(container.TabLocationTop)
 
@@ -7,8 +7,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 	"unsafe"
 
 	uuid "github.com/satori/go.uuid"
@@ -33,6 +35,7 @@ const (
 
 const (
 	IOCTL_DISK_GET_DRIVE_GEOMETRY_EX     = (IOCTL_DISK_BASE << 16) | (FILE_ANY_ACCESS << 14) | (0x0028 << 2) | METHOD_BUFFERED
+	IOCTL_DISK_IS_WRITABLE               = (IOCTL_DISK_BASE << 16) | (FILE_ANY_ACCESS << 14) | (0x0009 << 2) | METHOD_BUFFERED
 	IOCTL_SCSI_GET_ADDRESS               = (IOCTL_SCSI_BASE << 16) | (FILE_ANY_ACCESS << 14) | (0x0406 << 2) | METHOD_BUFFERED
 	IOCTL_STORAGE_CHECK_VERIFY           = (IOCTL_STORAGE_BASE << 16) | (FILE_READ_ACCESS << 14) | (0x0200 << 2) | METHOD_BUFFERED
 	IOCTL_STORAGE_CHECK_VERIFY2          = (IOCTL_STORAGE_BASE << 16) | (FILE_ANY_ACCESS << 14) | (0x0200 << 2) | METHOD_BUFFERED
@@ -105,6 +108,12 @@ const (
 	BusTypeMaxReserved = 0x7F
 )
 
+// Newer bus types are missing from the enumeration above.
+const (
+	BusTypeSpaces = 0x10
+	BusTypeNvme   = 0x11
+)
+
 // STORAGE_PROPERTY_ID enumeration
 type STORAGE_PROPERTY_ID uint32
 
@@ -213,6 +222,16 @@ type STORAGE_DEVICE_DESCRIPTOR struct {
 	RawDeviceProperties   [1]byte
 }
 
+type STORAGE_ACCESS_ALIGNMENT_DESCRIPTOR struct {
+	Version                       uint32
+	Size                          uint32
+	BytesPerCacheLine             uint32
+	BytesOffsetForCacheAlignment  uint32
+	BytesPerLogicalSector         uint32
+	BytesPerPhysicalSector        uint32
+	BytesOffsetForSectorAlignment uint32
+}
+
 type STORAGE_PROPERTY_QUERY struct {
 	PropertyId           STORAGE_PROPERTY_ID
 	QueryType            STORAGE_QUERY_TYPE
@@ -356,6 +375,96 @@ func GetStorageProperty(
 	return deviceDescriptor, err
 }
 
+// GetStorageDeviceStrings returns the product and serial number strings that
+// follow the STORAGE_DEVICE_DESCRIPTOR in the property query output.
+func GetStorageDeviceStrings(handle windows.Handle) (vendor string, product string, serial string, err error) {
+	var propertyQuery STORAGE_PROPERTY_QUERY
+	var bytesReturned uint32
+	outBuffer := make([]uint8, 1024)
+
+	propertyQuery.PropertyId = StorageDeviceProperty
+	propertyQuery.QueryType = PropertyStandardQuery
+
+	inBuffer := (*[unsafe.Sizeof(propertyQuery)]byte)(unsafe.Pointer(&propertyQuery))
+
+	err = windows.DeviceIoControl(
+		handle,
+		IOCTL_STORAGE_QUERY_PROPERTY,
+		&inBuffer[0],
+		uint32(len(inBuffer)),
+		&outBuffer[0],
+		uint32(len(outBuffer)),
+		&bytesReturned,
+		nil,
+	)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	deviceDescriptor := (*STORAGE_DEVICE_DESCRIPTOR)(unsafe.Pointer(&outBuffer[0]))
+	cString := func(offset uint32) string {
+		if offset == 0 || offset >= bytesReturned {
+			return ""
+		}
+		end := bytes.IndexByte(outBuffer[offset:bytesReturned], 0)
+		if end < 0 {
+			end = int(bytesReturned - offset)
+		}
+		return strings.TrimSpace(string(outBuffer[offset : offset+uint32(end)]))
+	}
+	return cString(deviceDescriptor.VendorIdOffset),
+		cString(deviceDescriptor.ProductIdOffset),
+		cString(deviceDescriptor.SerialNumberOffset),
+		nil
+}
+
+func GetStorageAccessAlignment(
+	handle windows.Handle,
+) (alignmentDescriptor STORAGE_ACCESS_ALIGNMENT_DESCRIPTOR, err error) {
+	var propertyQuery STORAGE_PROPERTY_QUERY
+	var bytesReturned uint32
+	outBuffer := make([]uint8, unsafe.Sizeof(alignmentDescriptor))
+
+	propertyQuery.PropertyId = StorageAccessAlignmentProperty
+	propertyQuery.QueryType = PropertyStandardQuery
+
+	inBuffer := (*[unsafe.Sizeof(propertyQuery)]byte)(unsafe.Pointer(&propertyQuery))
+
+	err = windows.DeviceIoControl(
+		handle,
+		IOCTL_STORAGE_QUERY_PROPERTY,
+		&inBuffer[0],
+		uint32(len(inBuffer)),
+		&outBuffer[0],
+		uint32(len(outBuffer)),
+		&bytesReturned,
+		nil,
+	)
+
+	if err == nil {
+		alignmentDescriptor = *(*STORAGE_ACCESS_ALIGNMENT_DESCRIPTOR)(unsafe.Pointer(&outBuffer[0]))
+	}
+	return alignmentDescriptor, err
+}
+
+// IsDiskWritable reports false when the media is write-protected, whether by
+// its lock switch or by the readonly disk attribute.
+func IsDiskWritable(handle windows.Handle) bool {
+	var bytesReturned uint32
+
+	err := windows.DeviceIoControl(
+		handle,
+		IOCTL_DISK_IS_WRITABLE,
+		nil,
+		0,
+		nil,
+		0,
+		&bytesReturned,
+		nil,
+	)
+	return err != windows.ERROR_WRITE_PROTECT
+}
+
 func VerifyVolume(handle windows.Handle) bool {
 	var bytesReturned uint32
 
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const journalVersion = 1
+
+// Journal records how far a read or write got, so that a job interrupted by
+// a crash, a power loss or a cancellation can be resumed later instead of
+// starting again from sector 0. It is saved whenever the job has flushed its
+// target, and removed once the job has succeeded.
+type Journal struct {
+	Version  int       `json:"version"`
+	TaskType TaskType  `json:"task_type"`
+	Created  time.Time `json:"created"`
+
+	ImagePath string `json:"image_path"`
+	// ImageSize and ImageModTime are only recorded for writes, whose image
+	// must not change before the job is resumed.
+	ImageSize    int64        `json:"image_size,omitempty"`
+	ImageModTime time.Time    `json:"image_mod_time"`
+	DevicePath   string       `json:"device_path"`
+	Identity     DiskIdentity `json:"identity"`
+
+	SectorSize   int   `json:"sector_size"`
+	ChunkSectors int   `json:"chunk_sectors"`
+	TotalSectors int64 `json:"total_sectors"`
+	// Done is the number of sectors that have been flushed to the target.
+	Done int64 `json:"done"`
+	// HashState is the state of the SHA-256 of the data up to Done.
+	HashState []byte `json:"hash_state"`
+
+	MbrCheck    bool `json:"mbr_check"`
+	IgnoreSize  bool `json:"ignore_size"`
+	PadTail     bool `json:"pad_tail"`
+	ClearTail   bool `json:"clear_tail"`
+	SkipZeros   bool `json:"skip_zeros"`
+	AssumeBlank bool `json:"assume_blank"`
+	DeltaWrite  bool `json:"delta_write"`
+	// Partition is the partition the job works on, with index 0 for the
+	// whole drive.
+	Partition Partition `json:"partition"`
+	// Range is the part of the image written and where it goes on the drive.
+	Range RawRange `json:"range"`
+	// TranslateFrom is the sector size the partition table of the image was
+	// translated from, or 0 when it was written as is.
+	TranslateFrom int `json:"translate_from"`
+
+	path string
+}
+
+func journalDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(configDir, "utkirna", "journals")
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+func taskName(taskType TaskType) string {
+	if taskType == START_WRITE {
+		return "write"
+	} else if taskType == START_VERIFY {
+		return "verify"
+	} else if taskType == START_CLONE {
+		return "clone"
+	} else if taskType == START_WIPE {
+		return "wipe"
+	} else if taskType == START_FORMAT {
+		return "format"
+	} else if taskType == START_RESTORE {
+		return "restore"
+	} else if taskType == START_TABLE_BACKUP {
+		return "table backup"
+	} else if taskType == START_TABLE_RESTORE {
+		return "table restore"
+	} else if taskType == START_BOARD {
+		return "board"
+	} else if taskType == START_COMPOSE || taskType == START_COMPOSE_IMAGE {
+		return "compose"
+	}
+	return "read"
+}
+
+// NewJournal starts the journal of a job that has just been set up.
+func NewJournal(data *MainData, sectorSize int, totalSectors int64) (*Journal, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return nil, errors.Join(errors.New("NewJournal(): journalDir failed"), err)
+	}
+
+	journal := &Journal{
+		Version:      journalVersion,
+		TaskType:     data.taskType,
+		Created:      time.Now(),
+		ImagePath:    data.imagePath,
+		DevicePath:   data.selectedDrive,
+		Identity:     data.selectedIdentity,
+		SectorSize:   sectorSize,
+		ChunkSectors: 1024,
+		TotalSectors: totalSectors,
+		MbrCheck:     data.mbrCheck,
+		IgnoreSize:   data.ignoreSize,
+		PadTail:      data.padTail,
+		ClearTail:    data.clearTail,
+		SkipZeros:    data.skipZeros,
+		AssumeBlank:  data.assumeBlank,
+		DeltaWrite:   data.deltaWrite,
+		Partition:    data.partition,
+		Range:        data.rawRange,
+	}
+	if data.taskType == START_WRITE {
+		imageStat, err := os.Stat(data.imagePath)
+		if err != nil {
+			return nil, errors.Join(errors.New("NewJournal(): Stat failed"), err)
+		}
+		journal.ImageSize = imageStat.Size()
+		journal.ImageModTime = imageStat.ModTime()
+	}
+	journal.path = filepath.Join(dir, jobFileName(journal.Created, data.taskType, data.selectedDrive)+".json")
+	return journal, nil
+}
+
+// jobFileName names the journal or the report of a job. The drive is part of
+// it, since a duplicator starts jobs on several drives within a second.
+func jobFileName(started time.Time, taskType TaskType, devPath string) string {
+	name := started.Format("20060102-150405") + "-" + taskName(taskType)
+	device := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return -1
+	}, filepath.Base(devPath))
+	if len(device) > 0 {
+		name += "-" + device
+	}
+	return name
+}
+
+// LoadJournal reads the journal saved at path.
+func LoadJournal(path string) (*Journal, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Join(errors.New("LoadJournal(): ReadFile failed"), err)
+	}
+
+	journal := &Journal{path: path}
+	err = json.Unmarshal(content, journal)
+	if err != nil {
+		return nil, errors.Join(errors.New("LoadJournal(): Unmarshal failed"), err)
+	}
+	if journal.Version != journalVersion {
+		return nil, fmt.Errorf("LoadJournal(): unsupported journal version %d", journal.Version)
+	}
+	return journal, nil
+}
+
+// ListJournals returns the journals of all interrupted jobs, newest first.
+// Journals that cannot be read are skipped.
+func ListJournals() ([]*Journal, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	journals := []*Journal{}
+	for _, path := range paths {
+		journal, err := LoadJournal(path)
+		if err == nil {
+			journals = append(journals, journal)
+		}
+	}
+	sort.Slice(journals, func(i, j int) bool {
+		return journals[i].Created.After(journals[j].Created)
+	})
+	return journals, nil
+}
+
+func (journal *Journal) Path() string {
+	return journal.path
+}
+
+func (journal *Journal) String() string {
+	direction := "to"
+	if journal.TaskType == START_READ {
+		direction = "from"
+	}
+	return fmt.Sprintf(
+		"%s %s %s %s, %d%% (%s)",
+		taskName(journal.TaskType),
+		filepath.Base(journal.ImagePath),
+		direction,
+		journal.DevicePath,
+		journal.Done*100/max(journal.TotalSectors, 1),
+		journal.Created.Format("2006-01-02 15:04"),
+	)
+}
+
+// Save records that everything before sector done has been flushed, along
+// with the hash of the data up to there. The journal is replaced atomically,
+// so a crash while saving leaves the previous checkpoint in place.
+func (journal *Journal) Save(done int64, hashState []byte) error {
+	journal.Done = done
+	journal.HashState = hashState
+
+	content, err := json.MarshalIndent(journal, "", "\t")
+	if err != nil {
+		return errors.Join(errors.New("Journal.Save(): MarshalIndent failed"), err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(journal.path), ".journal-*")
+	if err != nil {
+		return errors.Join(errors.New("Journal.Save(): CreateTemp failed"), err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err != nil || closeErr != nil {
+		return errors.Join(errors.New("Journal.Save(): Write failed"), err, closeErr)
+	}
+	return os.Rename(tmpFile.Name(), journal.path)
+}
+
+func (journal *Journal) Remove() error {
+	err := os.Remove(journal.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// hashState captures the state of a running hash so that it can be saved in
+// a journal or restored after the drive was reinserted.
+func hashState(sum hash.Hash) []byte {
+	state, _ := sum.(encoding.BinaryMarshaler).MarshalBinary()
+	return state
+}
+
+func restoreHash(sum hash.Hash, state []byte) error {
+	sum.Reset()
+	if len(state) == 0 {
+		return nil
+	}
+	return sum.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+}
+
+// openJournal returns the journal of a job and the hash of the data it has
+// handled so far: the journal being resumed, or a new one. A new job goes on
+// without a journal when none can be created.
+func openJournal(data *MainData, sectorSize int, totalSectors int64) (*Journal, hash.Hash, error) {
+	sum := sha256.New()
+	if data.taskType == START_CLONE {
+		// A clone has no file to check against when it is resumed.
+		return nil, sum, nil
+	}
+	if data.resume == nil {
+		journal, err := NewJournal(data, sectorSize, totalSectors)
+		if err != nil {
+			log.Printf("openJournal(): the job cannot be resumed: %s", err)
+		}
+		return journal, sum, nil
+	}
+
+	if data.resume.SectorSize != sectorSize || data.resume.TotalSectors != totalSectors {
+		return nil, nil, fmt.Errorf(
+			"The drive now has %d sectors of %d bytes to process, the interrupted job had %d of %d bytes",
+			totalSectors,
+			sectorSize,
+			data.resume.TotalSectors,
+			data.resume.SectorSize,
+		)
+	}
+	err := restoreHash(sum, data.resume.HashState)
+	if err != nil {
+		return nil, nil, errors.Join(errors.New("openJournal(): restoreHash failed"), err)
+	}
+	return data.resume, sum, nil
+}
+
+// saveJournal checkpoints a job. A journal that cannot be saved only costs
+// the ability to resume, so the job goes on.
+func saveJournal(journal *Journal, done int64, sum hash.Hash) {
+	if journal == nil {
+		return
+	}
+	err := journal.Save(done, hashState(sum))
+	if err != nil {
+		log.Printf("saveJournal(): %s", err)
+	}
+}
+
+func removeJournal(journal *Journal) {
+	if journal == nil {
+		return
+	}
+	err := journal.Remove()
+	if err != nil {
+		log.Printf("removeJournal(): %s", err)
+	}
+}
+
+// PrepareResume checks that the drive and the image of an interrupted job
+// are still the ones it was working with, and sets data up to go on with it.
+func PrepareResume(data *MainData, journal *Journal) error {
+	disk, ok := findDisk(journal.Identity)
+	if !ok {
+		return fmt.Errorf(
+			"The drive of the interrupted job is not connected.\nExpected: %s",
+			journal.Identity,
+		)
+	}
+
+	imageStat, err := os.Stat(journal.ImagePath)
+	if err != nil {
+		return errors.Join(errors.New("PrepareResume(): Stat failed"), err)
+	}
+	if journal.TaskType == START_WRITE {
+		if imageStat.Size() != journal.ImageSize || !imageStat.ModTime().Equal(journal.ImageModTime) {
+			return fmt.Errorf("%s has changed since the job was interrupted", journal.ImagePath)
+		}
+	} else if imageStat.Size() < journal.Done*int64(journal.SectorSize) {
+		return fmt.Errorf("%s is shorter than the part already read", journal.ImagePath)
+	}
+
+	data.taskType = journal.TaskType
+	data.selectedDrive = disk.Path
+	data.selectedDisk = disk
+	data.selectedIdentity = journal.Identity
+	data.imagePath = journal.ImagePath
+	data.mbrCheck = journal.MbrCheck
+	data.ignoreSize = journal.IgnoreSize
+	data.padTail = journal.PadTail
+	data.clearTail = journal.ClearTail
+	data.skipZeros = journal.SkipZeros
+	data.assumeBlank = journal.AssumeBlank
+	data.deltaWrite = journal.DeltaWrite
+	data.partition = journal.Partition
+	data.rawRange = journal.Range
+	data.resume = journal
+	return nil
+}
@@ -1,8 +1,18 @@
 package main
 
+import "os"
+
 func main() {
+	options, args, err := ParseArgs(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+	if code, ok := RunCommand(options, args); ok {
+		os.Exit(code)
+	}
+
 	if isPermAvailable() {
-		StartGui()
+		StartGui(options)
 	} else {
 		HandleStartError()
 	}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// multiChunkSize is how much of the image is handed to the drives of a
+// multi-target write at a time. It is a multiple of every sector size.
+const multiChunkSize = 1 << 20
+
+// MultiFrontend is a Frontend that also shows one row per drive of a
+// multi-target write.
+type MultiFrontend interface {
+	Frontend
+	SetTargetStatus(target int, status string)
+	SetTargetProgress(target int, done int64, total int64)
+}
+
+// sharedChunk is a chunk of the image handed to every drive. The last drive
+// done with it returns its buffer to the pool.
+type sharedChunk struct {
+	data   []byte
+	offset int64
+	size   int64
+	refs   atomic.Int32
+	pool   *BufferPool
+}
+
+func (chunk *sharedChunk) release() {
+	if chunk.refs.Add(-1) == 0 {
+		chunk.pool.Put(chunk.data)
+	}
+}
+
+// multiTarget is one drive of a multi-target write. It fails on its own,
+// without stopping the others.
+type multiTarget struct {
+	index   int
+	data    MainData
+	handles Handles
+	opened  bool
+	layout  *imageLayout
+	chunks  chan *sharedChunk
+	err     error
+}
+
+func (target *multiTarget) open() error {
+	err := CheckDiskPolicy(target.data.selectedDisk, START_WRITE)
+	if err != nil {
+		return err
+	}
+	err = GetRequiredHandles(
+		&target.handles,
+		START_WRITE,
+		target.data.selectedDrive,
+		target.data.selectedIdentity,
+		target.data.imagePath,
+	)
+	if err != nil {
+		return err
+	}
+	target.opened = true
+
+	target.layout, err = getImageLayout(&target.data, target.handles)
+	if err != nil {
+		return err
+	}
+	imageSector := DetectTableSectorSize(target.data.imagePath, target.layout.head, target.layout.imageSize)
+	if imageSector != 0 && imageSector != target.layout.diskSector {
+		return fmt.Errorf(
+			"The partition table of the image was built for %d-byte sectors, the drive uses %d-byte sectors.\n"+
+				"Write this drive on its own to translate the table.",
+			imageSector,
+			target.layout.diskSector,
+		)
+	}
+	return nil
+}
+
+func (target *multiTarget) fail(ui MultiFrontend, err error) {
+	target.err = err
+	ui.SetTargetStatus(target.index, "Failed: "+strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+// run writes or verifies the chunks handed to the drive until there are no
+// more. After a failure it only releases them.
+func (target *multiTarget) run(ui MultiFrontend, verify bool) {
+	layout := target.layout
+	diskData := alignedBuffer(multiChunkSize, layout.alignment)
+	chunkCount := 0
+
+	for chunk := range target.chunks {
+		if target.err == nil && chunk.offset < layout.imageSize {
+			size := min(chunk.size, layout.imageSize-chunk.offset)
+			sector := chunk.offset / int64(layout.diskSector)
+			// The last sector of the image is padded with the zeros that
+			// follow the image data in the chunk.
+			length := roundUp(int(size), layout.diskSector)
+
+			var err error
+			if verify {
+				diskChunk := diskData[:length]
+				err = readDiskChunk(&target.data, target.handles, diskChunk, sector, layout.diskSector, layout.alignment)
+				if err == nil && !bytes.Equal(diskChunk[:size], chunk.data[:size]) {
+					err = fmt.Errorf("Verification failed at sector: %d", sector)
+				}
+			} else {
+				err = writeDiskChunk(&target.data, target.handles, chunk.data[:length], sector, layout.diskSector, layout.alignment)
+				chunkCount++
+				if err == nil && chunkCount%16 == 0 {
+					err = SyncDisk(target.handles)
+				}
+			}
+
+			if err != nil {
+				target.fail(ui, err)
+			} else {
+				ui.SetTargetProgress(target.index, chunk.offset+size, layout.imageSize)
+			}
+		}
+		chunk.release()
+	}
+}
+
+// fanOut reads the image once and hands every chunk to the drives still
+// going, which write or verify it concurrently. The slowest drive sets the
+// pace. It returns false when the job was cancelled or the image could not be
+// read.
+func fanOut(
+	data *MainData,
+	ui MultiFrontend,
+	image *os.File,
+	imageSize int64,
+	pool *BufferPool,
+	targets []*multiTarget,
+	verify bool,
+) bool {
+	var wg sync.WaitGroup
+	active := []*multiTarget{}
+	for _, target := range targets {
+		if target.err != nil {
+			continue
+		}
+		target.chunks = make(chan *sharedChunk, 4)
+		active = append(active, target)
+		wg.Add(1)
+		go func(target *multiTarget) {
+			defer wg.Done()
+			target.run(ui, verify)
+		}(target)
+	}
+	defer wg.Wait()
+	defer func() {
+		for _, target := range active {
+			close(target.chunks)
+		}
+	}()
+	if len(active) == 0 {
+		return true
+	}
+
+	lastOffset := int64(0)
+	updateTimer := time.Now()
+	for offset := int64(0); offset < imageSize; offset += multiChunkSize {
+		select {
+		case <-data.bQuitTask:
+			return false
+		default:
+			buf := pool.Get()
+			size := min(multiChunkSize, imageSize-offset)
+			_, err := image.ReadAt(buf[:size], offset)
+			if err != nil && err != io.EOF {
+				pool.Put(buf)
+				ui.HandleError(data, errors.Join(errors.New("fanOut(): ReadAt failed"), err))
+				return false
+			}
+			clear(buf[size:])
+
+			chunk := &sharedChunk{data: buf, offset: offset, size: size, pool: pool}
+			chunk.refs.Store(int32(len(active)))
+			for _, target := range active {
+				target.chunks <- chunk
+			}
+
+			ui.SetProgress(offset+size, imageSize)
+			if updateSpeed(ui, 1, offset-lastOffset, updateTimer) {
+				lastOffset = offset
+				updateTimer = time.Now()
+			}
+		}
+	}
+	return true
+}
+
+// multiWriteDropped lists the options set in data that only a single write
+// offers, in the words the user is told about them.
+func multiWriteDropped(data MainData) []string {
+	dropped := []string{}
+	if data.snapshot {
+		dropped = append(dropped, "No snapshot is saved, so the write cannot be undone.")
+	}
+	if data.deltaWrite {
+		dropped = append(dropped, "Every chunk is written, not only the ones that differ.")
+	}
+	if data.skipZeros || data.assumeBlank {
+		dropped = append(dropped, "Chunks of zeros are written too.")
+	}
+	if data.clearTail {
+		dropped = append(dropped, "The rest of the drives after the image is left as it is.")
+	}
+	return dropped
+}
+
+// StartMultiWrite writes the image of data to several drives at once and
+// verifies each of them. The image is read only once per pass. Unlike a
+// single write, the last partial sector is always padded with zeros, a
+// partition table is never translated and the options multiWriteDropped
+// lists are turned off.
+func StartMultiWrite(data *MainData, ui MultiFrontend, disks []Disk, identities []DiskIdentity) {
+	dropped := multiWriteDropped(*data)
+	data.snapshot = false
+	data.deltaWrite = false
+	data.skipZeros = false
+	data.assumeBlank = false
+	data.clearTail = false
+	data.padTail = true
+	data.taskType = START_WRITE
+	data.report = NewJobReport(data)
+	for _, note := range dropped {
+		data.report.AddNote("%s", note)
+	}
+	data.bQuitTimer = StartTimer(time.Now(), ui)
+
+	targets := []*multiTarget{}
+	for i, disk := range disks {
+		target := &multiTarget{index: i, data: *data}
+		target.data.selectedDrive = disk.Path
+		target.data.selectedDisk = disk
+		target.data.selectedIdentity = identities[i]
+		targets = append(targets, target)
+
+		ui.SetTargetStatus(i, "Opening...")
+		err := target.open()
+		if err != nil {
+			target.fail(ui, err)
+		} else {
+			ui.SetTargetStatus(i, "Writing...")
+		}
+	}
+
+	cleanUpTargets := func() {
+		for _, target := range targets {
+			if target.opened {
+				CloseRequiredHandles(target.handles)
+			}
+		}
+		finishJob(data, ui)
+	}
+
+	image, err := os.Open(data.imagePath)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("StartMultiWrite(): Open failed"), err))
+		cleanUpTargets()
+		return
+	}
+	imageStat, err := image.Stat()
+	if err != nil {
+		image.Close()
+		ui.HandleError(data, errors.Join(errors.New("StartMultiWrite(): Stat failed"), err))
+		cleanUpTargets()
+		return
+	}
+
+	alignment := ioAlignment
+	for _, target := range targets {
+		if target.err == nil {
+			alignment = max(alignment, target.layout.alignment)
+		}
+	}
+	pool := NewBufferPool(multiChunkSize, alignment)
+
+	data.bQuitTask = make(chan struct{}, 1)
+
+	stop := func() {
+		for _, target := range targets {
+			if target.err == nil {
+				ui.SetTargetStatus(target.index, "Stopped")
+			}
+		}
+	}
+
+	go func() {
+		defer cleanUpTargets()
+		defer image.Close()
+
+		if !fanOut(data, ui, image, imageStat.Size(), pool, targets, false) {
+			stop()
+			return
+		}
+
+		ui.SetStatus("Verifying...")
+		for _, target := range targets {
+			if target.err != nil {
+				continue
+			}
+			err := FlushDiskCache(target.handles)
+			if err != nil {
+				target.fail(ui, err)
+			} else {
+				ui.SetTargetStatus(target.index, "Verifying...")
+			}
+		}
+		if !fanOut(data, ui, image, imageStat.Size(), pool, targets, true) {
+			stop()
+			return
+		}
+
+		failed := []string{}
+		for _, target := range targets {
+			if target.err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", target.data.selectedDrive, target.err))
+				data.report.AddNote("%s: failed: %s", target.data.selectedDrive, target.err)
+			} else {
+				ui.SetTargetStatus(target.index, "Verified")
+				data.report.AddNote("%s: verified", target.data.selectedDrive)
+			}
+		}
+		if len(failed) == 0 {
+			ui.HandleSuccess(fmt.Sprintf("All %d drives were written and verified.", len(targets)))
+		} else {
+			ui.HandleError(data, fmt.Errorf(
+				"%d of %d drives failed:\n%s",
+				len(failed),
+				len(targets),
+				strings.Join(failed, "\n"),
+			))
+		}
+	}()
+}
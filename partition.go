@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+type TableType int
+
+const (
+	TABLE_NONE TableType = iota
+	TABLE_MBR
+	TABLE_GPT
+)
+
+// tableHeadSize is how much of the start of a disk or image is read to find
+// its partition table. It covers LBA 0 to 33 with 4096-byte sectors, which is
+// where a GPT and its default 128-entry array end.
+const tableHeadSize = 1 << 20
+
+const gptSignature = "EFI PART"
+
+type Partition struct {
+	Index      int
+	Type       string
+	Name       string
+	StartLBA   int64
+	NumSectors int64
+	// Extended is set for the extended partition of an MBR, which only holds
+	// the EBRs and the logical partitions and is never a target itself.
+	Extended bool
+}
+
+type PartitionTable struct {
+	Type       TableType
+	SectorSize int
+	Partitions []Partition
+	// Areas are the parts of the drive the table itself takes.
+	Areas []TableArea
+}
+
+// TableArea is a part of a drive taken by a structure of its partition table.
+type TableArea struct {
+	Name string
+	Extent
+}
+
+// Patch replaces Data at byte Offset of the data written to a device.
+type Patch struct {
+	Offset int64
+	Data   []byte
+}
+
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC32    uint32
+	Reserved       uint32
+	MyLBA          uint64
+	AlternateLBA   uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	NumEntries     uint32
+	EntrySize      uint32
+	EntriesCRC32   uint32
+}
+
+const gptHeaderSize = 92
+
+func isExtendedType(partType byte) bool {
+	return partType == 0x05 || partType == 0x0F || partType == 0x85
+}
+
+func readGPTHeader(head []byte, sectorSize int) (gptHeader, bool) {
+	var header gptHeader
+
+	if len(head) < sectorSize+gptHeaderSize {
+		return header, false
+	}
+	if string(head[sectorSize:sectorSize+8]) != gptSignature {
+		return header, false
+	}
+	binary.Read(bytes.NewReader(head[sectorSize:]), binary.LittleEndian, &header)
+	return header, true
+}
+
+func (header gptHeader) marshal() []byte {
+	var buf bytes.Buffer
+
+	header.HeaderCRC32 = 0
+	binary.Write(&buf, binary.LittleEndian, header)
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[16:], crc32.ChecksumIEEE(data))
+	return data
+}
+
+// gptEntries returns the raw partition entry array a header points at.
+func gptEntries(head []byte, header gptHeader, sectorSize int) ([]byte, error) {
+	start := int64(header.EntriesLBA) * int64(sectorSize)
+	end := start + int64(header.NumEntries)*int64(header.EntrySize)
+	if header.EntrySize < 128 || end > int64(len(head)) {
+		return nil, errors.New("gptEntries(): partition entries are out of range")
+	}
+	return head[start:end], nil
+}
+
+func ParsePartitionTable(head []byte, sectorSize int) (*PartitionTable, error) {
+	table := &PartitionTable{Type: TABLE_NONE, SectorSize: sectorSize}
+
+	if len(head) < 512 || head[510] != 0x55 || head[511] != 0xAA {
+		return table, nil
+	}
+
+	if header, ok := readGPTHeader(head, sectorSize); ok {
+		entries, err := gptEntries(head, header, sectorSize)
+		if err != nil {
+			return nil, err
+		}
+		if crc32.ChecksumIEEE(entries) != header.EntriesCRC32 {
+			return nil, errors.New("ParsePartitionTable(): GPT partition entries CRC mismatch")
+		}
+
+		table.Type = TABLE_GPT
+		size := int64(sectorSize)
+		entriesSize := header.entriesSectors(sectorSize) * size
+		table.Areas = []TableArea{
+			{"protective MBR and GPT header", Extent{0, 2 * size}},
+			{"GPT partition entries", Extent{int64(header.EntriesLBA) * size, entriesSize}},
+		}
+		// The backup entries usually sit right before the backup header.
+		backup := int64(header.AlternateLBA) * size
+		if backup > entriesSize {
+			table.Areas = append(table.Areas, TableArea{"backup GPT", Extent{backup - entriesSize, entriesSize + size}})
+		}
+		for i := 0; i < int(header.NumEntries); i++ {
+			entry := entries[i*int(header.EntrySize):]
+			if bytes.Equal(entry[:16], make([]byte, 16)) {
+				continue
+			}
+			startLBA := int64(binary.LittleEndian.Uint64(entry[32:]))
+			endLBA := int64(binary.LittleEndian.Uint64(entry[40:]))
+			table.Partitions = append(table.Partitions, Partition{
+				Index:      i + 1,
+				Type:       guidString(entry[:16]),
+				Name:       utf16String(entry[56:128]),
+				StartLBA:   startLBA,
+				NumSectors: endLBA - startLBA + 1,
+			})
+		}
+		return table, nil
+	}
+
+	table.Type = TABLE_MBR
+	table.Areas = []TableArea{{"MBR", Extent{0, int64(sectorSize)}}}
+	for i := 0; i < 4; i++ {
+		entry := head[0x1BE+16*i:]
+		if entry[4] == 0 {
+			continue
+		}
+		table.Partitions = append(table.Partitions, Partition{
+			Index:      i + 1,
+			Type:       fmt.Sprintf("0x%02X", entry[4]),
+			StartLBA:   int64(binary.LittleEndian.Uint32(entry[8:])),
+			NumSectors: int64(binary.LittleEndian.Uint32(entry[12:])),
+			Extended:   isExtendedType(entry[4]),
+		})
+	}
+	return table, nil
+}
+
+// addLogicalPartitions follows the EBR chain of the extended partition of an
+// MBR, which lies beyond the head of the drive. It adds the logical
+// partitions, numbered from 5 on as Linux does, and the EBRs to the areas of
+// the table. readSector reads one sector of the drive.
+func (table *PartitionTable) addLogicalPartitions(readSector func(lba int64) ([]byte, error)) error {
+	size := int64(table.SectorSize)
+	index := 5
+	for _, extended := range table.Partitions {
+		if !extended.Extended {
+			continue
+		}
+		visited := map[int64]bool{}
+		for lba := extended.StartLBA; ; {
+			if visited[lba] || len(visited) >= maxEBRs {
+				return fmt.Errorf("The EBR chain of partition %d loops or is too long.", extended.Index)
+			}
+			visited[lba] = true
+
+			ebr, err := readSector(lba)
+			if err != nil {
+				return errors.Join(errors.New("addLogicalPartitions(): readSector failed"), err)
+			}
+			if len(ebr) < 512 || ebr[510] != 0x55 || ebr[511] != 0xAA {
+				return fmt.Errorf("The EBR at sector %d has no boot signature.", lba)
+			}
+			table.Areas = append(table.Areas, TableArea{fmt.Sprintf("EBR %d", len(visited)), Extent{lba * size, size}})
+
+			entry := ebr[0x1BE:]
+			if entry[4] != 0 {
+				table.Partitions = append(table.Partitions, Partition{
+					Index:      index,
+					Type:       fmt.Sprintf("0x%02X", entry[4]),
+					StartLBA:   lba + int64(binary.LittleEndian.Uint32(entry[8:])),
+					NumSectors: int64(binary.LittleEndian.Uint32(entry[12:])),
+				})
+				index++
+			}
+			next := ebr[0x1CE:]
+			if next[4] == 0 {
+				break
+			}
+			lba = extended.StartLBA + int64(binary.LittleEndian.Uint32(next[8:]))
+		}
+	}
+	return nil
+}
+
+// EndLBA is the first sector past the last partition of the table.
+func (table *PartitionTable) EndLBA() int64 {
+	end := int64(0)
+	for _, partition := range table.Partitions {
+		end = max(end, partition.StartLBA+partition.NumSectors)
+	}
+	return end
+}
+
+// Describe names a partition of the table for the user.
+func (table *PartitionTable) Describe(partition Partition) string {
+	label := fmt.Sprintf("Partition %d", partition.Index)
+	if len(partition.Name) > 0 {
+		label += " \"" + partition.Name + "\""
+	} else if table.Type == TABLE_MBR {
+		label += " (" + partition.Type + ")"
+	}
+	return fmt.Sprintf(
+		"%s, %s at sector %d",
+		label,
+		fmtBytes(partition.NumSectors*int64(table.SectorSize)),
+		partition.StartLBA,
+	)
+}
+
+// ListPartitions reads the partition table of a drive, so that one of its
+// partitions can be selected for a job. The sector size is taken from the
+// table; the job checks the partition again with the one of the drive.
+func ListPartitions(disk Disk, identity DiskIdentity) (*PartitionTable, error) {
+	head, err := ReadImageHead(SourceDevicePath(disk, identity))
+	if err != nil {
+		return nil, errors.Join(errors.New("ListPartitions(): ReadImageHead failed"), err)
+	}
+	sectorSize := DetectTableSectorSize(SourceDevicePath(disk, identity), head, identity.Size)
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+	table, err := ParsePartitionTable(head, sectorSize)
+	if err != nil || table.Type != TABLE_MBR {
+		return table, err
+	}
+
+	device, err := os.Open(SourceDevicePath(disk, identity))
+	if err != nil {
+		return nil, errors.Join(errors.New("ListPartitions(): Open failed"), err)
+	}
+	defer device.Close()
+	err = table.addLogicalPartitions(func(lba int64) ([]byte, error) {
+		sector := make([]byte, sectorSize)
+		_, err := device.ReadAt(sector, lba*int64(sectorSize))
+		return sector, err
+	})
+	if err != nil {
+		return nil, errors.Join(errors.New("ListPartitions(): addLogicalPartitions failed"), err)
+	}
+	return table, nil
+}
+
+func guidString(guid []byte) string {
+	return fmt.Sprintf(
+		"%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(guid[0:]),
+		binary.LittleEndian.Uint16(guid[4:]),
+		binary.LittleEndian.Uint16(guid[6:]),
+		guid[8:10],
+		guid[10:16],
+	)
+}
+
+func utf16String(data []byte) string {
+	runes := []rune{}
+	for i := 0; i+1 < len(data); i += 2 {
+		r := binary.LittleEndian.Uint16(data[i:])
+		if r == 0 {
+			break
+		}
+		runes = append(runes, rune(r))
+	}
+	return string(runes)
+}
+
+// ReadImageHead returns up to tableHeadSize bytes from the start of a file.
+func ReadImageHead(imagePath string) ([]byte, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, tableHeadSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// DetectTableSectorSize guesses which sector size the partition table at the
+// start of the image at path was built for. A GPT header gives it away by
+// the LBA it records for itself. An MBR only holds LBAs, so the volumes found
+// where each reading of them puts the partitions decide, and the image size
+// is only a hint when none of them tells. It returns 0 when there is no way
+// to tell.
+func DetectTableSectorSize(path string, head []byte, imageSize int64) int {
+	for _, sectorSize := range []int{512, 4096} {
+		if len(head) < 2*sectorSize {
+			continue
+		}
+		header, err := checkGPTHeader(head[sectorSize : 2*sectorSize])
+		if err == nil && header.MyLBA == 1 {
+			return sectorSize
+		}
+	}
+
+	table, err := ParsePartitionTable(head, 512)
+	if err != nil || table.Type != TABLE_MBR || len(table.Partitions) == 0 {
+		return 0
+	}
+	for _, partition := range table.Partitions {
+		if partition.Type == "0xEE" {
+			return 0
+		}
+	}
+
+	image, err := os.Open(path)
+	if err == nil {
+		defer image.Close()
+		matches := map[int]int{}
+		for _, sectorSize := range []int{512, 4096} {
+			for _, partition := range table.Partitions {
+				if volumeMatches(image, partition.StartLBA*int64(sectorSize), sectorSize) {
+					matches[sectorSize]++
+				}
+			}
+		}
+		if matches[512] > matches[4096] {
+			return 512
+		} else if matches[4096] > matches[512] {
+			return 4096
+		}
+	}
+
+	// An image made for 4096-byte sectors usually ends where its last
+	// partition does. A sparse or trimmed image made for 512-byte sectors
+	// is the norm otherwise.
+	end := table.EndLBA() * 4096
+	if end <= imageSize && imageSize-end < partitionAlignment {
+		return 4096
+	}
+	return 512
+}
+
+// volumeMatches tells whether a volume made for sectorSize-byte sectors
+// starts at byte offset of image. FAT, NTFS and exFAT record their sector
+// size, while an ext superblock at least shows that a partition starts there.
+func volumeMatches(image io.ReaderAt, offset int64, sectorSize int) bool {
+	boot := make([]byte, 2048)
+	_, err := image.ReadAt(boot, offset)
+	if err != nil {
+		return false
+	}
+	if string(boot[3:11]) == "EXFAT   " {
+		return 1<<boot[108] == sectorSize
+	}
+	if boot[510] == 0x55 && boot[511] == 0xAA && binary.LittleEndian.Uint16(boot[11:]) == uint16(sectorSize) {
+		return true
+	}
+	return binary.LittleEndian.Uint16(boot[1024+56:]) == 0xEF53
+}
+
+func scaleLBA(lba int64, from int, to int) (int64, error) {
+	if (lba*int64(from))%int64(to) != 0 {
+		return 0, fmt.Errorf("LBA %d is not aligned to %d-byte sectors", lba, to)
+	}
+	return lba * int64(from) / int64(to), nil
+}
+
+// TranslatePartitionTable rewrites the partition table in head, built for
+// from-byte sectors, for a device with to-byte sectors and diskNumSectors
+// sectors. Byte offsets of partitions do not change, so the partition data of
+// the image is written untouched and only the returned patches differ from
+// the image. Filesystems that record their own sector size may still need to
+// support the new one.
+func TranslatePartitionTable(head []byte, from int, to int, diskNumSectors int64) ([]Patch, error) {
+	if header, ok := readGPTHeader(head, from); ok {
+		return translateGPT(head, header, from, to, diskNumSectors)
+	}
+	if len(head) < 512 {
+		return nil, errors.New("TranslatePartitionTable(): image is too small")
+	}
+
+	mbr := make([]byte, 512)
+	copy(mbr, head)
+	for i := 0; i < 4; i++ {
+		entry := mbr[0x1BE+16*i:]
+		if entry[4] == 0 {
+			continue
+		}
+		if isExtendedType(entry[4]) {
+			return nil, errors.New("TranslatePartitionTable(): extended partitions cannot be translated")
+		}
+		for _, field := range []int{8, 12} {
+			lba, err := scaleLBA(int64(binary.LittleEndian.Uint32(entry[field:])), from, to)
+			if err != nil {
+				return nil, errors.Join(errors.New("TranslatePartitionTable(): scaleLBA failed"), err)
+			}
+			if lba > 0xFFFFFFFF {
+				return nil, fmt.Errorf(
+					"TranslatePartitionTable(): LBA %d does not fit an MBR with %d-byte sectors",
+					lba,
+					to,
+				)
+			}
+			binary.LittleEndian.PutUint32(entry[field:], uint32(lba))
+		}
+	}
+	return []Patch{{Offset: 0, Data: mbr}}, nil
+}
+
+func translateGPT(head []byte, header gptHeader, from int, to int, diskNumSectors int64) ([]Patch, error) {
+	oldEntries, err := gptEntries(head, header, from)
+	if err != nil {
+		return nil, err
+	}
+	entries := bytes.Clone(oldEntries)
+
+	entriesSectors := int64(roundUp(len(entries), to) / to)
+	firstUsable := 2 + entriesSectors
+	lastUsable := diskNumSectors - 2 - entriesSectors
+
+	for i := 0; i < int(header.NumEntries); i++ {
+		entry := entries[i*int(header.EntrySize):]
+		if bytes.Equal(entry[:16], make([]byte, 16)) {
+			continue
+		}
+		startLBA, err := scaleLBA(int64(binary.LittleEndian.Uint64(entry[32:])), from, to)
+		if err != nil {
+			return nil, errors.Join(errors.New("translateGPT(): scaleLBA failed"), err)
+		}
+		endLBA, err := scaleLBA(int64(binary.LittleEndian.Uint64(entry[40:]))+1, from, to)
+		if err != nil {
+			return nil, errors.Join(errors.New("translateGPT(): scaleLBA failed"), err)
+		}
+		endLBA--
+		if startLBA < firstUsable || endLBA > lastUsable {
+			return nil, fmt.Errorf("translateGPT(): partition %d does not fit the translated table", i+1)
+		}
+		binary.LittleEndian.PutUint64(entry[32:], uint64(startLBA))
+		binary.LittleEndian.PutUint64(entry[40:], uint64(endLBA))
+	}
+
+	header.EntriesCRC32 = crc32.ChecksumIEEE(entries)
+	header.FirstUsableLBA = uint64(firstUsable)
+	header.LastUsableLBA = uint64(lastUsable)
+
+	primary := header
+	primary.MyLBA = 1
+	primary.AlternateLBA = uint64(diskNumSectors - 1)
+	primary.EntriesLBA = 2
+
+	backup := header
+	backup.MyLBA = uint64(diskNumSectors - 1)
+	backup.AlternateLBA = 1
+	backup.EntriesLBA = uint64(diskNumSectors - 1 - entriesSectors)
+
+	pmbr := make([]byte, 512)
+	copy(pmbr, head)
+	binary.LittleEndian.PutUint32(pmbr[0x1BE+12:], uint32(min(diskNumSectors-1, 0xFFFFFFFF)))
+
+	// The old header and entries are cleared first, including the backup
+	// copy when it lies within the image, so no stale GPT is left behind.
+	oldTableEnd := (int64(header.EntriesLBA)*int64(from) + int64(len(oldEntries)))
+	patches := []Patch{
+		{Offset: 0, Data: make([]byte, max(oldTableEnd, (2+entriesSectors)*int64(to)))},
+		{Offset: int64(header.AlternateLBA) * int64(from), Data: make([]byte, from)},
+	}
+	copy(patches[0].Data, pmbr)
+
+	primarySector := make([]byte, to)
+	copy(primarySector, primary.marshal())
+	backupSector := make([]byte, to)
+	copy(backupSector, backup.marshal())
+	paddedEntries := make([]byte, entriesSectors*int64(to))
+	copy(paddedEntries, entries)
+
+	return append(patches,
+		Patch{Offset: int64(to), Data: primarySector},
+		Patch{Offset: 2 * int64(to), Data: paddedEntries},
+		Patch{Offset: int64(backup.EntriesLBA) * int64(to), Data: paddedEntries},
+		Patch{Offset: int64(backup.MyLBA) * int64(to), Data: backupSector},
+	), nil
+}
+
+// applyPatches overlays every patch that overlaps the chunk of data that
+// starts at byte offset chunkOffset.
+func applyPatches(chunk []byte, chunkOffset int64, patches []Patch) {
+	for _, patch := range patches {
+		start := max(patch.Offset, chunkOffset)
+		end := min(patch.Offset+int64(len(patch.Data)), chunkOffset+int64(len(chunk)))
+		if start >= end {
+			continue
+		}
+		copy(chunk[start-chunkOffset:end-chunkOffset], patch.Data[start-patch.Offset:end-patch.Offset])
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mbrImage writes an image of size bytes with an MBR holding one partition,
+// and a FAT boot sector made for volumeSector-byte sectors at volumeOffset
+// unless that is 0.
+func mbrImage(t *testing.T, size int64, start uint32, numSectors uint32, volumeOffset int64, volumeSector int) (string, []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image")
+	image, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+
+	mbr := make([]byte, 512)
+	putMBREntry(mbr[0x1BE:], 0x0C, int64(start), int64(numSectors), false)
+	mbr[510], mbr[511] = 0x55, 0xAA
+	_, err = image.WriteAt(mbr, 0)
+	if err == nil && volumeOffset > 0 {
+		boot := make([]byte, 512)
+		binary.LittleEndian.PutUint16(boot[11:], uint16(volumeSector))
+		boot[510], boot[511] = 0x55, 0xAA
+		_, err = image.WriteAt(boot, volumeOffset)
+	}
+	if err == nil {
+		err = image.Truncate(size)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ReadImageHead(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, head
+}
+
+func TestDetectTableSectorSize(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int64
+		start        uint32
+		numSectors   uint32
+		volumeOffset int64
+		volumeSector int
+		want         int
+	}{
+		// Partitions that take up only a small part of the image made the
+		// size heuristic take these for 4096-byte tables.
+		{"sparse 512", 64 << 20, 2048, 2048, 1 << 20, 512, 512},
+		{"sparse 512 without a volume", 64 << 20, 2048, 2048, 0, 0, 512},
+		{"trimmed 512", 1 << 20, 2048, 2048, 0, 0, 512},
+		{"4096", 2 << 20, 256, 256, 1 << 20, 4096, 4096},
+		{"4096 without a volume", 2 << 20, 256, 256, 0, 0, 4096},
+	}
+	for _, test := range tests {
+		path, head := mbrImage(t, test.size, test.start, test.numSectors, test.volumeOffset, test.volumeSector)
+		got := DetectTableSectorSize(path, head, test.size)
+		if got != test.want {
+			t.Errorf("%s: DetectTableSectorSize() = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTranslateMBRTooLarge(t *testing.T) {
+	mbr := make([]byte, 512)
+	putMBREntry(mbr[0x1BE:], 0x83, 256, 0x20000000, false)
+	mbr[510], mbr[511] = 0x55, 0xAA
+
+	_, err := TranslatePartitionTable(mbr, 4096, 512, 1<<40)
+	if err == nil {
+		t.Fatal("an LBA past 32 bits was translated")
+	}
+
+	putMBREntry(mbr[0x1BE:], 0x83, 256, 1024, false)
+	patches, err := TranslatePartitionTable(mbr, 4096, 512, 1<<40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := patches[0].Data[0x1BE:]
+	if binary.LittleEndian.Uint32(entry[8:]) != 2048 || binary.LittleEndian.Uint32(entry[12:]) != 8192 {
+		t.Fatalf("wrong translated entry % x", entry[:16])
+	}
+}
+
+// testMBR returns an MBR holding one partition.
+func testMBR(partType byte, start uint32, numSectors uint32) []byte {
+	mbr := make([]byte, 512)
+	entry := mbr[0x1BE:]
+	entry[4] = partType
+	binary.LittleEndian.PutUint32(entry[8:], start)
+	binary.LittleEndian.PutUint32(entry[12:], numSectors)
+	mbr[510], mbr[511] = 0x55, 0xAA
+	return mbr
+}
+
+// testGPT returns the head of an image with a GPT built for sectorSize-byte
+// sectors, holding one partition from start to end.
+func testGPT(sectorSize int, numSectors int64, start uint64, end uint64) []byte {
+	head := make([]byte, tableHeadSize)
+	copy(head, testMBR(0xEE, 1, uint32(min(numSectors-1, 0xFFFFFFFF))))
+
+	entries := head[2*sectorSize : 2*sectorSize+128*128]
+	entries[0] = 0xAF
+	binary.LittleEndian.PutUint64(entries[32:], start)
+	binary.LittleEndian.PutUint64(entries[40:], end)
+
+	entriesSectors := uint64(128 * 128 / sectorSize)
+	header := gptHeader{
+		Revision:       0x00010000,
+		HeaderSize:     gptHeaderSize,
+		MyLBA:          1,
+		AlternateLBA:   uint64(numSectors - 1),
+		FirstUsableLBA: 2 + entriesSectors,
+		LastUsableLBA:  uint64(numSectors) - 2 - entriesSectors,
+		EntriesLBA:     2,
+		NumEntries:     128,
+		EntrySize:      128,
+		EntriesCRC32:   crc32.ChecksumIEEE(entries),
+	}
+	copy(header.Signature[:], gptSignature)
+	copy(head[sectorSize:], header.marshal())
+	return head
+}
+
+func TestDetectTableSectorSizeGPT(t *testing.T) {
+	for _, sectorSize := range []int{512, 4096} {
+		head := testGPT(sectorSize, 8192, 256, 511)
+		got := DetectTableSectorSize("", head, 8192*int64(sectorSize))
+		if got != sectorSize {
+			t.Errorf("DetectTableSectorSize() = %d for a GPT of %d-byte sectors", got, sectorSize)
+		}
+	}
+}
+
+func TestTranslateMBR(t *testing.T) {
+	tests := []struct {
+		name       string
+		partType   byte
+		from, to   int
+		start, num uint32
+		wantStart  uint32
+		wantNum    uint32
+		wantErr    bool
+	}{
+		{"4096 to 512", 0x0C, 4096, 512, 256, 1024, 2048, 8192, false},
+		{"512 to 4096", 0x83, 512, 4096, 2048, 8192, 256, 1024, false},
+		{"unaligned", 0x83, 512, 4096, 63, 8192, 0, 0, true},
+		{"extended", 0x05, 4096, 512, 256, 1024, 0, 0, true},
+	}
+	for _, test := range tests {
+		patches, err := TranslatePartitionTable(testMBR(test.partType, test.start, test.num), test.from, test.to, 1<<20)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		entry := patches[0].Data[0x1BE:]
+		start, num := binary.LittleEndian.Uint32(entry[8:]), binary.LittleEndian.Uint32(entry[12:])
+		if start != test.wantStart || num != test.wantNum {
+			t.Errorf("%s: translated to %d+%d, want %d+%d", test.name, start, num, test.wantStart, test.wantNum)
+		}
+	}
+}
+
+func TestTranslateGPT(t *testing.T) {
+	const diskNumSectors = 16384
+	head := testGPT(4096, 2048, 256, 511)
+	patches, err := TranslatePartitionTable(head, 4096, 512, diskNumSectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disk := make([]byte, diskNumSectors*512)
+	copy(disk, head)
+	applyPatches(disk, 0, patches)
+	table, err := ParsePartitionTable(disk[:tableHeadSize], 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Type != TABLE_GPT || len(table.Partitions) != 1 {
+		t.Fatalf("translated table is %+v", table)
+	}
+	if partition := table.Partitions[0]; partition.StartLBA != 2048 || partition.NumSectors != 2048 {
+		t.Errorf("partition moved to %d+%d, want 2048+2048", partition.StartLBA, partition.NumSectors)
+	}
+	backup, ok := readGPTHeader(disk[(diskNumSectors-2)*512:], 512)
+	if !ok || backup.MyLBA != diskNumSectors-1 {
+		t.Errorf("no backup header at the end of the drive")
+	}
+}
+
+func TestLogicalPartitions(t *testing.T) {
+	ebr := func(start, numSectors, next uint32) []byte {
+		sector := testMBR(0x83, start, numSectors)
+		if next > 0 {
+			entry := sector[0x1CE:]
+			entry[4] = 0x05
+			binary.LittleEndian.PutUint32(entry[8:], next)
+			binary.LittleEndian.PutUint32(entry[12:], 1000)
+		}
+		return sector
+	}
+
+	tests := []struct {
+		name    string
+		ebrs    map[int64][]byte
+		wantErr bool
+		want    []Partition
+	}{
+		{
+			name: "chain",
+			ebrs: map[int64][]byte{
+				2048: ebr(63, 100, 1000),
+				3048: ebr(63, 200, 0),
+			},
+			want: []Partition{
+				{Index: 5, Type: "0x83", StartLBA: 2111, NumSectors: 100},
+				{Index: 6, Type: "0x83", StartLBA: 3111, NumSectors: 200},
+			},
+		},
+		{
+			name:    "loop",
+			ebrs:    map[int64][]byte{2048: ebr(63, 100, 0)},
+			wantErr: true,
+		},
+		{
+			name:    "no signature",
+			ebrs:    map[int64][]byte{2048: make([]byte, 512)},
+			wantErr: true,
+		},
+	}
+	// The EBR of the loop case points back at itself.
+	binary.LittleEndian.PutUint32(tests[1].ebrs[2048][0x1CE+8:], 0)
+	tests[1].ebrs[2048][0x1CE+4] = 0x05
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			head := make([]byte, tableHeadSize)
+			copy(head, testMBR(0x0F, 2048, 10000))
+			table, err := ParsePartitionTable(head, 512)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(table.Partitions) != 1 || !table.Partitions[0].Extended {
+				t.Fatalf("extended partition not marked: %+v", table.Partitions)
+			}
+
+			err = table.addLogicalPartitions(func(lba int64) ([]byte, error) {
+				return test.ebrs[lba], nil
+			})
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("broken EBR chain accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			logicals := table.Partitions[1:]
+			if len(logicals) != len(test.want) {
+				t.Fatalf("got %d logical partitions, want %d", len(logicals), len(test.want))
+			}
+			for i, want := range test.want {
+				if logicals[i] != want {
+					t.Errorf("logical partition %d is %+v, want %+v", i, logicals[i], want)
+				}
+			}
+			var ebrAreas int
+			for _, area := range table.Areas {
+				if len(area.Name) > 3 && area.Name[:3] == "EBR" {
+					ebrAreas++
+				}
+			}
+			if ebrAreas != len(test.ebrs) {
+				t.Errorf("got %d EBR areas, want %d", ebrAreas, len(test.ebrs))
+			}
+		})
+	}
+}
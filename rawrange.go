@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RawRange places a part of an image at a given place of the drive, the way
+// dd does with skip, seek and count. Boards such as Allwinner, Rockchip and
+// i.MX ones load their bootloader from fixed offsets of the raw device. All
+// of it is in bytes.
+type RawRange struct {
+	// Skip is where in the image reading starts.
+	Skip int64 `json:"skip"`
+	// Seek is where on the drive writing starts.
+	Seek int64 `json:"seek"`
+	// Count limits how much of the image is written, 0 is all of it.
+	Count int64 `json:"count"`
+}
+
+func (r RawRange) IsSet() bool {
+	return r != RawRange{}
+}
+
+func (r RawRange) String() string {
+	str := fmt.Sprintf("from byte %d of the image to byte %d of the drive", r.Skip, r.Seek)
+	if r.Count > 0 {
+		str = fmt.Sprintf("%d bytes %s", r.Count, str)
+	}
+	return str
+}
+
+// Length is how many bytes of an image of imageSize bytes the range takes.
+func (r RawRange) Length(imageSize int64) (int64, error) {
+	if r.Skip < 0 || r.Seek < 0 || r.Count < 0 {
+		return 0, errors.New("Offsets and lengths cannot be negative.")
+	}
+	if r.Skip >= imageSize {
+		return 0, fmt.Errorf("The input offset %d lies past the end of the image (%d bytes).", r.Skip, imageSize)
+	}
+	length := imageSize - r.Skip
+	if r.Count > 0 {
+		length = min(length, r.Count)
+	}
+	return length, nil
+}
+
+// ParseSize reads a size or an offset such as 8K, 32KiB, 1M or 64s. A bare
+// number is in bytes and s stands for 512-byte sectors.
+func ParseSize(str string) (int64, error) {
+	str = strings.TrimSpace(str)
+	if len(str) == 0 {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+		{"k", 1 << 10}, {"s", 512},
+	}
+	unit := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(str, 0, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size", str)
+	}
+	if n > (1<<63-1)/unit {
+		return 0, fmt.Errorf("%q is too large", str)
+	}
+	return n * unit, nil
+}
+
+// Overlaps lists the structures of the partition table and the partitions
+// that the bytes [start, start+length) of the drive run into.
+func (table *PartitionTable) Overlaps(start int64, length int64) []string {
+	overlaps := []string{}
+	touches := func(offset int64, size int64) bool {
+		return start < offset+size && offset < start+length
+	}
+	for _, area := range table.Areas {
+		if touches(area.Offset, area.Length) {
+			overlaps = append(overlaps, "the "+area.Name)
+		}
+	}
+	sectorSize := int64(table.SectorSize)
+	for _, partition := range table.Partitions {
+		if touches(partition.StartLBA*sectorSize, partition.NumSectors*sectorSize) {
+			overlaps = append(overlaps, table.Describe(partition))
+		}
+	}
+	return overlaps
+}
+
+// CheckRawRange checks the range of a write before it is started and warns
+// about the partition table and the partitions of the drive it overwrites.
+func CheckRawRange(data *MainData) ([]string, error) {
+	imageStat, err := os.Stat(data.imagePath)
+	if err != nil {
+		return nil, errors.Join(errors.New("CheckRawRange(): Stat failed"), err)
+	}
+	length, err := data.rawRange.Length(imageStat.Size())
+	if err != nil {
+		return nil, err
+	}
+	if data.clearTail {
+		return nil, errors.New("The rest of the drive cannot be discarded after an offset write.")
+	}
+
+	table, err := ListPartitions(data.selectedDisk, data.selectedIdentity)
+	if err != nil {
+		return []string{"The partition table of the drive could not be read, overlaps are not checked."}, nil
+	}
+	start := data.rawRange.Seek
+	if data.partition.Index > 0 {
+		start += data.partition.StartLBA * int64(table.SectorSize)
+	}
+	if start%int64(table.SectorSize) != 0 {
+		return nil, fmt.Errorf("The output offset must be a multiple of the sector size (%d bytes).", table.SectorSize)
+	}
+
+	warnings := []string{}
+	for _, overlap := range table.Overlaps(start, length) {
+		if data.partition.Index > 0 && overlap == table.Describe(data.partition) {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("Bytes %d to %d overlap %s.", start, start+length, overlap))
+	}
+	return warnings, nil
+}
+
+// selectRawRange confines the job to the range of the drive and the image
+// set by the user, within the partition when one is selected.
+func selectRawRange(data *MainData, handles *Handles) error {
+	numSectors, sectorSize, err := GetNumDiskSector(handles.hDisk)
+	if err != nil {
+		return errors.Join(errors.New("selectRawRange(): GetNumDiskSector failed"), err)
+	}
+	if data.rawRange.Seek%int64(sectorSize) != 0 {
+		return fmt.Errorf("The output offset must be a multiple of the sector size (%d bytes).", sectorSize)
+	}
+	if data.clearTail {
+		return errors.New("The rest of the drive cannot be discarded after an offset write.")
+	}
+	if handles.diskLength > 0 {
+		if data.rawRange.Seek >= handles.diskLength {
+			return fmt.Errorf("The output offset lies past the end of partition %d.", data.partition.Index)
+		}
+		handles.diskLength -= data.rawRange.Seek
+	}
+	handles.diskOffset += data.rawRange.Seek
+	if handles.diskOffset >= numSectors*int64(sectorSize) {
+		return errors.New("The output offset lies past the end of the drive.")
+	}
+	handles.imageOffset = data.rawRange.Skip
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    int64
+		wantErr bool
+	}{
+		{str: "", want: 0},
+		{str: "4096", want: 4096},
+		{str: "0x200", want: 512},
+		{str: "8K", want: 8 << 10},
+		{str: "8k", want: 8 << 10},
+		{str: "32KiB", want: 32 << 10},
+		{str: " 1 M ", want: 1 << 20},
+		{str: "2GiB", want: 2 << 30},
+		{str: "64s", want: 64 * 512},
+		{str: "-1", wantErr: true},
+		{str: "1.5M", wantErr: true},
+		{str: "K", wantErr: true},
+		{str: "8T", wantErr: true},
+		{str: "9000000000G", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseSize(test.str)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d, error %t", test.str, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestRawRangeLength(t *testing.T) {
+	tests := []struct {
+		name      string
+		rawRange  RawRange
+		imageSize int64
+		want      int64
+		wantErr   bool
+	}{
+		{name: "whole image", rawRange: RawRange{Seek: 8192}, imageSize: 1000, want: 1000},
+		{name: "skip", rawRange: RawRange{Skip: 100}, imageSize: 1000, want: 900},
+		{name: "count", rawRange: RawRange{Skip: 100, Count: 50}, imageSize: 1000, want: 50},
+		{name: "count past the end", rawRange: RawRange{Skip: 900, Count: 500}, imageSize: 1000, want: 100},
+		{name: "skip past the end", rawRange: RawRange{Skip: 1000}, imageSize: 1000, wantErr: true},
+		{name: "negative", rawRange: RawRange{Seek: -512}, imageSize: 1000, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.rawRange.Length(test.imageSize)
+			if (err != nil) != test.wantErr || got != test.want {
+				t.Errorf("Length(%d) = %d, %v, want %d, error %t", test.imageSize, got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	table := &PartitionTable{
+		Type:       TABLE_MBR,
+		SectorSize: 512,
+		Partitions: []Partition{
+			{Index: 1, Type: "0x0C", StartLBA: 2048, NumSectors: 2048},
+			{Index: 2, Type: "0x83", StartLBA: 4096, NumSectors: 4096},
+		},
+		Areas: []TableArea{{"MBR", Extent{0, 512}}},
+	}
+	first := table.Describe(table.Partitions[0])
+	second := table.Describe(table.Partitions[1])
+
+	tests := []struct {
+		name   string
+		start  int64
+		length int64
+		want   []string
+	}{
+		{name: "gap after the MBR", start: 8192, length: 32768, want: []string{}},
+		{name: "MBR", start: 0, length: 1024, want: []string{"the MBR"}},
+		{name: "end of the gap", start: 8192, length: 2048*512 - 8192, want: []string{}},
+		{name: "first byte of a partition", start: 8192, length: 2048*512 - 8191, want: []string{first}},
+		{name: "two partitions", start: 3000 * 512, length: 2000 * 512, want: []string{first, second}},
+		{name: "past the partitions", start: 8192 * 512, length: 512, want: []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := table.Overlaps(test.start, test.length)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("Overlaps(%d, %d) = %q, want %q", test.start, test.length, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// findDisk looks for the drive with the given identity among all drives.
+func findDisk(identity DiskIdentity) (Disk, bool) {
+	for _, disk := range GetDisks(true) {
+		if disk.System {
+			continue
+		}
+		current, err := GetDiskIdentity(disk.Path)
+		if err == nil && identity.Matches(current) {
+			return disk, true
+		}
+	}
+	return Disk{}, false
+}
+
+// resumeAfterRemoval is called with an error from an access to the drive.
+// When the error means the drive went away, it keeps the job on hold until
+// the same drive shows up again, reopens the handles on it and returns true
+// so that the job can go on from sector done. Any other error is reported,
+// and false is returned for it as well as for a cancelled job. A job with
+// failOnRemoval set reports the removal as an error instead of waiting.
+func resumeAfterRemoval(
+	data *MainData,
+	ui Frontend,
+	handles *Handles,
+	taskType TaskType,
+	done int64,
+	total int64,
+	err error,
+) bool {
+	if !IsRemovalError(data.selectedDrive, err) {
+		ui.HandleError(data, err)
+		return false
+	}
+
+	log.Printf("resumeAfterRemoval(): %s removed: %s", data.selectedDrive, err)
+	if data.failOnRemoval {
+		ui.HandleError(data, errors.Join(errors.New("the drive was removed"), err))
+		return false
+	}
+	ui.SetStatus(fmt.Sprintf(
+		"Device removed at %d%%. Reinsert it to resume...",
+		done*100/max(total, 1),
+	))
+	ui.SetSpeed("")
+
+	for {
+		select {
+		case <-data.bQuitTask:
+			return false
+		case <-time.After(time.Second):
+			disk, ok := findDisk(data.selectedIdentity)
+			if !ok {
+				continue
+			}
+			devPath := disk.Path
+
+			// The handles on the removed drive stay open until the new ones
+			// are in place, so that cleaning up always closes valid handles.
+			oldHandles := *handles
+			err := GetRequiredHandles(handles, taskType, devPath, data.selectedIdentity, data.imagePath)
+			if err != nil {
+				*handles = oldHandles
+				log.Printf("resumeAfterRemoval(): reopening %s failed: %s", devPath, err)
+				continue
+			}
+			CloseRequiredHandles(oldHandles)
+
+			data.selectedDrive = devPath
+			ui.SetStatus(fmt.Sprintf("Resuming at %d%%...", done*100/max(total, 1)))
+			return true
+		}
+	}
+}
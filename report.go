@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetriedRange is a range of the drive that failed and was tried again.
+type RetriedRange struct {
+	Op         string
+	Sector     int64
+	NumSectors int64
+	Attempts   int
+	// Split is set for a chunk that was tried in pieces after its retries
+	// failed. The pieces that needed retries are recorded on their own.
+	Split      bool
+	FirstError string
+	Recovered  bool
+}
+
+func (retried RetriedRange) String() string {
+	result := "failed"
+	if retried.Recovered {
+		result = "recovered"
+	}
+	split := ""
+	if retried.Split {
+		split = " and a split"
+	}
+	return fmt.Sprintf(
+		"%s of sectors %d-%d: %s after %d attempts%s (first error: %s)",
+		retried.Op,
+		retried.Sector,
+		retried.Sector+retried.NumSectors-1,
+		result,
+		retried.Attempts,
+		split,
+		retried.FirstError,
+	)
+}
+
+// JobReport collects what happened during a job beyond its outcome. It is
+// saved as a text file when the job ends.
+type JobReport struct {
+	mutex    sync.Mutex
+	taskType TaskType
+	device   string
+	identity DiskIdentity
+	image    string
+	started  time.Time
+	retries  []RetriedRange
+	notes    []string
+}
+
+func NewJobReport(data *MainData) *JobReport {
+	report := &JobReport{
+		taskType: data.taskType,
+		device:   data.selectedDrive,
+		identity: data.selectedIdentity,
+		image:    data.imagePath,
+		started:  time.Now(),
+	}
+	// Composing an image leaves the selected drive alone.
+	if data.taskType == START_COMPOSE_IMAGE {
+		report.device, report.identity = "", DiskIdentity{}
+	}
+	return report
+}
+
+func (report *JobReport) AddRetry(retried RetriedRange) {
+	log.Printf("JobReport: retried %s", retried)
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.retries = append(report.retries, retried)
+}
+
+// AddNote records a line worth keeping about the job, such as a statistic.
+func (report *JobReport) AddNote(format string, args ...any) {
+	note := fmt.Sprintf(format, args...)
+	log.Printf("JobReport: %s", note)
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.notes = append(report.notes, note)
+}
+
+func (report *JobReport) String() string {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "Utkirna job report\n\n")
+	fmt.Fprintf(&content, "Task:     %s\n", taskName(report.taskType))
+	if len(report.device) > 0 {
+		fmt.Fprintf(&content, "Device:   %s (%s)\n", report.device, report.identity)
+	}
+	if len(report.image) > 0 {
+		fmt.Fprintf(&content, "Image:    %s\n", report.image)
+	}
+	fmt.Fprintf(&content, "Started:  %s\n", report.started.Format(time.RFC3339))
+	fmt.Fprintf(&content, "Ended:    %s\n", time.Now().Format(time.RFC3339))
+	for _, note := range report.notes {
+		fmt.Fprintf(&content, "%s\n", note)
+	}
+
+	fmt.Fprintf(&content, "\nRetried ranges: %d\n", len(report.retries))
+	for _, retried := range report.retries {
+		fmt.Fprintf(&content, "  %s\n", retried)
+	}
+	return content.String()
+}
+
+// Save writes the report to the reports directory and returns its path.
+func (report *JobReport) Save() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Join(errors.New("JobReport.Save(): UserConfigDir failed"), err)
+	}
+	dir := filepath.Join(configDir, "utkirna", "reports")
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", errors.Join(errors.New("JobReport.Save(): MkdirAll failed"), err)
+	}
+
+	path := filepath.Join(dir, jobFileName(report.started, report.taskType, report.device)+".txt")
+	err = os.WriteFile(path, []byte(report.String()), 0o600)
+	if err != nil {
+		return "", errors.Join(errors.New("JobReport.Save(): WriteFile failed"), err)
+	}
+	return path, nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Block states of a GNU ddrescue mapfile.
+const (
+	RESCUE_NON_TRIED   byte = '?'
+	RESCUE_NON_TRIMMED byte = '*'
+	RESCUE_NON_SCRAPED byte = '/'
+	RESCUE_BAD_SECTOR  byte = '-'
+	RESCUE_FINISHED    byte = '+'
+)
+
+// Phases of a rescue as recorded in the current_status field of a mapfile.
+const (
+	RESCUE_PHASE_COPYING  byte = '?'
+	RESCUE_PHASE_SCRAPING byte = '/'
+	RESCUE_PHASE_DONE     byte = '+'
+)
+
+type rescueBlock struct {
+	pos    int64
+	size   int64
+	status byte
+}
+
+// RescueMap tracks which parts of a device have been read, in bytes, the same
+// way a GNU ddrescue mapfile does. It is shared between the job and the GUI.
+type RescueMap struct {
+	mutex   sync.Mutex
+	size    int64
+	blocks  []rescueBlock
+	pos     int64
+	phase   byte
+	pass    int
+	started time.Time
+}
+
+func NewRescueMap(size int64) *RescueMap {
+	return &RescueMap{
+		size:    size,
+		blocks:  []rescueBlock{{0, size, RESCUE_NON_TRIED}},
+		phase:   RESCUE_PHASE_COPYING,
+		pass:    1,
+		started: time.Now(),
+	}
+}
+
+// Set marks the size bytes at pos with status.
+func (rescueMap *RescueMap) Set(pos int64, size int64, status byte) {
+	rescueMap.mutex.Lock()
+	defer rescueMap.mutex.Unlock()
+
+	end := pos + size
+	rescueMap.pos = end
+	blocks := make([]rescueBlock, 0, len(rescueMap.blocks)+2)
+	inserted := false
+	for _, block := range rescueMap.blocks {
+		blockEnd := block.pos + block.size
+		if blockEnd <= pos || block.pos >= end {
+			if !inserted && block.pos >= end {
+				blocks = append(blocks, rescueBlock{pos, size, status})
+				inserted = true
+			}
+			blocks = append(blocks, block)
+			continue
+		}
+		if block.pos < pos {
+			blocks = append(blocks, rescueBlock{block.pos, pos - block.pos, block.status})
+		}
+		if !inserted {
+			blocks = append(blocks, rescueBlock{pos, size, status})
+			inserted = true
+		}
+		if blockEnd > end {
+			blocks = append(blocks, rescueBlock{end, blockEnd - end, block.status})
+		}
+	}
+	if !inserted {
+		blocks = append(blocks, rescueBlock{pos, size, status})
+	}
+
+	// Neighbours with the same state are merged to keep the map small.
+	merged := blocks[:1]
+	for _, block := range blocks[1:] {
+		last := &merged[len(merged)-1]
+		if last.status == block.status && last.pos+last.size == block.pos {
+			last.size += block.size
+		} else {
+			merged = append(merged, block)
+		}
+	}
+	rescueMap.blocks = merged
+}
+
+func (rescueMap *RescueMap) SetPhase(phase byte, pass int) {
+	rescueMap.mutex.Lock()
+	defer rescueMap.mutex.Unlock()
+	rescueMap.phase = phase
+	rescueMap.pass = pass
+}
+
+// Areas returns the areas with one of the given states.
+func (rescueMap *RescueMap) Areas(statuses ...byte) [][2]int64 {
+	rescueMap.mutex.Lock()
+	defer rescueMap.mutex.Unlock()
+
+	areas := [][2]int64{}
+	for _, block := range rescueMap.blocks {
+		if strings.IndexByte(string(statuses), block.status) >= 0 {
+			areas = append(areas, [2]int64{block.pos, block.size})
+		}
+	}
+	return areas
+}
+
+// Bytes returns how many bytes have the given state.
+func (rescueMap *RescueMap) Bytes(status byte) int64 {
+	total := int64(0)
+	for _, area := range rescueMap.Areas(status) {
+		total += area[1]
+	}
+	return total
+}
+
+// StatusAt returns the worst state found between start and end, which is what
+// a single pixel of the GUI map shows.
+func (rescueMap *RescueMap) StatusAt(start int64, end int64) byte {
+	rescueMap.mutex.Lock()
+	defer rescueMap.mutex.Unlock()
+
+	worst := byte(RESCUE_FINISHED)
+	rank := map[byte]int{
+		RESCUE_FINISHED:    0,
+		RESCUE_NON_TRIED:   1,
+		RESCUE_NON_SCRAPED: 2,
+		RESCUE_NON_TRIMMED: 3,
+		RESCUE_BAD_SECTOR:  4,
+	}
+	for _, block := range rescueMap.blocks {
+		if block.pos+block.size <= start || block.pos >= end {
+			continue
+		}
+		if rank[block.status] > rank[worst] {
+			worst = block.status
+		}
+	}
+	return worst
+}
+
+func (rescueMap *RescueMap) Size() int64 {
+	return rescueMap.size
+}
+
+// WriteMapfile saves the map in the format of GNU ddrescue, so that the
+// rescue can be continued or inspected with ddrescue and its tools.
+func (rescueMap *RescueMap) WriteMapfile(path string, devPath string) error {
+	rescueMap.mutex.Lock()
+	var content strings.Builder
+	fmt.Fprintf(&content, "# Mapfile. Created by Utkirna\n")
+	fmt.Fprintf(&content, "# Rescue read of %s\n", devPath)
+	fmt.Fprintf(&content, "# Start time:   %s\n", rescueMap.started.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&content, "# Current time: %s\n", time.Now().Format("2006-01-02 15:04:05"))
+	if rescueMap.phase == RESCUE_PHASE_DONE {
+		fmt.Fprintf(&content, "# Finished\n")
+	}
+	fmt.Fprintf(&content, "# current_pos  current_status  current_pass\n")
+	fmt.Fprintf(&content, "0x%08X     %c               %d\n", rescueMap.pos, rescueMap.phase, rescueMap.pass)
+	fmt.Fprintf(&content, "#      pos        size  status\n")
+	for _, block := range rescueMap.blocks {
+		fmt.Fprintf(&content, "0x%08X  0x%08X  %c\n", block.pos, block.size, block.status)
+	}
+	rescueMap.mutex.Unlock()
+
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	err := os.WriteFile(tmpPath, []byte(content.String()), 0o644)
+	if err != nil {
+		return errors.Join(errors.New("RescueMap.WriteMapfile(): WriteFile failed"), err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// rescueImage reads the device into the image like ReadDisk, but does not give
+// up on read errors. The first pass skips chunks that fail, so that the
+// readable bulk of a failing drive is saved before it gets worse. The second
+// pass goes back to them with shrinking reads down to single sectors. What
+// stays unreadable is zero-filled in the image and recorded in a mapfile next
+// to it.
+func rescueImage(data *MainData, ui Frontend, handles Handles, diskSector int, diskNumSectors int64, pool *BufferPool) {
+	mapPath := data.imagePath + ".map"
+	rescueMap := NewRescueMap(diskNumSectors * int64(diskSector))
+	ui.ShowRescueMap(rescueMap)
+
+	go func() {
+		defer cleanUp(data, ui, handles)
+		// The mapfile tells what was saved even when the job stops early.
+		defer rescueMap.WriteMapfile(mapPath, data.selectedDrive)
+
+		sectorData := pool.Get()
+		defer pool.Put(sectorData)
+		lasti := int64(0)
+		updateTimer := time.Now()
+
+		for i := int64(0); i < diskNumSectors; i += 1024 {
+			select {
+			case <-data.bQuitTask:
+				return
+			default:
+				chunk := sectorData[:chunkSectors(i, diskNumSectors)*int64(diskSector)]
+				status := RESCUE_FINISHED
+
+				err := readDiskSectors(handles, &chunk, i, diskSector)
+				if err != nil {
+					if IsRemovalError(data.selectedDrive, err) {
+						ui.HandleError(
+							data,
+							errors.Join(errors.New("rescueImage(): ReadSectorDataFromHandle failed"), err),
+						)
+						return
+					}
+					clear(chunk)
+					status = RESCUE_NON_TRIMMED
+				}
+
+				err = WriteSectorDataFromHandle(handles.hImage, &chunk, i, diskSector)
+				if err != nil {
+					ui.HandleError(
+						data,
+						errors.Join(errors.New("rescueImage(): WriteSectorDataFromHandle failed"), err),
+					)
+					return
+				}
+				rescueMap.Set(i*int64(diskSector), int64(len(chunk)), status)
+
+				ui.SetProgress(i+int64(len(chunk)/diskSector), diskNumSectors)
+				if updateSpeed(ui, diskSector, i-lasti, updateTimer) {
+					lasti = i
+					updateTimer = time.Now()
+					ui.ShowRescueMap(rescueMap)
+					rescueMap.WriteMapfile(mapPath, data.selectedDrive)
+				}
+			}
+		}
+
+		rescueMap.SetPhase(RESCUE_PHASE_SCRAPING, 2)
+		ui.SetStatus("Retrying unreadable areas...")
+		ui.SetSpeed("")
+		for _, area := range rescueMap.Areas(RESCUE_NON_TRIMMED) {
+			areaStart := area[0] / int64(diskSector)
+			areaEnd := areaStart + area[1]/int64(diskSector)
+
+			for i := areaStart; i < areaEnd; i += 1024 {
+				select {
+				case <-data.bQuitTask:
+					return
+				default:
+					chunk := sectorData[:chunkSectors(i, areaEnd)*int64(diskSector)]
+					clear(chunk)
+
+					err := rescueRange(data, handles, rescueMap, chunk, i, diskSector)
+					if err != nil {
+						ui.HandleError(
+							data,
+							errors.Join(errors.New("rescueImage(): rescueRange failed"), err),
+						)
+						return
+					}
+
+					err = WriteSectorDataFromHandle(handles.hImage, &chunk, i, diskSector)
+					if err != nil {
+						ui.HandleError(
+							data,
+							errors.Join(errors.New("rescueImage(): WriteSectorDataFromHandle failed"), err),
+						)
+						return
+					}
+					ui.ShowRescueMap(rescueMap)
+					rescueMap.WriteMapfile(mapPath, data.selectedDrive)
+				}
+			}
+		}
+		rescueMap.SetPhase(RESCUE_PHASE_DONE, 2)
+		ui.ShowRescueMap(rescueMap)
+
+		bad := rescueMap.Bytes(RESCUE_BAD_SECTOR)
+		if bad == 0 {
+			ui.HandleSuccess("Image saved. Every sector could be read.\nMapfile: " + mapPath)
+		} else {
+			ui.HandleSuccess(fmt.Sprintf(
+				"Image saved. %d bytes (%d sectors) could not be read and were filled with zeros.\nMapfile: %s",
+				bad,
+				bad/int64(diskSector),
+				mapPath,
+			))
+		}
+	}()
+}
+
+// rescueRange reads chunk, which starts at sector start, in eighths of its
+// size, and splits the pieces that fail again the same way down to single
+// sectors. Sectors that stay unreadable are zero-filled. Only the removal of
+// the drive is returned as an error.
+func rescueRange(
+	data *MainData,
+	handles Handles,
+	rescueMap *RescueMap,
+	chunk []byte,
+	start int64,
+	diskSector int,
+) error {
+	numSectors := int64(len(chunk) / diskSector)
+	step := max(numSectors/8, 1)
+
+	for k := int64(0); k < numSectors; k += step {
+		n := min(step, numSectors-k)
+		piece := chunk[k*int64(diskSector) : (k+n)*int64(diskSector)]
+		pos := (start + k) * int64(diskSector)
+
+		err := readDiskSectors(handles, &piece, start+k, diskSector)
+		if err == nil {
+			rescueMap.Set(pos, int64(len(piece)), RESCUE_FINISHED)
+			continue
+		}
+		if IsRemovalError(data.selectedDrive, err) {
+			return err
+		}
+
+		clear(piece)
+		if n == 1 {
+			rescueMap.Set(pos, int64(len(piece)), RESCUE_BAD_SECTOR)
+			continue
+		}
+		rescueMap.Set(pos, int64(len(piece)), RESCUE_NON_SCRAPED)
+		err = rescueRange(data, handles, rescueMap, piece, start+k, diskSector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
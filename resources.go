@@ -0,0 +1,17 @@
+package main
+
+import (
+	"embed"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/theme"
+)
+
+//go:embed assets/boards/*.json
+var boardProfilesFS embed.FS
+
+//go:embed assets/icons/lock.svg
+var lockIconData []byte
+
+// lockIcon follows the foreground colour of the current theme.
+var lockIcon = theme.NewThemedResource(fyne.NewStaticResource("lock.svg", lockIconData))
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"time"
+)
+
+// RetryPolicy decides how an access to the drive that failed is tried again.
+// Cheap card readers fail now and then in a way that goes away on a retry.
+type RetryPolicy struct {
+	// Count is how many times a failed range is tried again.
+	Count int
+	// Backoff is the wait before the first retry. It doubles for every
+	// further one.
+	Backoff time.Duration
+	// Split retries a chunk that keeps failing in smaller pieces, which gets
+	// past readers that only choke on large transfers.
+	Split bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Count:   3,
+	Backoff: 100 * time.Millisecond,
+	Split:   true,
+}
+
+// retryFunc accesses numSectors sectors of the drive from sector start on.
+type retryFunc func(start int64, numSectors int64) error
+
+// Run accesses the range of numSectors sectors at start through try, and
+// retries it according to the policy. Pieces of a split chunk stay multiples
+// of alignSectors. The removal of the drive is returned right away, so that
+// the job can wait for it to come back instead.
+func (policy RetryPolicy) Run(
+	report *JobReport,
+	op string,
+	devPath string,
+	start int64,
+	numSectors int64,
+	alignSectors int64,
+	try retryFunc,
+) error {
+	firstErr := try(start, numSectors)
+	if firstErr == nil || IsRemovalError(devPath, firstErr) {
+		return firstErr
+	}
+	attempts, err := policy.retry(devPath, start, numSectors, try, firstErr)
+	split := err != nil && policy.Split && numSectors > alignSectors && !IsRemovalError(devPath, err)
+	if split {
+		err = policy.runPieces(report, op, devPath, start, numSectors, alignSectors, try)
+	}
+
+	// The chunk is only recorded once its outcome is known, and only when
+	// it was actually tried again.
+	if attempts > 1 || split {
+		report.AddRetry(RetriedRange{
+			Op:         op,
+			Sector:     start,
+			NumSectors: numSectors,
+			Attempts:   attempts,
+			Split:      split,
+			FirstError: firstErr.Error(),
+			Recovered:  err == nil,
+		})
+	}
+	return err
+}
+
+// runPieces accesses a chunk that kept failing in pieces of an eighth of it,
+// retrying each piece on its own.
+func (policy RetryPolicy) runPieces(
+	report *JobReport,
+	op string,
+	devPath string,
+	start int64,
+	numSectors int64,
+	alignSectors int64,
+	try retryFunc,
+) error {
+	step := max(numSectors/8/alignSectors, 1) * alignSectors
+	for pieceStart := start; pieceStart < start+numSectors; pieceStart += step {
+		pieceSectors := min(step, start+numSectors-pieceStart)
+		firstErr := try(pieceStart, pieceSectors)
+		if firstErr == nil {
+			continue
+		}
+		if IsRemovalError(devPath, firstErr) {
+			return firstErr
+		}
+
+		attempts, err := policy.retry(devPath, pieceStart, pieceSectors, try, firstErr)
+		if attempts > 1 {
+			report.AddRetry(RetriedRange{
+				Op:         op,
+				Sector:     pieceStart,
+				NumSectors: pieceSectors,
+				Attempts:   attempts,
+				FirstError: firstErr.Error(),
+				Recovered:  err == nil,
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry tries the range again up to Count times after it failed with
+// firstErr, and returns how many attempts were made in all.
+func (policy RetryPolicy) retry(
+	devPath string,
+	start int64,
+	numSectors int64,
+	try retryFunc,
+	firstErr error,
+) (int, error) {
+	err := firstErr
+	backoff := policy.Backoff
+	attempts := 1
+	for attempts <= policy.Count && !IsRemovalError(devPath, err) {
+		time.Sleep(backoff)
+		backoff *= 2
+		attempts++
+		err = try(start, numSectors)
+		if err == nil {
+			break
+		}
+	}
+	return attempts, err
+}
+
+// writeDiskChunk writes chunk to the drive from sector chunkStart on, under
+// the retry policy of the job.
+func writeDiskChunk(data *MainData, handles Handles, chunk []byte, chunkStart int64, sectorSize int, alignment int) error {
+	return data.retry.Run(
+		data.report,
+		"write",
+		data.selectedDrive,
+		chunkStart,
+		int64(len(chunk)/sectorSize),
+		int64(max(alignment/sectorSize, 1)),
+		func(start int64, numSectors int64) error {
+			piece := chunk[(start-chunkStart)*int64(sectorSize) : (start-chunkStart+numSectors)*int64(sectorSize)]
+			return writeDiskSectors(handles, &piece, start, sectorSize)
+		},
+	)
+}
+
+// readDiskChunk is the counterpart of writeDiskChunk for reads.
+func readDiskChunk(data *MainData, handles Handles, chunk []byte, chunkStart int64, sectorSize int, alignment int) error {
+	return data.retry.Run(
+		data.report,
+		"read",
+		data.selectedDrive,
+		chunkStart,
+		int64(len(chunk)/sectorSize),
+		int64(max(alignment/sectorSize, 1)),
+		func(start int64, numSectors int64) error {
+			piece := chunk[(start-chunkStart)*int64(sectorSize) : (start-chunkStart+numSectors)*int64(sectorSize)]
+			return readDiskSectors(handles, &piece, start, sectorSize)
+		},
+	)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRetryPolicyRun(t *testing.T) {
+	const always = -1
+	type span [2]int64
+
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		// failures is how many times each range fails before it works.
+		failures map[span]int
+		wantErr  bool
+		want     []RetriedRange
+	}{
+		{
+			name:   "no error",
+			policy: RetryPolicy{Count: 3, Split: true},
+		},
+		{
+			name:     "recovered by a retry",
+			policy:   RetryPolicy{Count: 3, Split: true},
+			failures: map[span]int{{0, 16}: 1},
+			want: []RetriedRange{
+				{Op: "read", Sector: 0, NumSectors: 16, Attempts: 2, Recovered: true},
+			},
+		},
+		{
+			name:     "no retries",
+			policy:   RetryPolicy{},
+			failures: map[span]int{{0, 16}: always},
+			wantErr:  true,
+		},
+		{
+			name:     "recovered by a split",
+			policy:   RetryPolicy{Count: 1, Split: true},
+			failures: map[span]int{{0, 16}: always},
+			want: []RetriedRange{
+				{Op: "read", Sector: 0, NumSectors: 16, Attempts: 2, Split: true, Recovered: true},
+			},
+		},
+		{
+			name:     "piece recovered by a retry",
+			policy:   RetryPolicy{Count: 2, Split: true},
+			failures: map[span]int{{0, 16}: always, {4, 2}: 1},
+			want: []RetriedRange{
+				{Op: "read", Sector: 4, NumSectors: 2, Attempts: 2, Recovered: true},
+				{Op: "read", Sector: 0, NumSectors: 16, Attempts: 3, Split: true, Recovered: true},
+			},
+		},
+		{
+			name:     "bad piece",
+			policy:   RetryPolicy{Count: 1, Split: true},
+			failures: map[span]int{{0, 16}: always, {6, 2}: always},
+			wantErr:  true,
+			want: []RetriedRange{
+				{Op: "read", Sector: 6, NumSectors: 2, Attempts: 2},
+				{Op: "read", Sector: 0, NumSectors: 16, Attempts: 2, Split: true},
+			},
+		},
+		{
+			name:     "bad piece without retries",
+			policy:   RetryPolicy{Split: true},
+			failures: map[span]int{{0, 16}: always, {6, 2}: always},
+			wantErr:  true,
+			want: []RetriedRange{
+				{Op: "read", Sector: 0, NumSectors: 16, Attempts: 1, Split: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report := NewJobReport(&MainData{})
+			failures := map[span]int{}
+			for key, count := range test.failures {
+				failures[key] = count
+			}
+			err := test.policy.Run(report, "read", "", 0, 16, 1, func(start int64, numSectors int64) error {
+				key := span{start, numSectors}
+				if failures[key] == 0 {
+					return nil
+				}
+				if failures[key] > 0 {
+					failures[key]--
+				}
+				return errors.New("I/O error")
+			})
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, test.wantErr)
+			}
+			if len(report.retries) != len(test.want) {
+				t.Fatalf("got %d retried ranges, want %d: %v", len(report.retries), len(test.want), report.retries)
+			}
+			for i, want := range test.want {
+				want.FirstError = "I/O error"
+				if report.retries[i] != want {
+					t.Errorf("retried range %d is %+v, want %+v", i, report.retries[i], want)
+				}
+			}
+		})
+	}
+}
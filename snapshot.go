@@ -0,0 +1,462 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const snapshotVersion = 1
+
+const (
+	// snapshotHead is how much of the start of a drive a snapshot keeps at
+	// least, enough for the partition table and the boot area of most images.
+	snapshotHead = 64 << 20
+	// snapshotEnd is kept from the end of the drive, where a backup GPT sits.
+	snapshotEnd = 1 << 20
+	// snapshotKeep is how many snapshots the store keeps.
+	snapshotKeep = 5
+)
+
+// Snapshot is what a drive held where a write was about to overwrite it. The
+// data is kept gzip-compressed next to the description, in the order of
+// Extents.
+type Snapshot struct {
+	Version    int
+	Device     string
+	Identity   DiskIdentity
+	SectorSize int
+	// Image is what was written over the drive.
+	Image   string
+	Created time.Time
+	// Full is set when everything the write changed was saved, and not
+	// only the start and the end of the drive.
+	Full bool
+	// Offset is the byte offset on the drive Extents count from, the start
+	// of the partition when only a partition was written.
+	Offset  int64
+	Extents []Extent
+	// Digest is the SHA-256 of the saved data.
+	Digest string
+
+	path string
+}
+
+func (snapshot *Snapshot) Size() int64 {
+	size := int64(0)
+	for _, extent := range snapshot.Extents {
+		size += extent.Length
+	}
+	return size
+}
+
+func (snapshot *Snapshot) String() string {
+	coverage := "the start and the end of the drive"
+	if snapshot.Full {
+		coverage = "everything that was overwritten"
+	}
+	return fmt.Sprintf(
+		"%s of %s (%s), taken %s before writing %s",
+		coverage,
+		snapshot.Device,
+		snapshot.Identity,
+		snapshot.Created.Format("2006-01-02 15:04:05"),
+		filepath.Base(snapshot.Image),
+	)
+}
+
+func (snapshot *Snapshot) dataPath() string {
+	return strings.TrimSuffix(snapshot.path, ".json") + ".gz"
+}
+
+func snapshotDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(configDir, "utkirna", "snapshots")
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+func LoadSnapshot(path string) (*Snapshot, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Join(errors.New("LoadSnapshot(): ReadFile failed"), err)
+	}
+	snapshot := &Snapshot{}
+	err = json.Unmarshal(content, snapshot)
+	if err != nil {
+		return nil, errors.Join(errors.New("LoadSnapshot(): Unmarshal failed"), err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("%s was saved by another version of Utkirna", path)
+	}
+	snapshot.path = path
+	return snapshot, nil
+}
+
+// listSnapshots returns the snapshots in the store, the newest first.
+func listSnapshots() ([]*Snapshot, error) {
+	dir, err := snapshotDir()
+	if err != nil {
+		return nil, errors.Join(errors.New("listSnapshots(): snapshotDir failed"), err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, errors.Join(errors.New("listSnapshots(): Glob failed"), err)
+	}
+
+	snapshots := []*Snapshot{}
+	for _, path := range paths {
+		snapshot, err := LoadSnapshot(path)
+		if err != nil {
+			log.Printf("listSnapshots(): %s", err)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	slices.SortFunc(snapshots, func(a *Snapshot, b *Snapshot) int {
+		return b.Created.Compare(a.Created)
+	})
+	return snapshots, nil
+}
+
+// LatestSnapshot returns the snapshot of the last write to the drive, or nil
+// when there is none.
+func LatestSnapshot(identity DiskIdentity) (*Snapshot, error) {
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Identity.Matches(identity) {
+			return snapshot, nil
+		}
+	}
+	return nil, nil
+}
+
+// pruneSnapshots removes all but the newest snapshots from the store.
+func pruneSnapshots() {
+	snapshots, err := listSnapshots()
+	if err != nil {
+		log.Printf("pruneSnapshots(): %s", err)
+		return
+	}
+	for _, snapshot := range snapshots[min(snapshotKeep, len(snapshots)):] {
+		os.Remove(snapshot.dataPath())
+		os.Remove(snapshot.path)
+	}
+}
+
+// snapshotExtents returns what a snapshot before writing the image keeps. The
+// whole overwritten part is kept when the store has room for it even
+// uncompressed, otherwise only its start and the end of the drive.
+func snapshotExtents(data *MainData, layout *imageLayout, dir string) ([]Extent, bool) {
+	sectorSize := int64(layout.diskSector)
+	diskSize := layout.diskNumSectors * sectorSize
+	overwritten := min(layout.imageNumSectors*sectorSize, diskSize)
+	if data.clearTail {
+		overwritten = diskSize
+	}
+
+	end := overwritten
+	free, err := GetFreeSpace(dir)
+	if err != nil || free-end < max(1<<30, free/10) {
+		end = min(end, snapshotHead)
+	}
+
+	extents := []Extent{{0, end}}
+	tail := max(diskSize-snapshotEnd, end)
+	if tail < diskSize {
+		extents = append(extents, Extent{tail, diskSize - tail})
+	}
+	return extents, end == overwritten
+}
+
+// errNotBlank stops isBlank at the first chunk holding data.
+var errNotBlank = errors.New("the drive holds data")
+
+// isBlank tells whether the extents of the drive a snapshot would keep hold
+// nothing but erased bytes, in which case leaving the snapshot out loses
+// nothing. A drive in use already shows data in its first chunk, so only a
+// blank drive is read through.
+func isBlank(data *MainData, ui Frontend, handles Handles, layout *imageLayout, extents []Extent) (bool, error) {
+	ui.SetStatus("Checking whether the drive is blank...")
+	err := copyExtents(data, ui, layout, extents, func(chunk []byte, i int64) error {
+		err := readDiskChunk(data, handles, chunk, i, layout.diskSector, layout.alignment)
+		if err != nil {
+			return errors.Join(errors.New("isBlank(): readDiskChunk failed"), err)
+		}
+		if !isErased(chunk) {
+			return errNotBlank
+		}
+		return nil
+	})
+	if err == errNotBlank {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// copyExtents calls step for every chunk of the extents in order and keeps
+// the progress up to date.
+func copyExtents(
+	data *MainData,
+	ui Frontend,
+	layout *imageLayout,
+	extents []Extent,
+	step func(chunk []byte, i int64) error,
+) error {
+	sectorSize := int64(layout.diskSector)
+	total := int64(0)
+	for _, extent := range extents {
+		total += extent.Length / sectorSize
+	}
+
+	buf := layout.pool.Get()
+	defer layout.pool.Put(buf)
+	done := int64(0)
+	lastDone := int64(0)
+	updateTimer := time.Now()
+
+	ui.SetProgress(0, total)
+	for _, extent := range extents {
+		start := extent.Offset / sectorSize
+		end := (extent.Offset + extent.Length) / sectorSize
+		for i := start; i < end; i += 1024 {
+			select {
+			case <-data.bQuitTask:
+				return errCancelled
+			default:
+				chunk := buf[:chunkSectors(i, end)*sectorSize]
+				err := step(chunk, i)
+				if err != nil {
+					return err
+				}
+
+				done += int64(len(chunk)) / sectorSize
+				ui.SetProgress(done, total)
+				if updateSpeed(ui, layout.diskSector, done-lastDone, updateTimer) {
+					lastDone = done
+					updateTimer = time.Now()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// TakeSnapshot saves what the drive holds where the image is about to be
+// written. It returns nil for a blank drive, which has nothing to lose.
+func TakeSnapshot(data *MainData, ui Frontend, handles Handles, layout *imageLayout) (*Snapshot, error) {
+	dir, err := snapshotDir()
+	if err != nil {
+		return nil, errors.Join(errors.New("TakeSnapshot(): snapshotDir failed"), err)
+	}
+	extents, full := snapshotExtents(data, layout, dir)
+	blank, err := isBlank(data, ui, handles, layout, extents)
+	if err != nil || blank {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Version:    snapshotVersion,
+		Device:     data.selectedDrive,
+		Identity:   data.selectedIdentity,
+		SectorSize: layout.diskSector,
+		Image:      data.imagePath,
+		Created:    time.Now(),
+		Offset:     handles.diskOffset,
+	}
+	snapshot.Extents, snapshot.Full = extents, full
+	snapshot.path = filepath.Join(dir, fmt.Sprintf(
+		"%s-%s.json",
+		snapshot.Created.Format("20060102-150405"),
+		safeFileName(snapshot.Identity, snapshot.Device),
+	))
+
+	err = snapshot.save(data, ui, handles, layout)
+	if err != nil {
+		os.Remove(snapshot.dataPath())
+		return nil, err
+	}
+	pruneSnapshots()
+	return snapshot, nil
+}
+
+func (snapshot *Snapshot) save(data *MainData, ui Frontend, handles Handles, layout *imageLayout) error {
+	file, err := os.OpenFile(snapshot.dataPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return errors.Join(errors.New("Snapshot.save(): OpenFile failed"), err)
+	}
+	defer file.Close()
+	compressed, _ := gzip.NewWriterLevel(file, gzip.BestSpeed)
+	sum := sha256.New()
+
+	ui.SetStatus("Saving a snapshot of the drive...")
+	err = copyExtents(data, ui, layout, snapshot.Extents, func(chunk []byte, i int64) error {
+		err := readDiskChunk(data, handles, chunk, i, layout.diskSector, layout.alignment)
+		if err != nil {
+			return errors.Join(errors.New("Snapshot.save(): readDiskChunk failed"), err)
+		}
+		sum.Write(chunk)
+		_, err = compressed.Write(chunk)
+		if err != nil {
+			return errors.Join(errors.New("Snapshot.save(): Write failed"), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = compressed.Close()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return errors.Join(errors.New("Snapshot.save(): Close failed"), err)
+	}
+
+	snapshot.Digest = fmt.Sprintf("%x", sum.Sum(nil))
+	content, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return errors.Join(errors.New("Snapshot.save(): MarshalIndent failed"), err)
+	}
+	err = os.WriteFile(snapshot.path, content, 0o600)
+	if err != nil {
+		return errors.Join(errors.New("Snapshot.save(): WriteFile failed"), err)
+	}
+	return nil
+}
+
+// restore writes the snapshot back to the drive and reads it back.
+func (snapshot *Snapshot) restore(data *MainData, ui Frontend, handles Handles, layout *imageLayout) error {
+	file, err := os.Open(snapshot.dataPath())
+	if err != nil {
+		return errors.Join(errors.New("Snapshot.restore(): Open failed"), err)
+	}
+	defer file.Close()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return errors.Join(errors.New("Snapshot.restore(): NewReader failed"), err)
+	}
+
+	ui.SetStatus("Restoring the snapshot...")
+	last := int64(-1)
+	err = copyExtents(data, ui, layout, snapshot.Extents, func(chunk []byte, i int64) error {
+		_, err := io.ReadFull(compressed, chunk)
+		if err != nil {
+			return errors.Join(errors.New("Snapshot.restore(): ReadFull failed"), err)
+		}
+		err = writeDiskChunk(data, handles, chunk, i, layout.diskSector, layout.alignment)
+		if err == nil && i-last >= 16*1024 {
+			last = i
+			err = SyncDisk(handles)
+		}
+		if err != nil {
+			return errors.Join(errors.New("Snapshot.restore(): writeDiskChunk failed"), err)
+		}
+		return nil
+	})
+	if err == nil {
+		err = SyncDisk(handles)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = FlushDiskCache(handles)
+	if err != nil {
+		return errors.Join(errors.New("Snapshot.restore(): FlushDiskCache failed"), err)
+	}
+	ui.SetStatus("Verifying (" + DiskIOMode(handles) + ")...")
+	sum := sha256.New()
+	err = copyExtents(data, ui, layout, snapshot.Extents, func(chunk []byte, i int64) error {
+		err := readDiskChunk(data, handles, chunk, i, layout.diskSector, layout.alignment)
+		if err != nil {
+			return errors.Join(errors.New("Snapshot.restore(): readDiskChunk failed"), err)
+		}
+		sum.Write(chunk)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if fmt.Sprintf("%x", sum.Sum(nil)) != snapshot.Digest {
+		return errors.New("The drive does not read back what the snapshot holds.")
+	}
+	return nil
+}
+
+// RestoreSnapshot undoes a write by putting back the snapshot taken before it.
+func RestoreSnapshot(data *MainData, ui Frontend, handles Handles) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	snapshot, err := LoadSnapshot(data.snapshotPath)
+	if err == nil && !snapshot.Identity.Matches(data.selectedIdentity) {
+		err = fmt.Errorf(
+			"The snapshot was taken of another drive.\nSnapshot: %s\nSelected: %s",
+			snapshot.Identity,
+			data.selectedIdentity,
+		)
+	}
+	var layout *imageLayout
+	if err == nil {
+		handles.diskOffset = snapshot.Offset
+		layout = &imageLayout{}
+		layout.diskNumSectors, layout.diskSector, err = getTargetSectors(handles)
+	}
+	if err == nil && layout.diskSector != snapshot.SectorSize {
+		err = fmt.Errorf(
+			"The snapshot was taken with %d-byte sectors, the drive uses %d-byte sectors.",
+			snapshot.SectorSize,
+			layout.diskSector,
+		)
+	}
+	if err == nil {
+		for _, extent := range snapshot.Extents {
+			if extent.Offset+extent.Length > layout.diskNumSectors*int64(layout.diskSector) {
+				err = errors.New("The snapshot reaches past the end of the drive.")
+			}
+		}
+	}
+	if err == nil {
+		layout.alignment, err = GetDiskAlignment(handles.hDisk)
+	}
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("RestoreSnapshot(): preparing failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+	layout.pool = NewBufferPool(layout.diskSector*1024, layout.alignment)
+
+	go func() {
+		defer func() { cleanUp(data, ui, handles) }()
+
+		err := snapshot.restore(data, ui, handles, layout)
+		if errors.Is(err, errCancelled) {
+			return
+		}
+		if err != nil {
+			ui.HandleError(data, errors.Join(errors.New("RestoreSnapshot(): restore failed"), err))
+			return
+		}
+		data.report.AddNote("Restored %d bytes from %s", snapshot.Size(), snapshot.path)
+		message := "The last write was undone."
+		if !snapshot.Full {
+			message += "\nOnly the start and the end of the drive were saved, files further in may be lost."
+		}
+		ui.HandleSuccess(message)
+	}()
+}
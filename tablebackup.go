@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const tableBackupVersion = 1
+
+// maxEBRs bounds the walk along the EBR chain, which a damaged table can
+// turn into a loop.
+const maxEBRs = 256
+
+// TableRegion is a run of sectors of a drive that holds part of its
+// partition structures.
+type TableRegion struct {
+	Name  string
+	LBA   int64
+	Data  []byte
+	CRC32 uint32
+}
+
+// TableBackup holds the partition structures of a drive: the MBR and its EBR
+// chain, or the protective MBR and both copies of the GPT.
+type TableBackup struct {
+	Version     int
+	Device      string
+	Identity    DiskIdentity
+	SectorSize  int
+	DiskSectors int64
+	Created     time.Time
+	Type        string
+	Regions     []TableRegion
+}
+
+func (backup *TableBackup) String() string {
+	names := ""
+	for i, region := range backup.Regions {
+		if i > 0 {
+			names += ", "
+		}
+		names += region.Name
+	}
+	return fmt.Sprintf("%s table of %s (%s): %s", backup.Type, backup.Device, backup.Identity, names)
+}
+
+var errNoGPT = errors.New("no GPT header")
+
+// checkGPTHeader parses the GPT header in sector and checks its CRC.
+func checkGPTHeader(sector []byte) (gptHeader, error) {
+	var header gptHeader
+	if len(sector) < gptHeaderSize || string(sector[:8]) != gptSignature {
+		return header, errNoGPT
+	}
+	binary.Read(bytes.NewReader(sector), binary.LittleEndian, &header)
+	if header.HeaderSize < gptHeaderSize || int(header.HeaderSize) > len(sector) {
+		return header, fmt.Errorf("GPT header size %d is out of range", header.HeaderSize)
+	}
+	raw := bytes.Clone(sector[:header.HeaderSize])
+	binary.LittleEndian.PutUint32(raw[16:], 0)
+	if crc32.ChecksumIEEE(raw) != header.HeaderCRC32 {
+		return header, errors.New("GPT header CRC mismatch")
+	}
+	if header.EntrySize < 128 || header.EntrySize > 4096 || header.NumEntries > 1<<16 {
+		return header, errors.New("GPT partition entries are out of range")
+	}
+	return header, nil
+}
+
+// entriesSectors is the number of sectors the entry array of header takes.
+func (header gptHeader) entriesSectors(sectorSize int) int64 {
+	return int64(roundUp(int(header.NumEntries*header.EntrySize), sectorSize) / sectorSize)
+}
+
+func readTableRegion(handles Handles, layout diskGeometry, name string, lba int64, numSectors int64) (TableRegion, error) {
+	if lba < 0 || numSectors < 1 || lba+numSectors > layout.numSectors {
+		return TableRegion{}, fmt.Errorf("%s lies outside the drive", name)
+	}
+	buf := alignedBuffer(int(numSectors)*layout.sectorSize, layout.alignment)
+	err := ReadSectorDataFromHandle(handles.hDisk, &buf, lba, layout.sectorSize)
+	if err != nil {
+		return TableRegion{}, errors.Join(fmt.Errorf("readTableRegion(): reading %s failed", name), err)
+	}
+	data := bytes.Clone(buf)
+	return TableRegion{name, lba, data, crc32.ChecksumIEEE(data)}, nil
+}
+
+// readGPTCopy reads one copy of the GPT, the header at lba and its entries.
+func readGPTCopy(handles Handles, layout diskGeometry, name string, lba int64) ([]TableRegion, gptHeader, error) {
+	headerRegion, err := readTableRegion(handles, layout, name+" GPT header", lba, 1)
+	if err != nil {
+		return nil, gptHeader{}, err
+	}
+	header, err := checkGPTHeader(headerRegion.Data)
+	if err == nil && int64(header.MyLBA) != lba {
+		err = fmt.Errorf("GPT header at LBA %d claims to be at LBA %d", lba, header.MyLBA)
+	}
+	if err != nil {
+		return nil, header, fmt.Errorf("%s GPT header: %w", name, err)
+	}
+
+	entriesRegion, err := readTableRegion(
+		handles,
+		layout,
+		name+" GPT entries",
+		int64(header.EntriesLBA),
+		header.entriesSectors(layout.sectorSize),
+	)
+	if err != nil {
+		return nil, header, err
+	}
+	if crc32.ChecksumIEEE(entriesRegion.Data[:header.NumEntries*header.EntrySize]) != header.EntriesCRC32 {
+		return nil, header, fmt.Errorf("%s GPT partition entries CRC mismatch", name)
+	}
+	return []TableRegion{headerRegion, entriesRegion}, header, nil
+}
+
+// readEBRChain reads the EBRs of the extended partition starting at extStart.
+func readEBRChain(handles Handles, layout diskGeometry, extStart int64) ([]TableRegion, error) {
+	regions := []TableRegion{}
+	visited := map[int64]bool{}
+	for lba := extStart; len(regions) < maxEBRs; {
+		if visited[lba] {
+			return nil, fmt.Errorf("the EBR chain loops back to LBA %d", lba)
+		}
+		visited[lba] = true
+
+		region, err := readTableRegion(handles, layout, fmt.Sprintf("EBR %d", len(regions)+1), lba, 1)
+		if err != nil {
+			return nil, err
+		}
+		if region.Data[510] != 0x55 || region.Data[511] != 0xAA {
+			return nil, fmt.Errorf("%s has no boot signature", region.Name)
+		}
+		regions = append(regions, region)
+
+		next := region.Data[0x1CE:]
+		if next[4] == 0 {
+			return regions, nil
+		}
+		lba = extStart + int64(binary.LittleEndian.Uint32(next[8:]))
+	}
+	return nil, errors.New("the EBR chain is too long")
+}
+
+// tableJobCancelled tells whether the job was cancelled. The regions of a
+// table are small, so a table job only looks between them.
+func tableJobCancelled(data *MainData) bool {
+	select {
+	case <-data.bQuitTask:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadTableBackup reads the partition structures of the drive. A damaged
+// backup GPT is left out, since the primary one is enough to restore from.
+func ReadTableBackup(data *MainData, handles Handles, layout diskGeometry) (*TableBackup, error) {
+	backup := &TableBackup{
+		Version:     tableBackupVersion,
+		Device:      data.selectedDrive,
+		Identity:    data.selectedIdentity,
+		SectorSize:  layout.sectorSize,
+		DiskSectors: layout.numSectors,
+		Created:     time.Now(),
+	}
+
+	mbr, err := readTableRegion(handles, layout, "MBR", 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if mbr.Data[510] != 0x55 || mbr.Data[511] != 0xAA {
+		return nil, errors.New("The drive holds no partition table.")
+	}
+	backup.Regions = append(backup.Regions, mbr)
+
+	if tableJobCancelled(data) {
+		return nil, errCancelled
+	}
+	primary, header, err := readGPTCopy(handles, layout, "primary", 1)
+	if err == nil {
+		backup.Type = "GPT"
+		backup.Regions = append(backup.Regions, primary...)
+		if tableJobCancelled(data) {
+			return nil, errCancelled
+		}
+		secondary, _, err := readGPTCopy(handles, layout, "backup", int64(header.AlternateLBA))
+		if err != nil {
+			log.Printf("ReadTableBackup(): %s, leaving it out", err)
+		} else {
+			backup.Regions = append(backup.Regions, secondary...)
+		}
+		return backup, nil
+	}
+	// A GPT signature with a bad header must not pass for an MBR.
+	if !errors.Is(err, errNoGPT) {
+		return nil, errors.Join(errors.New("ReadTableBackup(): the primary GPT is damaged"), err)
+	}
+
+	backup.Type = "MBR"
+	for i := 0; i < 4; i++ {
+		entry := mbr.Data[0x1BE+16*i:]
+		if !isExtendedType(entry[4]) {
+			continue
+		}
+		if tableJobCancelled(data) {
+			return nil, errCancelled
+		}
+		ebrs, err := readEBRChain(handles, layout, int64(binary.LittleEndian.Uint32(entry[8:])))
+		if err != nil {
+			return nil, errors.Join(errors.New("ReadTableBackup(): readEBRChain failed"), err)
+		}
+		backup.Regions = append(backup.Regions, ebrs...)
+	}
+	return backup, nil
+}
+
+// Check makes sure the backup is intact and fits a drive of numSectors
+// sectors of sectorSize bytes. A GPT only fits a drive of the size it was
+// read from, since its backup copy sits at the end of the drive.
+func (backup *TableBackup) Check(sectorSize int, numSectors int64) error {
+	if backup.SectorSize != sectorSize {
+		return fmt.Errorf(
+			"The backup was read from a drive with %d-byte sectors, this drive uses %d-byte sectors.",
+			backup.SectorSize,
+			sectorSize,
+		)
+	}
+	if backup.Type == "GPT" && backup.DiskSectors != numSectors {
+		return fmt.Errorf(
+			"The GPT was read from a drive of %d sectors, this drive has %d sectors.",
+			backup.DiskSectors,
+			numSectors,
+		)
+	}
+	if len(backup.Regions) < 1 || backup.Regions[0].LBA != 0 {
+		return errors.New("The backup holds no MBR.")
+	}
+
+	headers := map[int64]gptHeader{}
+	for _, region := range backup.Regions {
+		if len(region.Data) < sectorSize || len(region.Data)%sectorSize != 0 {
+			return fmt.Errorf("%s is not a whole number of sectors", region.Name)
+		}
+		if crc32.ChecksumIEEE(region.Data) != region.CRC32 {
+			return fmt.Errorf("%s is damaged, its CRC does not match", region.Name)
+		}
+		if region.LBA < 0 || region.LBA+int64(len(region.Data)/sectorSize) > numSectors {
+			return fmt.Errorf("%s lies outside the drive", region.Name)
+		}
+		if backup.Type == "GPT" && region.LBA > 0 && len(region.Data) == sectorSize {
+			header, err := checkGPTHeader(region.Data)
+			if err == nil {
+				headers[int64(header.EntriesLBA)] = header
+			} else if !errors.Is(err, errNoGPT) {
+				return fmt.Errorf("%s: %w", region.Name, err)
+			}
+		}
+	}
+
+	if backup.Type == "GPT" {
+		if len(headers) < 1 {
+			return errors.New("The backup holds no intact GPT header.")
+		}
+		matched := 0
+		for _, region := range backup.Regions {
+			header, ok := headers[region.LBA]
+			if !ok {
+				continue
+			}
+			matched++
+			size := int(header.NumEntries * header.EntrySize)
+			if len(region.Data) < size || crc32.ChecksumIEEE(region.Data[:size]) != header.EntriesCRC32 {
+				return fmt.Errorf("%s do not match their header", region.Name)
+			}
+			if header.LastUsableLBA >= uint64(numSectors) || header.AlternateLBA >= uint64(numSectors) {
+				return fmt.Errorf("%s reach past the end of the drive", region.Name)
+			}
+		}
+		if matched != len(headers) {
+			return errors.New("The backup lacks the partition entries of a GPT header.")
+		}
+		return nil
+	}
+
+	mbr := backup.Regions[0].Data
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return errors.New("The MBR in the backup has no boot signature.")
+	}
+	table, err := ParsePartitionTable(mbr, sectorSize)
+	if err != nil {
+		return err
+	}
+	if table.EndLBA() > numSectors {
+		return fmt.Errorf("The partitions end at sector %d, the drive has %d sectors.", table.EndLBA(), numSectors)
+	}
+	return nil
+}
+
+func tableBackupDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(configDir, "utkirna", "tables")
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+// DefaultTableBackupPath is where a backup of the partition table of the
+// selected drive goes when no file was chosen.
+func DefaultTableBackupPath(data *MainData) (string, error) {
+	dir, err := tableBackupDir()
+	if err != nil {
+		return "", errors.Join(errors.New("DefaultTableBackupPath(): tableBackupDir failed"), err)
+	}
+	return filepath.Join(dir, fmt.Sprintf(
+		"%s-%s.json",
+		time.Now().Format("20060102-150405"),
+		safeFileName(data.selectedIdentity, data.selectedDrive),
+	)), nil
+}
+
+func (backup *TableBackup) Save(path string) error {
+	content, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return errors.Join(errors.New("TableBackup.Save(): MarshalIndent failed"), err)
+	}
+	err = os.WriteFile(path, content, 0o600)
+	if err != nil {
+		return errors.Join(errors.New("TableBackup.Save(): WriteFile failed"), err)
+	}
+	return nil
+}
+
+func LoadTableBackup(path string) (*TableBackup, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Join(errors.New("LoadTableBackup(): ReadFile failed"), err)
+	}
+	backup := &TableBackup{}
+	err = json.Unmarshal(content, backup)
+	if err != nil {
+		return nil, errors.Join(errors.New("LoadTableBackup(): Unmarshal failed"), err)
+	}
+	if backup.Version != tableBackupVersion {
+		return nil, fmt.Errorf("%s is not a partition table backup of this version of Utkirna", path)
+	}
+	return backup, nil
+}
+
+// restore writes every region of the backup to the drive and reads it back.
+// A cancelled restore stops between two regions and may leave a table that
+// is only partly restored.
+func (backup *TableBackup) restore(data *MainData, handles Handles, layout diskGeometry) error {
+	for _, region := range backup.Regions {
+		if tableJobCancelled(data) {
+			return errCancelled
+		}
+		buf := alignedBuffer(len(region.Data), layout.alignment)
+		copy(buf, region.Data)
+		err := WriteSectorDataFromHandle(handles.hDisk, &buf, region.LBA, layout.sectorSize)
+		if err != nil {
+			return errors.Join(fmt.Errorf("TableBackup.restore(): writing %s failed", region.Name), err)
+		}
+	}
+	err := SyncDisk(handles)
+	if err == nil {
+		err = FlushDiskCache(handles)
+	}
+	if err != nil {
+		return errors.Join(errors.New("TableBackup.restore(): SyncDisk failed"), err)
+	}
+
+	for _, region := range backup.Regions {
+		if tableJobCancelled(data) {
+			return errCancelled
+		}
+		readBack, err := readTableRegion(handles, layout, region.Name, region.LBA, int64(len(region.Data)/layout.sectorSize))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(readBack.Data, region.Data) {
+			return fmt.Errorf("Verification failed: %s does not read back as written", region.Name)
+		}
+	}
+	return nil
+}
+
+// BackupPartitionTable saves the partition structures of the selected drive
+// to data.imagePath.
+func BackupPartitionTable(data *MainData, ui Frontend, handles Handles) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	go func() {
+		defer func() { cleanUp(data, ui, handles) }()
+
+		ui.SetStatus("Reading the partition table...")
+		layout, err := getDiskGeometry(handles)
+		if err != nil {
+			ui.HandleError(data, errors.Join(errors.New("BackupPartitionTable(): getDiskGeometry failed"), err))
+			return
+		}
+		backup, err := ReadTableBackup(data, handles, layout)
+		if err == nil {
+			err = backup.Save(data.imagePath)
+		}
+		if errors.Is(err, errCancelled) {
+			return
+		}
+		if err != nil {
+			ui.HandleError(data, err)
+			return
+		}
+
+		ui.SetProgress(1, 1)
+		data.report.AddNote("Saved %s", backup)
+		ui.HandleSuccess(fmt.Sprintf("The %s partition table was saved to %s.", backup.Type, data.imagePath))
+	}()
+}
+
+// RestorePartitionTable writes the partition structures saved in
+// data.imagePath back to the selected drive.
+func RestorePartitionTable(data *MainData, ui Frontend, handles Handles) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	go func() {
+		defer func() { cleanUp(data, ui, handles) }()
+
+		ui.SetStatus("Restoring the partition table...")
+		layout, err := getDiskGeometry(handles)
+		if err != nil {
+			ui.HandleError(data, errors.Join(errors.New("RestorePartitionTable(): getDiskGeometry failed"), err))
+			return
+		}
+		backup, err := LoadTableBackup(data.imagePath)
+		if err == nil {
+			err = backup.Check(layout.sectorSize, layout.numSectors)
+		}
+		if err == nil {
+			err = backup.restore(data, handles, layout)
+		}
+		if errors.Is(err, errCancelled) {
+			return
+		}
+		if err != nil {
+			ui.HandleError(data, err)
+			return
+		}
+
+		ui.SetProgress(1, 1)
+		data.report.AddNote("Restored %s", backup)
+		ui.HandleSuccess(fmt.Sprintf("The %s partition table from %s was restored.", backup.Type, data.imagePath))
+	}()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"testing"
+)
+
+func testRegion(name string, lba int64, data []byte) TableRegion {
+	data = bytes.Clone(data)
+	return TableRegion{Name: name, LBA: lba, Data: data, CRC32: crc32.ChecksumIEEE(data)}
+}
+
+func TestTableBackupCheck(t *testing.T) {
+	gpt := func() *TableBackup {
+		head := testGPT(512, 8192, 256, 511)
+		return &TableBackup{
+			Type:        "GPT",
+			SectorSize:  512,
+			DiskSectors: 8192,
+			Regions: []TableRegion{
+				testRegion("MBR", 0, head[:512]),
+				testRegion("primary GPT header", 1, head[512:1024]),
+				testRegion("primary GPT entries", 2, head[1024:1024+128*128]),
+			},
+		}
+	}
+	mbr := func() *TableBackup {
+		return &TableBackup{
+			Type:        "MBR",
+			SectorSize:  512,
+			DiskSectors: 8192,
+			Regions:     []TableRegion{testRegion("MBR", 0, testMBR(0x83, 2048, 4096))},
+		}
+	}
+	// resealed changes a byte of a region and computes its CRC again.
+	resealed := func(region *TableRegion, offset int, value byte) {
+		region.Data[offset] = value
+		region.CRC32 = crc32.ChecksumIEEE(region.Data)
+	}
+
+	tests := []struct {
+		name       string
+		backup     func() *TableBackup
+		mutate     func(backup *TableBackup)
+		sectorSize int
+		numSectors int64
+		wantErr    bool
+	}{
+		{name: "GPT", backup: gpt},
+		{name: "MBR", backup: mbr},
+		{name: "MBR on a larger drive", backup: mbr, numSectors: 16384},
+		{name: "GPT on a larger drive", backup: gpt, numSectors: 16384, wantErr: true},
+		{name: "other sector size", backup: mbr, sectorSize: 4096, wantErr: true},
+		{
+			name:    "CRC mismatch",
+			backup:  gpt,
+			mutate:  func(backup *TableBackup) { backup.Regions[2].Data[0] ^= 0xFF },
+			wantErr: true,
+		},
+		{
+			name:   "partial sector",
+			backup: mbr,
+			mutate: func(backup *TableBackup) {
+				backup.Regions = append(backup.Regions, testRegion("EBR", 2048, make([]byte, 100)))
+			},
+			wantErr: true,
+		},
+		{
+			name:    "region past the end",
+			backup:  gpt,
+			mutate:  func(backup *TableBackup) { backup.Regions[2].LBA = 8180 },
+			wantErr: true,
+		},
+		{
+			name:   "negative LBA",
+			backup: mbr,
+			mutate: func(backup *TableBackup) {
+				backup.Regions = append(backup.Regions, testRegion("EBR", -1, make([]byte, 512)))
+			},
+			wantErr: true,
+		},
+		{
+			name:    "no MBR",
+			backup:  gpt,
+			mutate:  func(backup *TableBackup) { backup.Regions = backup.Regions[1:] },
+			wantErr: true,
+		},
+		{
+			name:    "entries not matching their header",
+			backup:  gpt,
+			mutate:  func(backup *TableBackup) { resealed(&backup.Regions[2], 1, 0x11) },
+			wantErr: true,
+		},
+		{
+			name:    "damaged GPT header",
+			backup:  gpt,
+			mutate:  func(backup *TableBackup) { resealed(&backup.Regions[1], 80, 0xFF) },
+			wantErr: true,
+		},
+		{
+			name:    "GPT header without entries",
+			backup:  gpt,
+			mutate:  func(backup *TableBackup) { backup.Regions = backup.Regions[:2] },
+			wantErr: true,
+		},
+		{
+			name:    "no boot signature",
+			backup:  mbr,
+			mutate:  func(backup *TableBackup) { resealed(&backup.Regions[0], 510, 0) },
+			wantErr: true,
+		},
+		{name: "partitions past the end", backup: mbr, numSectors: 4096, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backup := test.backup()
+			if test.mutate != nil {
+				test.mutate(backup)
+			}
+			sectorSize, numSectors := 512, int64(8192)
+			if test.sectorSize > 0 {
+				sectorSize = test.sectorSize
+			}
+			if test.numSectors > 0 {
+				numSectors = test.numSectors
+			}
+			err := backup.Check(sectorSize, numSectors)
+			if (err != nil) != test.wantErr {
+				t.Errorf("Check() = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
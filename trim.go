@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errZeroingUnsupported is returned by ZeroDisk for drives that cannot zero
+// themselves without being sent the zeros.
+var errZeroingUnsupported = errors.New("The drive cannot zero itself.")
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// prepareSkipZeros makes sure that the part of the drive the image is still
+// to be written to reads as zeros, so that the chunks of the image that are
+// all zeros can be skipped. The part is discarded first, which is enough
+// for drives that promise to read back zeros afterwards. Other drives are
+// asked to zero it by themselves. It returns false when neither works, in
+// which case every chunk has to be written.
+func prepareSkipZeros(data *MainData, ui Frontend, handles Handles, layout *imageLayout, start int64) (bool, error) {
+	if data.assumeBlank {
+		data.report.AddNote("The drive was taken to be blank, chunks of zeros were not written")
+		return true, nil
+	}
+
+	// The last partial sector keeps what the drive holds after the image
+	// unless it is padded, so it must not be zeroed here.
+	end := layout.imageNumSectors
+	if !data.padTail && layout.imageSize%int64(layout.diskSector) != 0 {
+		end--
+	}
+
+	ui.SetStatus("Discarding the drive...")
+	err := discardSectors(data, ui, handles, layout.diskSector, start, end, false)
+	if errors.Is(err, errCancelled) {
+		return false, err
+	}
+	if err != nil {
+		log.Printf("prepareSkipZeros(): %s", err)
+	} else if DiscardZeroesData(handles) {
+		data.report.AddNote("The drive was discarded and reads back zeros, chunks of zeros were not written")
+		return true, nil
+	}
+
+	ui.SetStatus("Zeroing the drive...")
+	err = stepSectors(data, ui, layout.diskSector, start, end, func(offset int64, length int64) error {
+		return ZeroDisk(handles, offset, length)
+	})
+	if errors.Is(err, errZeroingUnsupported) {
+		log.Printf("prepareSkipZeros(): %s, writing every chunk", err)
+		data.report.AddNote("The drive cannot zero itself, chunks of zeros were written")
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Join(errors.New("prepareSkipZeros(): ZeroDisk failed"), err)
+	}
+	return true, nil
+}
+
+// zeroSectors writes zeros to the sectors from start to end.
+func zeroSectors(data *MainData, ui Frontend, handles Handles, layout *imageLayout, start int64, end int64) error {
+	buf := layout.pool.Get()
+	defer layout.pool.Put(buf)
+	clear(buf)
+	lasti := start
+	updateTimer := time.Now()
+
+	ui.SetProgress(0, end-start)
+	for i := start; i < end; i += 1024 {
+		select {
+		case <-data.bQuitTask:
+			return errCancelled
+		default:
+			chunk := buf[:min(1024, end-i)*int64(layout.diskSector)]
+			err := writeDiskChunk(data, handles, chunk, i, layout.diskSector, layout.alignment)
+			if err == nil && ((i-start)/1024%16 == 15 || i+1024 >= end) {
+				err = SyncDisk(handles)
+			}
+			if err != nil {
+				return errors.Join(errors.New("zeroSectors(): writeDiskChunk failed"), err)
+			}
+
+			ui.SetProgress(i+int64(len(chunk)/layout.diskSector)-start, end-start)
+			if updateSpeed(ui, layout.diskSector, i-lasti, updateTimer) {
+				lasti = i
+				updateTimer = time.Now()
+			}
+		}
+	}
+	return nil
+}
+
+// clearTail discards the part of the drive after the image, so that no stale
+// data is left there and the flash controller knows the blocks are free.
+// Drives that cannot discard get the part zero-filled instead. It returns a
+// line for the user about what was done.
+func clearTail(data *MainData, ui Frontend, handles Handles, layout *imageLayout) (string, error) {
+	start := layout.imageNumSectors
+	end := layout.diskNumSectors
+	if start >= end {
+		return "", nil
+	}
+	size := (end - start) * int64(layout.diskSector)
+
+	ui.SetStatus("Discarding the rest of the drive...")
+	err := discardSectors(data, ui, handles, layout.diskSector, start, end, false)
+	if err == nil {
+		data.report.AddNote("Discarded %d bytes after the image", size)
+		return fmt.Sprintf("%s after the image were discarded.", fmtBytes(size)), nil
+	}
+	if errors.Is(err, errCancelled) {
+		return "", err
+	}
+
+	log.Printf("clearTail(): %s, zero-filling instead", err)
+	ui.SetStatus("Zero-filling the rest of the drive...")
+	err = zeroSectors(data, ui, handles, layout, start, end)
+	if err != nil {
+		return "", err
+	}
+	data.report.AddNote("Zero-filled %d bytes after the image, the drive cannot discard", size)
+	return fmt.Sprintf("%s after the image were zero-filled.", fmtBytes(size)), nil
+}
@@ -4,19 +4,34 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
 type Handles struct {
-	hDisk  int
-	hImage int
+	hDisk       int
+	hImage      int
+	diskDirect  bool
+	imageDirect bool
+	// diskOffset and diskLength confine a job to a part of the drive, such as
+	// a partition. Sector numbers of the job count from diskOffset, and a
+	// diskLength of 0 stands for the rest of the drive.
+	diskOffset int64
+	diskLength int64
+	// imageOffset is where in the image the job starts reading.
+	imageOffset int64
 }
 
 func isPermAvailable() bool {
@@ -27,9 +42,22 @@ func isPermAvailable() bool {
 	return currentUser.Uid == "0"
 }
 
+// regularFileSize returns the size of fd when it is a regular file, such as
+// an image standing in for a drive, which the block ioctls do not apply to.
+func regularFileSize(fd int) (int64, bool) {
+	var stat unix.Stat_t
+	if unix.Fstat(fd, &stat) != nil || stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return 0, false
+	}
+	return stat.Size, true
+}
+
 func gatherSizeInBytes(fd int) (int64, error) {
 	diskSize, err := unix.IoctlGetInt(fd, unix.BLKGETSIZE64)
 	if err != nil {
+		if size, ok := regularFileSize(fd); ok {
+			return size, nil
+		}
 		return 0, err
 	}
 	return int64(diskSize), nil
@@ -38,12 +66,117 @@ func gatherSizeInBytes(fd int) (int64, error) {
 func getDiskSectorSize(fd int) (int, error) {
 	sector, err := unix.IoctlGetInt(fd, unix.BLKSSZGET)
 	if err != nil {
+		if _, ok := regularFileSize(fd); ok {
+			return 512, nil
+		}
+		return 0, err
+	}
+
+	return sector, nil
+}
+
+// dropBufferCache writes back and invalidates everything the kernel holds
+// for fd, so the next read has to come from the device itself.
+func dropBufferCache(fd int) error {
+	err := unix.Fsync(fd)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := regularFileSize(fd); !ok {
+		err = unix.IoctlSetInt(fd, unix.BLKFLSBUF, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return unix.Fadvise(fd, 0, 0, unix.FADV_DONTNEED)
+}
+
+func getPhysicalSectorSize(fd int) (int, error) {
+	sector, err := unix.IoctlGetInt(fd, unix.BLKPBSZGET)
+	if err != nil {
+		if _, ok := regularFileSize(fd); ok {
+			return 512, nil
+		}
 		return 0, err
 	}
 
 	return sector, nil
 }
 
+func ioModeString(direct bool) string {
+	if direct {
+		return "O_DIRECT"
+	}
+	return "buffered"
+}
+
+// openHandle opens path with O_DIRECT when the underlying filesystem accepts
+// it. Filesystems such as tmpfs reject O_DIRECT at open time while some FUSE
+// and network filesystems only fail the first read or write, so the handle
+// is probed with an aligned read and, for writable handles, an aligned write
+// before being trusted. A write-only handle is opened for reading as well to
+// be probed. On fallback the handle is opened buffered and the kernel is told
+// the access is sequential.
+func openHandle(path string, flags int, direct bool) (int, bool, error) {
+	if direct {
+		directFlags := flags
+		if flags&unix.O_ACCMODE == unix.O_WRONLY {
+			directFlags = flags&^unix.O_ACCMODE | unix.O_RDWR
+		}
+		fd, err := unix.Open(path, directFlags|unix.O_DIRECT, 0777)
+		if err == nil {
+			err = probeDirect(fd, directFlags&unix.O_ACCMODE == unix.O_RDWR)
+			if err != nil {
+				unix.Close(fd)
+			}
+		}
+		if err == nil {
+			log.Printf("openHandle(): %s opened with %s", path, ioModeString(true))
+			return fd, true, nil
+		}
+		if err != unix.EINVAL && directFlags == flags {
+			return -1, false, err
+		}
+	}
+
+	fd, err := unix.Open(path, flags, 0777)
+	if err != nil {
+		return -1, false, err
+	}
+	unix.Fadvise(fd, 0, 0, unix.FADV_SEQUENTIAL)
+
+	log.Printf("openHandle(): %s opened with %s", path, ioModeString(false))
+	return fd, false, nil
+}
+
+// probeDirect reads the first block of fd and, if it is a writable file,
+// writes the block back. Past the end of a short file the block is zeros,
+// and the file is cut back to its size afterwards. Drives are only read,
+// since they take O_DIRECT writes as soon as they take O_DIRECT reads.
+func probeDirect(fd int, writable bool) error {
+	probe := alignedBuffer(ioAlignment, ioAlignment)
+	_, err := unix.Pread(fd, probe, 0)
+	if err != nil || !writable {
+		return err
+	}
+
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err != nil || stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return err
+	}
+	_, err = unix.Pwrite(fd, probe, 0)
+	if err != nil {
+		return err
+	}
+	if stat.Size < int64(len(probe)) {
+		return unix.Ftruncate(fd, stat.Size)
+	}
+	return nil
+}
+
 func isBlockRemovable(block string) bool {
 	str, _ := filepath.EvalSymlinks("/sys/class/block/" + block + "/device")
 	return strings.Contains(str, "usb") || strings.Contains(str, "mmc")
@@ -77,12 +210,235 @@ func unmountDisk(selectedDrive string) error {
 }
 
 func CloseRequiredHandles(handles Handles) {
+	if !handles.imageDirect {
+		unix.Fdatasync(handles.hImage)
+		unix.Fadvise(handles.hImage, 0, 0, unix.FADV_DONTNEED)
+	}
 	unix.Close(handles.hDisk)
 	unix.Close(handles.hImage)
 }
 
-func GetDisks() []string {
-	drives := []string{}
+// blockReadOnlyReason tells a write protection requested through the kernel
+// from one reported by the device. Both end up in the same ro attribute, so
+// only force_ro gives the former away; SD cards and USB card readers
+// otherwise report the position of the lock switch.
+func blockReadOnlyReason(block string) string {
+	forceRO, _ := os.ReadFile("/sys/block/" + block + "/force_ro")
+	if strings.TrimSpace(string(forceRO)) == "1" || !isBlockRemovable(block) {
+		return fmt.Sprintf(
+			"The kernel has marked the drive read-only.\n"+
+				"Clear the flag with \"blockdev --setrw /dev/%s\"\n"+
+				"and reload the drive list.",
+			block,
+		)
+	}
+	return "The drive reports that it is write-protected, most likely\n" +
+		"by the lock switch on the card or its adapter. Slide the switch\n" +
+		"to the unlocked position, reinsert the card and reload the drive list."
+}
+
+// blockBus names the bus a whole-disk block device hangs off.
+func blockBus(block string) string {
+	for _, prefix := range []string{"loop", "nbd", "zram", "ram", "md", "dm-"} {
+		if strings.HasPrefix(block, prefix) {
+			return strings.TrimSuffix(prefix, "-")
+		}
+	}
+
+	str, _ := filepath.EvalSymlinks("/sys/class/block/" + block + "/device")
+	switch {
+	case strings.Contains(str, "usb"):
+		return "usb"
+	case strings.Contains(str, "mmc"):
+		return "mmc"
+	case strings.Contains(str, "nvme"):
+		return "nvme"
+	case strings.Contains(str, "virtio"):
+		return "virtio"
+	case strings.Contains(str, "/ata"):
+		return "sata"
+	case strings.Contains(str, "/host"):
+		return "scsi"
+	}
+	return "unknown"
+}
+
+func blockSize(block string) int64 {
+	data, _ := os.ReadFile("/sys/block/" + block + "/size")
+	sectors, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return sectors * 512
+}
+
+// wholeDisksOf returns the disks a block device is stored on, following
+// partitions up to their disk and device-mapper or md devices down to the
+// devices they are built from.
+func wholeDisksOf(block string) []string {
+	if len(block) < 1 {
+		return nil
+	}
+	sysPath, err := filepath.EvalSymlinks("/sys/class/block/" + block)
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(sysPath + "/partition"); err == nil {
+		sysPath = filepath.Dir(sysPath)
+	}
+
+	slaves, _ := os.ReadDir(sysPath + "/slaves")
+	if len(slaves) == 0 {
+		return []string{filepath.Base(sysPath)}
+	}
+	disks := []string{}
+	for _, slave := range slaves {
+		disks = append(disks, wholeDisksOf(slave.Name())...)
+	}
+	return disks
+}
+
+func blockOfPath(path string) string {
+	if strings.HasPrefix(path, "/dev/") && path != "/dev/root" {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Base(resolved)
+		}
+	}
+
+	var stat unix.Stat_t
+	if unix.Stat(path, &stat) != nil {
+		return ""
+	}
+	dev := stat.Rdev
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		dev = stat.Dev
+	}
+	resolved, err := filepath.EvalSymlinks(
+		fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(uint64(dev)), unix.Minor(uint64(dev))),
+	)
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(resolved)
+}
+
+var systemMountPoints = []string{"/", "/boot", "/boot/efi", "/efi", "/usr", "/var", "/home"}
+
+// systemDisks returns the whole disks that hold a filesystem the running
+// system is mounted from or an active swap area.
+func systemDisks() map[string]bool {
+	disks := map[string]bool{}
+
+	mounts, _ := os.ReadFile("/proc/mounts")
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !slices.Contains(systemMountPoints, fields[1]) {
+			continue
+		}
+		block := blockOfPath(fields[0])
+		if len(block) < 1 {
+			block = blockOfPath(fields[1])
+		}
+		for _, disk := range wholeDisksOf(block) {
+			disks[disk] = true
+		}
+	}
+
+	swaps, _ := os.ReadFile("/proc/swaps")
+	for _, line := range strings.Split(string(swaps), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != "partition" {
+			continue
+		}
+		for _, disk := range wholeDisksOf(blockOfPath(fields[0])) {
+			disks[disk] = true
+		}
+	}
+	return disks
+}
+
+// udevProperty looks a property of a block device up in the udev database,
+// which is where the serial numbers of USB and SCSI drives end up.
+func udevProperty(block string, key string) string {
+	dev, err := os.ReadFile("/sys/class/block/" + block + "/dev")
+	if err != nil {
+		return ""
+	}
+
+	db, err := os.ReadFile("/run/udev/data/b" + strings.TrimSpace(string(dev)))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(db), "\n") {
+		if value, ok := strings.CutPrefix(line, "E:"+key+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func sysfsAttribute(block string, attribute string) string {
+	data, _ := os.ReadFile("/sys/class/block/" + block + "/" + attribute)
+	return strings.TrimSpace(string(data))
+}
+
+// blockByID returns the /dev/disk/by-id link of a block device, preferring
+// the names built from the bus and serial over wwn- and nvme-eui. ones.
+func blockByID(block string) string {
+	links, _ := filepath.Glob("/dev/disk/by-id/*")
+	sort.Strings(links)
+
+	preferred := func(name string) bool {
+		return !strings.HasPrefix(name, "wwn-") && !strings.HasPrefix(name, "nvme-eui.")
+	}
+
+	byID := ""
+	for _, link := range links {
+		resolved, err := filepath.EvalSymlinks(link)
+		if err != nil || filepath.Base(resolved) != block {
+			continue
+		}
+		if len(byID) < 1 || (!preferred(filepath.Base(byID)) && preferred(filepath.Base(link))) {
+			byID = link
+		}
+	}
+	return byID
+}
+
+func GetDiskIdentity(devPath string) (DiskIdentity, error) {
+	var identity DiskIdentity
+
+	resolved, err := filepath.EvalSymlinks(devPath)
+	if err != nil {
+		return identity, err
+	}
+	block := filepath.Base(resolved)
+	if _, err := os.Stat("/sys/block/" + block); err != nil {
+		return identity, fmt.Errorf("GetDiskIdentity(): %s is not a whole-disk block device", devPath)
+	}
+
+	identity.ByID = blockByID(block)
+	identity.Size = blockSize(block)
+	identity.Serial = udevProperty(block, "ID_SERIAL_SHORT")
+	if len(identity.Serial) < 1 {
+		identity.Serial = sysfsAttribute(block, "device/serial")
+	}
+	identity.Vendor = udevProperty(block, "ID_VENDOR")
+	if len(identity.Vendor) < 1 {
+		identity.Vendor = sysfsAttribute(block, "device/vendor")
+	}
+	identity.Model = udevProperty(block, "ID_MODEL")
+	if len(identity.Model) < 1 {
+		identity.Model = sysfsAttribute(block, "device/model")
+	}
+	if len(identity.Model) < 1 {
+		identity.Model = sysfsAttribute(block, "device/name")
+	}
+	return identity, nil
+}
+
+// GetDisks lists the removable drives, or every whole-disk block device with
+// a medium when showAll is set.
+func GetDisks(showAll bool) []Disk {
+	drives := []Disk{}
 
 	block_dir, _ := os.Open("/sys/block")
 	blocks, _ := block_dir.Readdirnames(0)
@@ -90,40 +446,107 @@ func GetDisks() []string {
 	block_dir.Close()
 	sort.Strings(sort.StringSlice(blocks))
 
+	system := systemDisks()
 	for _, block := range blocks {
-		if isBlockRW(block) && isBlockRemovable(block) {
-			if isBlockRemovable(block) {
-				drives = append(drives, "/dev/"+block)
-			}
+		removable := isBlockRemovable(block)
+		size := blockSize(block)
+		if !removable && (!showAll || size == 0) {
+			continue
+		}
+
+		disk := Disk{
+			Path:      "/dev/" + block,
+			Bus:       blockBus(block),
+			Removable: removable,
+			System:    system[block],
+			Size:      size,
 		}
+		if !isBlockRW(block) {
+			disk.ReadOnly = true
+			disk.ReadOnlyReason = blockReadOnlyReason(block)
+		}
+		drives = append(drives, disk)
 	}
 	return drives
 }
 
-func GetRequiredHandles(handles *Handles, taskType TaskType, devPath string, imgPath string) error {
+func GetRequiredHandles(
+	handles *Handles,
+	taskType TaskType,
+	devPath string,
+	identity DiskIdentity,
+	imgPath string,
+) error {
 	var diskAccess, imageAccess int
+	var diskDirect, imageDirect bool
 
-	err := unmountDisk(devPath)
+	err := CheckDiskIdentity(devPath, identity)
+	if err != nil {
+		return err
+	}
+
+	err = unmountDisk(devPath)
 	if err != nil {
 		return err
 	}
 	if taskType == START_WRITE {
-		diskAccess = unix.O_RDWR | unix.O_DIRECT
-		imageAccess = unix.O_RDONLY
+		diskAccess, diskDirect = unix.O_RDWR, true
+		imageAccess, imageDirect = unix.O_RDONLY, false
+	} else if taskType == START_CLONE {
+		// The source drive must not change while it is copied either.
+		err = unmountDisk(imgPath)
+		if err != nil {
+			return err
+		}
+		diskAccess, diskDirect = unix.O_RDWR, true
+		imageAccess, imageDirect = unix.O_RDONLY, true
 	} else if taskType == START_VERIFY {
-		diskAccess = unix.O_RDONLY
-		imageAccess = unix.O_RDONLY | unix.O_DIRECT
+		diskAccess, diskDirect = unix.O_RDONLY, true
+		imageAccess, imageDirect = unix.O_RDONLY, true
 	} else if taskType == START_READ {
-		diskAccess = unix.O_RDONLY
-		imageAccess = unix.O_WRONLY | unix.O_DIRECT
+		diskAccess, diskDirect = unix.O_RDONLY, false
+		imageAccess, imageDirect = unix.O_WRONLY, true
+	} else if taskType == START_WIPE ||
+		taskType == START_FORMAT ||
+		taskType == START_RESTORE ||
+		taskType == START_TABLE_RESTORE ||
+		taskType == START_BOARD ||
+		taskType == START_COMPOSE {
+		diskAccess, diskDirect = unix.O_RDWR, true
+	} else if taskType == START_TABLE_BACKUP {
+		diskAccess, diskDirect = unix.O_RDONLY, true
 	}
 
-	handles.hDisk, err = unix.Open(devPath, diskAccess, 0777)
+	handles.hDisk, handles.diskDirect, err = openHandle(devPath, diskAccess, diskDirect)
 	if err != nil {
 		return err
 	}
 
-	handles.hImage, err = unix.Open(imgPath, imageAccess, 0777)
+	// The drive may have been swapped between the check above and the open.
+	diskSize, err := gatherSizeInBytes(handles.hDisk)
+	if err != nil || diskSize != identity.Size {
+		unix.Close(handles.hDisk)
+		return errors.Join(
+			fmt.Errorf("%s changed while it was being opened", devPath),
+			err,
+		)
+	}
+
+	if taskType == START_VERIFY {
+		err = dropBufferCache(handles.hDisk)
+		if err != nil {
+			unix.Close(handles.hDisk)
+			return err
+		}
+	}
+
+	// Only writing, reading, verifying and cloning use an image handle.
+	if taskType != START_WRITE && taskType != START_CLONE && taskType != START_VERIFY && taskType != START_READ {
+		handles.hImage, handles.imageDirect = -1, true
+		return nil
+	}
+
+	handles.hImage, handles.imageDirect, err = openHandle(imgPath, imageAccess, imageDirect)
 	if err != nil {
 		unix.Close(handles.hDisk)
 		return err
@@ -132,6 +555,130 @@ func GetRequiredHandles(handles *Handles, taskType TaskType, devPath string, img
 	return nil
 }
 
+// SourceDevicePath is the path the data of a drive is read through when it
+// is the source of a clone.
+func SourceDevicePath(disk Disk, identity DiskIdentity) string {
+	return disk.Path
+}
+
+func SyncDisk(handles Handles) error {
+	return unix.Fsync(handles.hDisk)
+}
+
+func SyncImage(handles Handles) error {
+	return unix.Fdatasync(handles.hImage)
+}
+
+// IsRemovalError tells errors caused by the drive going away from other I/O
+// errors. A plain EIO counts only when the drive has disappeared as well.
+func IsRemovalError(devPath string, err error) bool {
+	if errors.Is(err, unix.ENODEV) || errors.Is(err, unix.ENXIO) || errors.Is(err, unix.ENOMEDIUM) {
+		return true
+	}
+	if !errors.Is(err, unix.EIO) {
+		return false
+	}
+
+	block := filepath.Base(devPath)
+	_, statErr := os.Stat("/sys/class/block/" + block)
+	return statErr != nil || blockSize(block) == 0
+}
+
+// DiscardDisk has the drive drop the data of length bytes from offset on.
+// A secure discard also erases any copies the drive keeps internally.
+func DiscardDisk(handles Handles, secure bool, offset int64, length int64) error {
+	request := uintptr(unix.BLKDISCARD)
+	if secure {
+		request = unix.BLKSECDISCARD
+	}
+	span := [2]uint64{uint64(handles.diskOffset + offset), uint64(length)}
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(handles.hDisk),
+		request,
+		uintptr(unsafe.Pointer(&span[0])),
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// DiscardZeroesData tells whether the drive promises to read back zeros for
+// discarded sectors. Kernels since 4.12 no longer pass the promise on and
+// always answer no.
+func DiscardZeroesData(handles Handles) bool {
+	zeroes, err := unix.IoctlGetUint32(handles.hDisk, unix.BLKDISCARDZEROES)
+	return err == nil && zeroes == 1
+}
+
+// ZeroDisk has the drive zero length bytes from offset on by itself. Drives
+// without a write zeroes command return errZeroingUnsupported, since the
+// kernel would otherwise send the zeros, which is no quicker than writing.
+func ZeroDisk(handles Handles, offset int64, length int64) error {
+	var stat unix.Stat_t
+	err := unix.Fstat(handles.hDisk, &stat)
+	if err != nil {
+		return errors.Join(errors.New("ZeroDisk(): Fstat failed"), err)
+	}
+	maxBytes, _ := os.ReadFile(fmt.Sprintf(
+		"/sys/dev/block/%d:%d/queue/write_zeroes_max_bytes",
+		unix.Major(uint64(stat.Rdev)),
+		unix.Minor(uint64(stat.Rdev)),
+	))
+	if n, _ := strconv.ParseInt(strings.TrimSpace(string(maxBytes)), 10, 64); n < 1 {
+		return errZeroingUnsupported
+	}
+
+	span := [2]uint64{uint64(handles.diskOffset + offset), uint64(length)}
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(handles.hDisk),
+		unix.BLKZEROOUT,
+		uintptr(unsafe.Pointer(&span[0])),
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// GetFreeSpace returns how many bytes can still be stored in the filesystem
+// holding path.
+func GetFreeSpace(path string) (int64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * stat.Bsize, nil
+}
+
+func FlushDiskCache(handles Handles) error {
+	return dropBufferCache(handles.hDisk)
+}
+
+func DiskIOMode(handles Handles) string {
+	if handles.diskDirect {
+		return "direct I/O"
+	}
+	return "buffered I/O, cache dropped"
+}
+
+func GetDiskAlignment(fd int) (int, error) {
+	logical, err := getDiskSectorSize(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	physical, err := getPhysicalSectorSize(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	return max(logical, physical, ioAlignment), nil
+}
+
 func GetNumDiskSector(fd int) (int64, int, error) {
 	diskSector, err := getDiskSectorSize(fd)
 	if err != nil {
@@ -147,27 +694,48 @@ func GetNumDiskSector(fd int) (int64, int, error) {
 	return diskNumSectors, diskSector, nil
 }
 
+// ReadSectorDataFromHandle fills data from sector startsector on. Reads that
+// return less than asked for are continued; only the end of the file may
+// leave data short.
 func ReadSectorDataFromHandle(
 	fd int,
 	data *[]byte,
 	startsector int64,
 	sectorsize int,
 ) error {
-	_, err := unix.Seek(fd, startsector*int64(sectorsize), unix.SEEK_SET)
-	if err != nil {
-		return err
+	offset := startsector * int64(sectorsize)
+	for done := 0; done < len(*data); {
+		n, err := unix.Pread(fd, (*data)[done:], offset+int64(done))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		done += n
 	}
-
-	_, err = unix.Read(fd, *data)
-	return err
+	return nil
 }
 
+// WriteSectorDataFromHandle writes data from sector startsector on, going on
+// after short writes until all of it is written.
 func WriteSectorDataFromHandle(fd int, data *[]byte, startsector int64, sectorsize int) error {
-	_, err := unix.Seek(fd, startsector*int64(sectorsize), unix.SEEK_SET)
-	if err != nil {
-		return err
+	offset := startsector * int64(sectorsize)
+	for done := 0; done < len(*data); {
+		n, err := unix.Pwrite(fd, (*data)[done:], offset+int64(done))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		done += n
 	}
-
-	_, err = unix.Write(fd, *data)
-	return err
+	return nil
 }
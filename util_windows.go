@@ -4,7 +4,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"syscall"
 
 	"golang.org/x/sys/windows"
@@ -14,6 +16,13 @@ type Handles struct {
 	hVolume windows.Handle
 	hDisk   windows.Handle
 	hImage  windows.Handle
+	// diskOffset and diskLength confine a job to a part of the drive, such as
+	// a partition. Sector numbers of the job count from diskOffset, and a
+	// diskLength of 0 stands for the rest of the drive.
+	diskOffset int64
+	diskLength int64
+	// imageOffset is where in the image the job starts reading.
+	imageOffset int64
 }
 
 const driveLetters string = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -23,8 +32,34 @@ func isPermAvailable() bool {
 	return elevated
 }
 
-func checkDrive(driveLetter string) bool {
-	handle, err := windows.CreateFile(
+var busTypeNames = map[STORAGE_BUS_TYPE]string{
+	BusTypeScsi:              "scsi",
+	BusTypeAtapi:             "atapi",
+	BusTypeAta:               "ata",
+	BusType1394:              "1394",
+	BusTypeUsb:               "usb",
+	BusTypeRAID:              "raid",
+	BusTypeiScsi:             "iscsi",
+	BusTypeSas:               "sas",
+	BusTypeSata:              "sata",
+	BusTypeSd:                "sd",
+	BusTypeMmc:               "mmc",
+	BusTypeVirtual:           "virtual",
+	BusTypeFileBackedVirtual: "vhd",
+	BusTypeSpaces:            "spaces",
+	BusTypeNvme:              "nvme",
+}
+
+func busTypeName(busType STORAGE_BUS_TYPE) string {
+	name, ok := busTypeNames[busType]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+func openVolume(driveLetter string) (windows.Handle, error) {
+	return windows.CreateFile(
 		windows.StringToUTF16Ptr(fmt.Sprintf("\\\\.\\%s", driveLetter)),
 		windows.FILE_READ_DATA,
 		windows.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
@@ -33,6 +68,32 @@ func checkDrive(driveLetter string) bool {
 		0,
 		0,
 	)
+}
+
+// systemDiskPath returns the physical drive Windows itself is installed on.
+func systemDiskPath() string {
+	windowsDir, err := windows.GetSystemWindowsDirectory()
+	if err != nil || len(windowsDir) < 2 {
+		return ""
+	}
+
+	handle, err := openVolume(windowsDir[:2])
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(handle)
+
+	devicePath, _ := getDevicePath(handle)
+	return devicePath
+}
+
+// checkDrive describes the drive behind a drive letter and reports whether
+// it should be listed: removable drives always are, any other fixed drive
+// only when showAll is set.
+func checkDrive(driveLetter string, showAll bool, systemDisk string) (Disk, bool) {
+	disk := Disk{Path: driveLetter}
+
+	handle, err := openVolume(driveLetter)
 
 	defer windows.CloseHandle(handle)
 	if err == nil && VerifyVolume(handle) {
@@ -42,14 +103,27 @@ func checkDrive(driveLetter string) bool {
 		if driveType == windows.DRIVE_FIXED || driveType == windows.DRIVE_REMOVABLE {
 			deviceDescriptor, err := GetStorageProperty(handle)
 			if err == nil {
-				if ((driveType == windows.DRIVE_REMOVABLE) && (deviceDescriptor.BusType != BusTypeSata)) ||
-					((driveType == windows.DRIVE_FIXED) && ((deviceDescriptor.BusType == BusTypeUsb) || (deviceDescriptor.BusType == BusTypeSd) || (deviceDescriptor.BusType == BusTypeMmc))) {
-					return true
+				disk.Bus = busTypeName(deviceDescriptor.BusType)
+				disk.Removable = ((driveType == windows.DRIVE_REMOVABLE) && (deviceDescriptor.BusType != BusTypeSata)) ||
+					((driveType == windows.DRIVE_FIXED) && ((deviceDescriptor.BusType == BusTypeUsb) || (deviceDescriptor.BusType == BusTypeSd) || (deviceDescriptor.BusType == BusTypeMmc)))
+				if disk.Removable || showAll {
+					devicePath, _ := getDevicePath(handle)
+					disk.System = len(systemDisk) > 0 && devicePath == systemDisk
+					if diskGeometry, err := GetDiskGeometry(handle); err == nil {
+						disk.Size = int64(diskGeometry.DiskSize)
+					}
+					if !IsDiskWritable(handle) {
+						disk.ReadOnly = true
+						disk.ReadOnlyReason = "The drive is write-protected, either by the lock switch\n" +
+							"on the card or its adapter, or by the readonly disk attribute\n" +
+							"(\"attributes disk clear readonly\" in diskpart)."
+					}
+					return disk, true
 				}
 			}
 		}
 	}
-	return false
+	return disk, false
 }
 
 func getDevicePath(hVolume windows.Handle) (string, error) {
@@ -68,15 +142,40 @@ func CloseRequiredHandles(handles Handles) {
 	windows.CloseHandle(handles.hImage)
 }
 
-func GetDisks() []string {
-	drives := []string{}
+func GetDiskIdentity(volPath string) (DiskIdentity, error) {
+	var identity DiskIdentity
+
+	handle, err := openVolume(volPath)
+	if err != nil {
+		return identity, err
+	}
+	defer windows.CloseHandle(handle)
+
+	identity.ByID, err = getDevicePath(handle)
+	if err != nil {
+		return identity, err
+	}
+	diskGeometry, err := GetDiskGeometry(handle)
+	if err != nil {
+		return identity, err
+	}
+	identity.Size = int64(diskGeometry.DiskSize)
+	identity.Vendor, identity.Model, identity.Serial, _ = GetStorageDeviceStrings(handle)
+	return identity, nil
+}
+
+// GetDisks lists the removable drives, or every fixed drive as well when
+// showAll is set.
+func GetDisks(showAll bool) []Disk {
+	drives := []Disk{}
 	driveMask, _ := windows.GetLogicalDrives()
+	systemDisk := systemDiskPath()
 
 	for i := 0; driveMask != 0; i++ {
 		if (driveMask & 1) == 1 {
 			driveLetter := string(driveLetters[i]) + ":"
-			if checkDrive(driveLetter) {
-				drives = append(drives, string(driveLetters[i])+":")
+			if disk, listed := checkDrive(driveLetter, showAll, systemDisk); listed {
+				drives = append(drives, disk)
 			}
 		}
 		driveMask >>= 1
@@ -84,6 +183,81 @@ func GetDisks() []string {
 	return drives
 }
 
+// SourceDevicePath is the path the data of a drive is read through when it
+// is the source of a clone: its physical drive, since a drive letter only
+// covers a single volume.
+func SourceDevicePath(disk Disk, identity DiskIdentity) string {
+	return identity.ByID
+}
+
+func SyncDisk(handles Handles) error {
+	return windows.FlushFileBuffers(handles.hDisk)
+}
+
+func SyncImage(handles Handles) error {
+	return windows.FlushFileBuffers(handles.hImage)
+}
+
+func IsRemovalError(volPath string, err error) bool {
+	return errors.Is(err, windows.ERROR_DEVICE_NOT_CONNECTED) ||
+		errors.Is(err, windows.ERROR_DEV_NOT_EXIST) ||
+		errors.Is(err, windows.ERROR_NO_SUCH_DEVICE) ||
+		errors.Is(err, windows.ERROR_NOT_READY) ||
+		errors.Is(err, windows.ERROR_NO_MEDIA_IN_DRIVE) ||
+		errors.Is(err, windows.ERROR_MEDIA_CHANGED)
+}
+
+// DiscardDisk is not available on Windows, which only trims the free space
+// of mounted volumes.
+func DiscardDisk(handles Handles, secure bool, offset int64, length int64) error {
+	return errors.New("Discarding a drive is not supported on Windows. Use another wipe method.")
+}
+
+// DiscardZeroesData is always false on Windows, which cannot discard a drive.
+func DiscardZeroesData(handles Handles) bool {
+	return false
+}
+
+// ZeroDisk is not available on Windows, so every chunk is written.
+func ZeroDisk(handles Handles, offset int64, length int64) error {
+	return errZeroingUnsupported
+}
+
+// GetFreeSpace returns how many bytes can still be stored on the volume
+// holding path.
+func GetFreeSpace(path string) (int64, error) {
+	var free uint64
+	err := windows.GetDiskFreeSpaceEx(windows.StringToUTF16Ptr(path), &free, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return int64(free), nil
+}
+
+func FlushDiskCache(handles Handles) error {
+	return windows.FlushFileBuffers(handles.hDisk)
+}
+
+func DiskIOMode(handles Handles) string {
+	return "unbuffered I/O"
+}
+
+func GetDiskAlignment(handle windows.Handle) (int, error) {
+	diskGeometry, err := GetDiskGeometry(handle)
+	if err != nil {
+		return 0, err
+	}
+	alignment := max(int(diskGeometry.Geometry.BytesPerSector), ioAlignment)
+
+	// Not every driver reports the access alignment; the logical sector size
+	// is still a valid alignment then.
+	alignmentDescriptor, err := GetStorageAccessAlignment(handle)
+	if err == nil {
+		alignment = max(alignment, int(alignmentDescriptor.BytesPerPhysicalSector))
+	}
+	return alignment, nil
+}
+
 func GetNumDiskSector(handle windows.Handle) (int64, int, error) {
 	diskGeometry, err := GetDiskGeometry(handle)
 	if err != nil {
@@ -99,11 +273,29 @@ func GetNumDiskSector(handle windows.Handle) (int64, int, error) {
 }
 
 /* To get physical handle, first get volume handle */
-func GetRequiredHandles(handles *Handles, taskType TaskType, volPath string, imgPath string) error {
+func GetRequiredHandles(
+	handles *Handles,
+	taskType TaskType,
+	volPath string,
+	identity DiskIdentity,
+	imgPath string,
+) error {
 	var err error
 	var diskAccess, imageAccess, diskFileFlags, imageFileFlags uint32
 
-	if taskType == START_WRITE {
+	err = CheckDiskIdentity(volPath, identity)
+	if err != nil {
+		return err
+	}
+
+	if taskType == START_WRITE ||
+		taskType == START_CLONE ||
+		taskType == START_WIPE ||
+		taskType == START_FORMAT ||
+		taskType == START_RESTORE ||
+		taskType == START_TABLE_RESTORE ||
+		taskType == START_BOARD ||
+		taskType == START_COMPOSE {
 		diskAccess = windows.GENERIC_READ | windows.GENERIC_WRITE
 		imageAccess = windows.GENERIC_READ
 		diskFileFlags = windows.FILE_FLAG_WRITE_THROUGH | windows.FILE_FLAG_NO_BUFFERING
@@ -137,6 +329,10 @@ func GetRequiredHandles(handles *Handles, taskType TaskType, volPath string, img
 		windows.CloseHandle(handles.hVolume)
 		return err
 	}
+	if devicePath != identity.ByID {
+		windows.CloseHandle(handles.hVolume)
+		return fmt.Errorf("%s changed while it was being opened", volPath)
+	}
 	err = LockVolume(handles.hVolume)
 	if err != nil {
 		windows.CloseHandle(handles.hVolume)
@@ -164,6 +360,12 @@ func GetRequiredHandles(handles *Handles, taskType TaskType, volPath string, img
 		return err
 	}
 
+	// Only writing, reading, verifying and cloning use an image handle.
+	if taskType != START_WRITE && taskType != START_CLONE && taskType != START_VERIFY && taskType != START_READ {
+		handles.hImage = windows.InvalidHandle
+		return nil
+	}
+
 	handles.hImage, err = windows.CreateFile(
 		windows.StringToUTF16Ptr(imgPath),
 		imageAccess,
@@ -182,6 +384,9 @@ func GetRequiredHandles(handles *Handles, taskType TaskType, volPath string, img
 	return nil
 }
 
+// ReadSectorDataFromHandle fills data from sector startsector on. Reads that
+// return less than asked for are continued; only the end of the file may
+// leave data short.
 func ReadSectorDataFromHandle(
 	hRead windows.Handle,
 	data *[]byte,
@@ -192,10 +397,21 @@ func ReadSectorDataFromHandle(
 	if err != nil {
 		return err
 	}
-	_, err = windows.Read(hRead, *data)
-	return err
+	for done := 0; done < len(*data); {
+		n, err := windows.Read(hRead, (*data)[done:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		done += n
+	}
+	return nil
 }
 
+// WriteSectorDataFromHandle writes data from sector startsector on, going on
+// after short writes until all of it is written.
 func WriteSectorDataFromHandle(
 	hWrite windows.Handle,
 	data *[]byte,
@@ -206,7 +422,15 @@ func WriteSectorDataFromHandle(
 	if err != nil {
 		return err
 	}
-
-	_, err = windows.Write(hWrite, *data)
-	return err
+	for done := 0; done < len(*data); {
+		n, err := windows.Write(hWrite, (*data)[done:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		done += n
+	}
+	return nil
 }
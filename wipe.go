@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// WipeMethod is how a wipe erases a drive.
+type WipeMethod int
+
+const (
+	WIPE_ZERO WipeMethod = iota
+	WIPE_RANDOM
+	// WIPE_MULTI_PASS overwrites the drive with zeros, then ones, then
+	// random data.
+	WIPE_MULTI_PASS
+	// WIPE_DISCARD and WIPE_SECURE_DISCARD have the drive itself drop its
+	// data, which is quick on flash but only where the drive supports it.
+	WIPE_DISCARD
+	WIPE_SECURE_DISCARD
+)
+
+var wipeMethodNames = []string{"zero", "random", "multi-pass", "discard", "secure-discard"}
+
+var wipeMethodDescriptions = []string{
+	"Fill with zeros",
+	"Fill with random data",
+	"Three passes: zeros, ones, random data",
+	"Discard (TRIM)",
+	"Secure discard",
+}
+
+func (method WipeMethod) String() string {
+	return wipeMethodNames[method]
+}
+
+func (method WipeMethod) Description() string {
+	return wipeMethodDescriptions[method]
+}
+
+func ParseWipeMethod(name string) (WipeMethod, error) {
+	for i, methodName := range wipeMethodNames {
+		if methodName == name {
+			return WipeMethod(i), nil
+		}
+	}
+	return WIPE_ZERO, fmt.Errorf("unknown wipe method %q", name)
+}
+
+var errCancelled = errors.New("The job was cancelled.")
+
+// errNotVerifiable is returned when a discarded drive does not read back
+// erased. Drives may return anything for discarded sectors, so this does not
+// mean the wipe failed.
+var errNotVerifiable = errors.New("The drive does not read back zeros or ones after a discard.")
+
+// wipePattern is what a pass writes. fill puts into buf what belongs at byte
+// offset of the drive, so the pattern can be written and checked piecewise.
+type wipePattern struct {
+	name string
+	fill func(buf []byte, offset int64)
+}
+
+func constantPattern(name string, value byte) wipePattern {
+	return wipePattern{name, func(buf []byte, offset int64) {
+		for i := range buf {
+			buf[i] = value
+		}
+	}}
+}
+
+// randomPattern is an AES-CTR keystream under a key drawn for the pass. It
+// cannot be told from random data without the key, and the key lets the
+// pass be verified without storing what was written.
+func randomPattern() (wipePattern, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return wipePattern{}, errors.Join(errors.New("randomPattern(): Read failed"), err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return wipePattern{}, errors.Join(errors.New("randomPattern(): NewCipher failed"), err)
+	}
+
+	return wipePattern{"random data", func(buf []byte, offset int64) {
+		iv := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(offset/aes.BlockSize))
+		clear(buf)
+		cipher.NewCTR(block, iv).XORKeyStream(buf, buf)
+	}}, nil
+}
+
+func wipePasses(method WipeMethod) ([]wipePattern, error) {
+	switch method {
+	case WIPE_ZERO:
+		return []wipePattern{constantPattern("zeros", 0x00)}, nil
+	case WIPE_RANDOM:
+		random, err := randomPattern()
+		return []wipePattern{random}, err
+	case WIPE_MULTI_PASS:
+		random, err := randomPattern()
+		return []wipePattern{
+			constantPattern("zeros", 0x00),
+			constantPattern("ones", 0xFF),
+			random,
+		}, err
+	}
+	return nil, nil
+}
+
+// isErased tells whether chunk reads back the way discarded flash does,
+// as all zeros or all ones.
+func isErased(chunk []byte) bool {
+	if len(chunk) < 1 || (chunk[0] != 0x00 && chunk[0] != 0xFF) {
+		return false
+	}
+	return bytes.Count(chunk, chunk[:1]) == len(chunk)
+}
+
+// diskGeometry is the geometry of the drive a job works on as a whole.
+type diskGeometry struct {
+	sectorSize int
+	numSectors int64
+	alignment  int
+	pool       *BufferPool
+}
+
+func getDiskGeometry(handles Handles) (diskGeometry, error) {
+	var layout diskGeometry
+	var err error
+	layout.numSectors, layout.sectorSize, err = GetNumDiskSector(handles.hDisk)
+	if err != nil {
+		return layout, errors.Join(errors.New("getDiskGeometry(): GetNumDiskSector failed"), err)
+	}
+	layout.alignment, err = GetDiskAlignment(handles.hDisk)
+	if err != nil {
+		return layout, errors.Join(errors.New("getDiskGeometry(): GetDiskAlignment failed"), err)
+	}
+	layout.pool = NewBufferPool(layout.sectorSize*1024, layout.alignment)
+	return layout, nil
+}
+
+// wipeChunks calls step for every chunk of the drive in order and keeps the
+// progress up to date. It stops at the first error or when the job is
+// cancelled.
+func wipeChunks(data *MainData, ui Frontend, layout diskGeometry, step func(chunk []byte, i int64) error) error {
+	buf := layout.pool.Get()
+	defer layout.pool.Put(buf)
+	lasti := int64(0)
+	updateTimer := time.Now()
+
+	ui.SetProgress(0, layout.numSectors)
+	for i := int64(0); i < layout.numSectors; i += 1024 {
+		select {
+		case <-data.bQuitTask:
+			return errCancelled
+		default:
+			chunk := buf[:chunkSectors(i, layout.numSectors)*int64(layout.sectorSize)]
+			err := step(chunk, i)
+			if err != nil {
+				return err
+			}
+
+			ui.SetProgress(i+int64(len(chunk)/layout.sectorSize), layout.numSectors)
+			if updateSpeed(ui, layout.sectorSize, i-lasti, updateTimer) {
+				lasti = i
+				updateTimer = time.Now()
+			}
+		}
+	}
+	return nil
+}
+
+// stepSectors calls op for the sectors from start to end in steps of 1 GiB,
+// so that an operation the drive carries out by itself shows progress and
+// can be cancelled. op gets byte offsets.
+func stepSectors(
+	data *MainData,
+	ui Frontend,
+	sectorSize int,
+	start int64,
+	end int64,
+	op func(offset int64, length int64) error,
+) error {
+	step := int64(1<<30) / int64(sectorSize)
+	ui.SetProgress(0, end-start)
+	for i := start; i < end; i += step {
+		select {
+		case <-data.bQuitTask:
+			return errCancelled
+		default:
+			numSectors := min(step, end-i)
+			err := op(i*int64(sectorSize), numSectors*int64(sectorSize))
+			if err != nil {
+				return err
+			}
+			ui.SetProgress(i+numSectors-start, end-start)
+		}
+	}
+	return nil
+}
+
+// discardSectors has the drive discard the sectors from start to end.
+func discardSectors(
+	data *MainData,
+	ui Frontend,
+	handles Handles,
+	sectorSize int,
+	start int64,
+	end int64,
+	secure bool,
+) error {
+	return stepSectors(data, ui, sectorSize, start, end, func(offset int64, length int64) error {
+		err := DiscardDisk(handles, secure, offset, length)
+		if err != nil {
+			return errors.Join(errors.New("discardSectors(): DiscardDisk failed"), err)
+		}
+		return nil
+	})
+}
+
+func wipe(data *MainData, ui Frontend, handles Handles, layout diskGeometry, passes []wipePattern) error {
+	for n, pattern := range passes {
+		ui.SetStatus(fmt.Sprintf("Pass %d of %d: writing %s...", n+1, len(passes), pattern.name))
+		err := wipeChunks(data, ui, layout, func(chunk []byte, i int64) error {
+			pattern.fill(chunk, i*int64(layout.sectorSize))
+			err := writeDiskChunk(data, handles, chunk, i, layout.sectorSize, layout.alignment)
+			if err == nil && ((i/1024)%16 == 15 || i+1024 >= layout.numSectors) {
+				err = SyncDisk(handles)
+			}
+			if err != nil {
+				return errors.Join(errors.New("WipeDisk(): writeDiskChunk failed"), err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if data.wipeMethod == WIPE_DISCARD || data.wipeMethod == WIPE_SECURE_DISCARD {
+		ui.SetStatus("Discarding...")
+		err := discardSectors(
+			data,
+			ui,
+			handles,
+			layout.sectorSize,
+			0,
+			layout.numSectors,
+			data.wipeMethod == WIPE_SECURE_DISCARD,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !data.verify {
+		return nil
+	}
+	err := FlushDiskCache(handles)
+	if err != nil {
+		return errors.Join(errors.New("WipeDisk(): FlushDiskCache failed"), err)
+	}
+	ui.SetStatus("Verifying (" + DiskIOMode(handles) + ")...")
+
+	expected := layout.pool.Get()
+	defer layout.pool.Put(expected)
+	return wipeChunks(data, ui, layout, func(chunk []byte, i int64) error {
+		err := readDiskChunk(data, handles, chunk, i, layout.sectorSize, layout.alignment)
+		if err != nil {
+			return errors.Join(errors.New("WipeDisk(): readDiskChunk failed"), err)
+		}
+
+		if len(passes) < 1 {
+			if !isErased(chunk) {
+				return errNotVerifiable
+			}
+			return nil
+		}
+		pattern := expected[:len(chunk)]
+		passes[len(passes)-1].fill(pattern, i*int64(layout.sectorSize))
+		if !bytes.Equal(chunk, pattern) {
+			return fmt.Errorf("Verification failed at sector: %d", i)
+		}
+		return nil
+	})
+}
+
+// WipeDisk erases the selected drive with the method of data and issues a
+// certificate for the outcome.
+func WipeDisk(data *MainData, ui Frontend, handles Handles) {
+	elapsedTimer := time.Now()
+	data.bQuitTimer = StartTimer(elapsedTimer, ui)
+
+	layout, err := getDiskGeometry(handles)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("WipeDisk(): getDiskGeometry failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+
+	passes, err := wipePasses(data.wipeMethod)
+	if err != nil {
+		ui.HandleError(data, errors.Join(errors.New("WipeDisk(): wipePasses failed"), err))
+		cleanUp(data, ui, handles)
+		return
+	}
+
+	certificate := NewWipeCertificate(data)
+	certificate.SectorSize = layout.sectorSize
+	certificate.Sectors = layout.numSectors
+	for _, pass := range passes {
+		certificate.Passes = append(certificate.Passes, pass.name)
+	}
+
+	go func() {
+		defer func() { cleanUp(data, ui, handles) }()
+
+		err := wipe(data, ui, handles, layout, passes)
+		if errors.Is(err, errNotVerifiable) {
+			certificate.Verification = "not verifiable"
+			data.report.AddNote("Not verified: %s", err)
+			err = nil
+		}
+		certificate.Finish(err)
+		certificatePath, saveErr := certificate.Save()
+		if saveErr != nil {
+			log.Printf("WipeDisk(): %s", saveErr)
+		} else {
+			data.report.AddNote("Certificate: %s", certificatePath)
+		}
+
+		if errors.Is(err, errCancelled) {
+			return
+		}
+		err = errors.Join(err, saveErr)
+		if err != nil {
+			ui.HandleError(data, err)
+			return
+		}
+		message := "Drive wiped."
+		if certificate.Verification == "not verifiable" {
+			message += "\nIt could not be verified, since the drive does not read back zeros or ones after a discard."
+		}
+		ui.HandleSuccess(fmt.Sprintf("%s\nCertificate: %s", message, certificatePath))
+	}()
+}